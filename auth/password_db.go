@@ -0,0 +1,207 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/tscolari/memcached-broker/storage"
+)
+
+var errInvalidCredentials = errors.New("Invalid credentials")
+
+//go:generate counterfeiter . Authenticator
+
+// Authenticator controls who can authenticate against an instance.
+type Authenticator interface {
+	Grant(instanceID string, credentials storage.Credentials) error
+	Revoke(instanceID, username string) error
+	Remove(instanceID string) error
+}
+
+// Server serves the instances to the users in their password databases, and
+// is told when those change.
+type Server interface {
+	// Reload lets the users of the instance in, as they are now.
+	Reload(instanceID string) error
+
+	// Disconnect drops the connections the user authenticated on the
+	// instance.
+	Disconnect(instanceID, username string) error
+}
+
+func NewPasswordDB(directory string) (*PasswordDB, error) {
+	err := os.MkdirAll(directory, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PasswordDB{
+		directory: directory,
+	}, nil
+}
+
+// PasswordDB keeps a password database per instance, in the format of the
+// auth file memcached reads with `-Y`: one `username:password` line per
+// user. Clients authenticate with the text protocol, their first command is
+// a `set` of "username password" for any key. The embedded server and the
+// proxy of the shared plans authenticate them the same way. Neither of them
+// speaks SASL.
+//
+// Grant and Revoke have the Server reload the users of the instance. Revoke
+// then asks it to drop the connections the user authenticated before, which
+// it does where it can without affecting the other users.
+type PasswordDB struct {
+	Server Server
+
+	directory string
+	lock      sync.Mutex
+}
+
+// Path is the password database of the instance.
+func (p *PasswordDB) Path(instanceID string) string {
+	return filepath.Join(p.directory, instanceID+".pwdb")
+}
+
+// Grant adds the user to the instance, replacing its password if it's
+// there already.
+func (p *PasswordDB) Grant(instanceID string, credentials storage.Credentials) error {
+	if !validField(credentials.Username) || !validField(credentials.Password) {
+		return errInvalidCredentials
+	}
+
+	err := p.change(instanceID, func(users map[string]string) {
+		users[credentials.Username] = credentials.Password
+	})
+	if err != nil || p.Server == nil {
+		return err
+	}
+
+	return p.Server.Reload(instanceID)
+}
+
+// Revoke removes the user from the instance, and then disconnects it. The
+// user is disconnected even when it was removed already, so retrying a
+// Revoke that failed to disconnect it does.
+func (p *PasswordDB) Revoke(instanceID, username string) error {
+	err := p.change(instanceID, func(users map[string]string) {
+		delete(users, username)
+	})
+	if err != nil || p.Server == nil {
+		return err
+	}
+
+	err = p.Server.Reload(instanceID)
+	if err != nil {
+		return err
+	}
+
+	return p.Server.Disconnect(instanceID, username)
+}
+
+// Remove deletes the password database of the instance.
+func (p *PasswordDB) Remove(instanceID string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	err := os.Remove(p.Path(instanceID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Users returns the users of the instance and their passwords.
+func (p *PasswordDB) Users(instanceID string) (map[string]string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.read(instanceID)
+}
+
+func (p *PasswordDB) change(instanceID string, change func(users map[string]string)) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	users, err := p.read(instanceID)
+	if err != nil {
+		return err
+	}
+
+	change(users)
+	return p.write(instanceID, users)
+}
+
+func (p *PasswordDB) read(instanceID string) (map[string]string, error) {
+	users := map[string]string{}
+
+	rawData, err := ioutil.ReadFile(p.Path(instanceID))
+	if os.IsNotExist(err) {
+		return users, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(rawData))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Corrupt password database %s", p.Path(instanceID))
+		}
+
+		users[fields[0]] = fields[1]
+	}
+
+	return users, scanner.Err()
+}
+
+// write replaces the password database in one step, so memcached never
+// reads it half written.
+func (p *PasswordDB) write(instanceID string, users map[string]string) error {
+	var buffer bytes.Buffer
+	for _, username := range sortedKeys(users) {
+		fmt.Fprintf(&buffer, "%s:%s\n", username, users[username])
+	}
+
+	file, err := ioutil.TempFile(p.directory, instanceID+".pwdb.")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(buffer.Bytes())
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), p.Path(instanceID))
+}
+
+func validField(field string) bool {
+	return field != "" && !strings.ContainsAny(field, ":\r\n")
+}
+
+func sortedKeys(users map[string]string) []string {
+	usernames := make([]string, 0, len(users))
+	for username := range users {
+		usernames = append(usernames, username)
+	}
+
+	sort.Strings(usernames)
+	return usernames
+}
@@ -0,0 +1,227 @@
+package auth_test
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tscolari/cf-broker-api/common/repository"
+	"github.com/tscolari/memcached-broker/auth"
+	"github.com/tscolari/memcached-broker/memcache"
+	"github.com/tscolari/memcached-broker/storage"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type failingServer struct {
+	reloadError     error
+	disconnectError error
+}
+
+func (s failingServer) Reload(instanceID string) error {
+	return s.reloadError
+}
+
+func (s failingServer) Disconnect(instanceID, username string) error {
+	return s.disconnectError
+}
+
+var _ = Describe("PasswordDB", func() {
+	var directory string
+	var passwordDB *auth.PasswordDB
+
+	BeforeEach(func() {
+		var err error
+		directory, err = ioutil.TempDir("/tmp/", "auth")
+		Expect(err).ToNot(HaveOccurred())
+
+		passwordDB, err = auth.NewPasswordDB(filepath.Join(directory, "pwdb"))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(directory)
+	})
+
+	readFile := func(instanceID string) string {
+		rawData, err := ioutil.ReadFile(passwordDB.Path(instanceID))
+		Expect(err).ToNot(HaveOccurred())
+		return string(rawData)
+	}
+
+	Describe("Path", func() {
+		It("is a file per instance in the directory", func() {
+			Expect(passwordDB.Path("instance-1")).To(Equal(filepath.Join(directory, "pwdb", "instance-1.pwdb")))
+		})
+	})
+
+	Describe("Grant", func() {
+		It("writes the user in the memcached format", func() {
+			err := passwordDB.Grant("instance-1", storage.Credentials{Username: "user-b", Password: "secret-b"})
+			Expect(err).ToNot(HaveOccurred())
+			err = passwordDB.Grant("instance-1", storage.Credentials{Username: "user-a", Password: "secret-a"})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(readFile("instance-1")).To(Equal("user-a:secret-a\nuser-b:secret-b\n"))
+		})
+
+		It("keeps the instances apart", func() {
+			err := passwordDB.Grant("instance-1", storage.Credentials{Username: "user-1", Password: "secret-1"})
+			Expect(err).ToNot(HaveOccurred())
+			err = passwordDB.Grant("instance-2", storage.Credentials{Username: "user-2", Password: "secret-2"})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(readFile("instance-1")).To(Equal("user-1:secret-1\n"))
+			Expect(readFile("instance-2")).To(Equal("user-2:secret-2\n"))
+		})
+
+		It("replaces the password of a known user", func() {
+			err := passwordDB.Grant("instance-1", storage.Credentials{Username: "user", Password: "old"})
+			Expect(err).ToNot(HaveOccurred())
+			err = passwordDB.Grant("instance-1", storage.Credentials{Username: "user", Password: "new"})
+			Expect(err).ToNot(HaveOccurred())
+
+			users, err := passwordDB.Users("instance-1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(users).To(Equal(map[string]string{"user": "new"}))
+		})
+
+		It("leaves no temporary files behind", func() {
+			err := passwordDB.Grant("instance-1", storage.Credentials{Username: "user", Password: "secret"})
+			Expect(err).ToNot(HaveOccurred())
+
+			files, err := ioutil.ReadDir(filepath.Join(directory, "pwdb"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).To(HaveLen(1))
+		})
+
+		Context("when the Server can't reload the users", func() {
+			It("fails", func() {
+				passwordDB.Server = failingServer{reloadError: errors.New("can't reload")}
+
+				err := passwordDB.Grant("instance-1", storage.Credentials{Username: "user", Password: "secret"})
+				Expect(err).To(MatchError("can't reload"))
+			})
+		})
+
+		Context("when the credentials can't be written in the format", func() {
+			It("fails", func() {
+				for _, credentials := range []storage.Credentials{
+					{Username: "", Password: "secret"},
+					{Username: "user", Password: ""},
+					{Username: "us:er", Password: "secret"},
+					{Username: "user", Password: "sec\nret"},
+				} {
+					err := passwordDB.Grant("instance-1", credentials)
+					Expect(err).To(MatchError("Invalid credentials"))
+				}
+			})
+		})
+	})
+
+	Describe("Revoke", func() {
+		BeforeEach(func() {
+			err := passwordDB.Grant("instance-1", storage.Credentials{Username: "user-1", Password: "secret-1"})
+			Expect(err).ToNot(HaveOccurred())
+			err = passwordDB.Grant("instance-1", storage.Credentials{Username: "user-2", Password: "secret-2"})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("removes the user", func() {
+			Expect(passwordDB.Revoke("instance-1", "user-1")).To(Succeed())
+			Expect(readFile("instance-1")).To(Equal("user-2:secret-2\n"))
+		})
+
+		Context("when the user is unknown", func() {
+			It("succeeds", func() {
+				Expect(passwordDB.Revoke("instance-1", "user-3")).To(Succeed())
+				Expect(passwordDB.Revoke("instance-2", "user-1")).To(Succeed())
+			})
+		})
+
+		Context("with a Server", func() {
+			var server *memcache.Server
+			var connection net.Conn
+			var reader *bufio.Reader
+
+			BeforeEach(func() {
+				server = memcache.New(map[string]int{}, passwordDB.Users)
+				passwordDB.Server = server
+				Expect(server.Start(repository.Instance{ID: "instance-1", Host: "127.0.0.1", Port: "0"})).To(Succeed())
+
+				address, _ := server.Address("instance-1")
+				var err error
+				connection, err = net.Dial("tcp", address.String())
+				Expect(err).ToNot(HaveOccurred())
+				reader = bufio.NewReader(connection)
+
+				connection.SetDeadline(time.Now().Add(time.Second))
+				fmt.Fprint(connection, "set auth 0 0 15\r\nuser-1 secret-1\r\n")
+				Expect(reader.ReadString('\n')).To(Equal("STORED\r\n"))
+			})
+
+			AfterEach(func() {
+				Expect(server.Stop("instance-1")).To(Succeed())
+			})
+
+			It("closes the connections the user authenticated before", func() {
+				Expect(passwordDB.Revoke("instance-1", "user-1")).To(Succeed())
+
+				connection.SetDeadline(time.Now().Add(time.Second))
+				fmt.Fprint(connection, "get key\r\n")
+				_, err := reader.ReadString('\n')
+				Expect(err).To(HaveOccurred())
+			})
+
+			Context("when reloading the users fails", func() {
+				It("fails", func() {
+					passwordDB.Server = failingServer{reloadError: errors.New("can't reload")}
+					Expect(passwordDB.Revoke("instance-1", "user-1")).To(MatchError("can't reload"))
+				})
+			})
+
+			Context("when disconnecting fails", func() {
+				It("fails", func() {
+					passwordDB.Server = failingServer{disconnectError: errors.New("can't disconnect")}
+					Expect(passwordDB.Revoke("instance-1", "user-1")).To(MatchError("can't disconnect"))
+				})
+			})
+		})
+	})
+
+	Describe("Remove", func() {
+		It("deletes the password database of the instance", func() {
+			err := passwordDB.Grant("instance-1", storage.Credentials{Username: "user", Password: "secret"})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(passwordDB.Remove("instance-1")).To(Succeed())
+			_, err = os.Stat(passwordDB.Path("instance-1"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		Context("when the instance has no password database", func() {
+			It("succeeds", func() {
+				Expect(passwordDB.Remove("instance-1")).To(Succeed())
+			})
+		})
+	})
+
+	Describe("Users", func() {
+		Context("when the file is corrupt", func() {
+			It("fails", func() {
+				err := ioutil.WriteFile(passwordDB.Path("instance-1"), []byte("no separator\n"), 0600)
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = passwordDB.Users("instance-1")
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("Corrupt password database"))
+			})
+		})
+	})
+})
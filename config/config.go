@@ -3,14 +3,60 @@ package config
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 
 	"github.com/tscolari/memcached-broker/app"
+	"github.com/tscolari/memcached-broker/inventory"
+	"github.com/tscolari/memcached-broker/middleware"
+	"github.com/tscolari/memcached-broker/proxy"
+	"github.com/tscolari/memcached-broker/runner"
+	"github.com/tscolari/memcached-broker/storage"
 	"gopkg.in/yaml.v2"
 )
 
+const (
+	DefaultStorageBackend = "local_file"
+	DefaultStateFile      = "/tmp/data"
+	DefaultNodeHost       = "127.0.0.1"
+	DefaultNodePortRange  = "11211-11310"
+	DefaultAuthDirectory  = "/tmp/auth"
+	DefaultPidDirectory   = "/tmp/memcached"
+)
+
 type Config struct {
-	Catalog   app.CfbrokerCatalog `yaml:"catalog"`
-	StateFile string              `yaml:"state_file"`
+	Catalog app.CfbrokerCatalog `yaml:"catalog"`
+	Storage storage.Config      `yaml:"storage"`
+
+	// Credentials are what the platform authenticates with. Any of them is
+	// accepted, so they can be rotated without downtime.
+	Credentials []middleware.Credentials `yaml:"credentials"`
+
+	// Nodes are the memcached hosts and ports instances get placed on. The
+	// broker runs the memcached of every instance itself, so each host has
+	// to be an address of this machine.
+	Nodes []inventory.Node `yaml:"nodes"`
+
+	// AuthDirectory holds the auth file of each instance, with the users
+	// of its bindings.
+	AuthDirectory string `yaml:"auth_directory"`
+
+	// Runner configures the memcached processes run for the instances. Their
+	// memory limit, in megabytes, is the size of their plan in
+	// storage.plan_sizes.
+	Runner runner.Config `yaml:"runner"`
+
+	// Embedded serves the instances from inside the broker instead of
+	// running a memcached for each of them. Their data doesn't survive a
+	// restart of the broker.
+	Embedded bool `yaml:"embedded"`
+
+	// Proxy serves the instances of shared plans from a single memcached.
+	// It's off unless proxy.listen is set.
+	Proxy proxy.Config `yaml:"proxy"`
+
+	// StateFile is the storage path used when the storage section doesn't
+	// set one. Deprecated: use storage.path instead.
+	StateFile string `yaml:"state_file"`
 }
 
 func Load(filePath string) (Config, error) {
@@ -25,5 +71,79 @@ func Load(filePath string) (Config, error) {
 func Parse(data []byte) (Config, error) {
 	var config Config
 	err := yaml.Unmarshal(data, &config)
-	return config, err
+	if err != nil {
+		return config, err
+	}
+
+	if config.Storage.Backend == "" {
+		config.Storage.Backend = DefaultStorageBackend
+	}
+
+	if config.Storage.Path == "" {
+		config.Storage.Path = config.StateFile
+	}
+
+	if config.Storage.Path == "" {
+		config.Storage.Path = DefaultStateFile
+	}
+
+	if config.AuthDirectory == "" {
+		config.AuthDirectory = DefaultAuthDirectory
+	}
+
+	if config.Runner.Binary == "" {
+		config.Runner.Binary = runner.DefaultBinary
+	}
+
+	if config.Runner.Directory == "" {
+		config.Runner.Directory = DefaultPidDirectory
+	}
+
+	if len(config.Nodes) == 0 {
+		config.Nodes = []inventory.Node{{Host: DefaultNodeHost, PortRange: DefaultNodePortRange}}
+	}
+
+	return config, validateNodes(config.Nodes)
+}
+
+// validateNodes fails on a node on another machine, where neither the
+// runner nor the embedded server can start memcached.
+func validateNodes(nodes []inventory.Node) error {
+	for _, node := range nodes {
+		if !localHost(node.Host) {
+			return fmt.Errorf("Node %s isn't an address of this machine, memcached can only be run here", node.Host)
+		}
+	}
+
+	return nil
+}
+
+// localHost tells whether the host is an address memcached can listen on
+// here.
+func localHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+
+	addresses, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, address := range addresses {
+		if network, ok := address.(*net.IPNet); ok && network.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
 }
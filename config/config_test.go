@@ -1,7 +1,14 @@
 package config_test
 
 import (
+	"net"
+
 	"github.com/tscolari/memcached-broker/config"
+	"github.com/tscolari/memcached-broker/inventory"
+	"github.com/tscolari/memcached-broker/middleware"
+	"github.com/tscolari/memcached-broker/proxy"
+	"github.com/tscolari/memcached-broker/runner"
+	"github.com/tscolari/memcached-broker/storage"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -15,6 +22,34 @@ var _ = Describe("Config", func() {
 			Expect(err).ToNot(HaveOccurred())
 
 			Expect(len(config.Catalog.Services)).To(Equal(1))
+			Expect(config.Credentials).To(Equal([]middleware.Credentials{
+				{Username: "broker", Password: "old-secret"},
+				{Username: "broker", Password: "new-secret"},
+			}))
+			Expect(config.Storage.Backend).To(Equal("local_file"))
+			Expect(config.Storage.Capacity).To(Equal(1124))
+			Expect(config.Storage.PlanSizes).To(Equal(map[string]int{
+				"first-plan-id":  100,
+				"second-plan-id": 1024,
+			}))
+			Expect(config.Nodes).To(Equal([]inventory.Node{
+				{Host: "127.0.0.1", PortRange: "11211-11220"},
+				{Host: "127.0.0.2", Ports: []int{11211, 11311}},
+			}))
+			Expect(config.AuthDirectory).To(Equal("/var/vcap/store/broker/auth"))
+			Expect(config.Runner).To(Equal(runner.Config{
+				Binary:    "/var/vcap/packages/memcached/bin/memcached",
+				Directory: "/var/vcap/sys/run/memcached",
+				User:      "vcap",
+			}))
+			Expect(config.Embedded).To(BeFalse())
+			Expect(config.Proxy).To(Equal(proxy.Config{
+				Listen:  "0.0.0.0:11211",
+				Host:    "10.0.0.9",
+				Port:    "11211",
+				Backend: "10.0.0.10:11211",
+				Plans:   []string{"first-plan-id"},
+			}))
 		})
 
 		Context("when the file doesn't exist", func() {
@@ -48,6 +83,99 @@ catalog:
 			Expect(config.Catalog.Services[0].ID).To(Equal("service-id"))
 		})
 
+		It("parses the storage section", func() {
+			data := `---
+storage:
+  backend: sql
+  capacity: 10
+  driver: sqlite3
+  data_source: /var/vcap/store/broker/state.db`
+
+			config, err := config.Parse([]byte(data))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(config.Storage).To(Equal(storage.Config{
+				Backend:    "sql",
+				Path:       "/tmp/data",
+				Capacity:   10,
+				Driver:     "sqlite3",
+				DataSource: "/var/vcap/store/broker/state.db",
+			}))
+		})
+
+		Context("when the storage section is missing", func() {
+			It("uses a local file", func() {
+				config, err := config.Parse([]byte("---\nstate_file: /var/vcap/store/broker/state.yml"))
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(config.Storage.Backend).To(Equal("local_file"))
+				Expect(config.Storage.Path).To(Equal("/var/vcap/store/broker/state.yml"))
+			})
+		})
+
+		Context("when no nodes are configured", func() {
+			It("uses a port range on the local host", func() {
+				config, err := config.Parse([]byte("---\ncatalog: {}"))
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(config.Nodes).To(Equal([]inventory.Node{
+					{Host: "127.0.0.1", PortRange: "11211-11310"},
+				}))
+			})
+		})
+
+		Context("when a node is on another machine", func() {
+			It("fails", func() {
+				_, err := config.Parse([]byte("---\nnodes:\n- host: 192.0.2.1\n  port_range: 11211-11220"))
+				Expect(err).To(MatchError("Node 192.0.2.1 isn't an address of this machine, memcached can only be run here"))
+			})
+		})
+
+		Context("when a node is an address of this machine", func() {
+			It("accepts it", func() {
+				addresses, err := net.InterfaceAddrs()
+				Expect(err).ToNot(HaveOccurred())
+
+				for _, address := range addresses {
+					network, ok := address.(*net.IPNet)
+					if !ok {
+						continue
+					}
+
+					_, err := config.Parse([]byte("---\nnodes:\n- host: \"" + network.IP.String() + "\"\n  port_range: 11211-11220"))
+					Expect(err).ToNot(HaveOccurred())
+				}
+			})
+		})
+
+		Context("when no auth directory is configured", func() {
+			It("uses one in /tmp", func() {
+				config, err := config.Parse([]byte("---\ncatalog: {}"))
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(config.AuthDirectory).To(Equal("/tmp/auth"))
+			})
+		})
+
+		Context("when the runner isn't configured", func() {
+			It("runs memcached from the PATH", func() {
+				config, err := config.Parse([]byte("---\ncatalog: {}"))
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(config.Runner).To(Equal(runner.Config{
+					Binary:    "memcached",
+					Directory: "/tmp/memcached",
+				}))
+			})
+		})
+
+		It("parses the embedded flag", func() {
+			config, err := config.Parse([]byte("---\nembedded: true"))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(config.Embedded).To(BeTrue())
+		})
+
 		Context("when the data is not a valid yaml", func() {
 			It("fails", func() {
 				data := "not-yaml"
@@ -1,41 +1,192 @@
 package controllers
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+
 	"github.com/raphael/goa"
 	"github.com/tscolari/cf-broker-api/common/repository"
 	"github.com/tscolari/memcached-broker/app"
+	"github.com/tscolari/memcached-broker/auth"
+	"github.com/tscolari/memcached-broker/proxy"
+	"github.com/tscolari/memcached-broker/storage"
+	"github.com/tscolari/memcached-broker/worker"
 )
 
 type Binding struct {
 	goa.Controller
-	state repository.State
+	state         storage.Storage
+	authenticator auth.Authenticator
+
+	// router serves the instances of shared plans, it's nil when there is
+	// no proxy.
+	router proxy.Router
+
+	// queue runs the operations of requests that accept to finish in the
+	// background.
+	queue worker.Queue
+}
+
+// access lets the users of bindings in to an instance.
+type access interface {
+	Grant(instanceID string, credentials storage.Credentials) error
+	Revoke(instanceID, username string) error
+}
+
+// BindingResponse is the body of a successful bind.
+type BindingResponse struct {
+	Credentials BindingCredentials `json:"credentials"`
+}
+
+// BindingCredentials is what a bound app finds in VCAP_SERVICES. Whatever
+// the plan, apps speak the memcached text protocol and authenticate with
+// their first command: a `set` of "username password" for any key, as with
+// memcached's `-Y`. This isn't SASL: clients set up for SASL authentication
+// over the binary protocol can't connect.
+type BindingCredentials struct {
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	URI      string `json:"uri"`
 }
 
-func NewBinding(state repository.State) *Binding {
+func NewBinding(state storage.Storage, authenticator auth.Authenticator, router proxy.Router, queue worker.Queue) *Binding {
 	return &Binding{
-		state: state,
+		state:         state,
+		authenticator: authenticator,
+		router:        router,
+		queue:         queue,
 	}
 }
 
+// Update binds an app to the instance. Each binding gets its own user,
+// granted access to the instance before the binding is stored. Binding again
+// with the same ID returns the credentials issued the first time. Bindings to
+// shared instances get their user, and the address to connect to, from the
+// proxy.
+//
+// With accepts_incomplete the binding is stored right away, and its user is
+// granted access in the background. Platforms from before asynchronous
+// bindings are answered synchronously.
+//
+// Binding again with the same attributes and parameters is a repeat of the
+// original request, anything else a conflict. A repeat of a bind that failed
+// grants the user of the binding access again.
 func (b *Binding) Update(ctx *app.UpdateBindingContext) error {
-	if !b.state.InstanceExists(ctx.InstanceId) {
-		return ctx.NotFound()
+	instance, err := b.state.Instance(ctx.InstanceId)
+	if err != nil {
+		return respondError(ctx.Context, 404, "", unknownInstance(ctx.InstanceId))
+	}
+
+	parameters, err := requestParameters(ctx.Context)
+	if err != nil {
+		return respondError(ctx.Context, 400, "", "The parameters can't be encoded: "+err.Error())
+	}
+
+	requested := storage.Binding{
+		ID:         ctx.BindingId,
+		InstanceID: ctx.InstanceId,
+		ServiceID:  ctx.ServiceId,
+		PlanID:     ctx.PlanId,
+		AppGUID:    ctx.AppGuid,
+		Parameters: parameters,
 	}
 
 	if b.state.InstanceBindingExists(ctx.InstanceId, ctx.BindingId) {
-		return ctx.Conflict()
+		if operation, busy := b.busy(ctx.InstanceId, ctx.BindingId); busy {
+			if operation.Type != storage.BindOperation {
+				return concurrencyError(ctx.Context, "binding "+ctx.BindingId)
+			}
+
+			if !asyncBinding(ctx.Context) {
+				return asyncRequired(ctx.Context, "The binding "+ctx.BindingId)
+			}
+
+			return ctx.JSON(202, OperationResponse{Operation: operation.ID})
+		}
+
+		binding, err := b.state.Binding(ctx.InstanceId, ctx.BindingId)
+		if err != nil {
+			return respondError(ctx.Context, 500, "", err.Error())
+		}
+
+		if !sameBinding(binding, &requested) {
+			return respondError(ctx.Context, 409, "", fmt.Sprintf("Binding %s exists with other attributes or parameters", binding.ID))
+		}
+
+		if operation, failed := b.failed(ctx.InstanceId, ctx.BindingId); failed {
+			if asyncBinding(ctx.Context) {
+				operation, err := b.begin(ctx, *binding, storage.BindOperation)
+				if err != nil {
+					return respondError(ctx.Context, 500, "", "The operation can't be started: "+err.Error())
+				}
+
+				return ctx.JSON(202, OperationResponse{Operation: operation.ID})
+			}
+
+			err = b.accessTo(instance).Grant(ctx.InstanceId, binding.Credentials)
+			if err != nil {
+				return respondError(ctx.Context, 500, "", "The credentials can't be granted: "+err.Error())
+			}
+
+			err = b.state.SaveOperation(finish(*operation, nil))
+			if err != nil {
+				return respondError(ctx.Context, 500, "", "The operation can't be stored: "+err.Error())
+			}
+
+			return ctx.JSON(201, b.newBindingResponse(instance, binding))
+		}
+
+		return ctx.JSON(200, b.newBindingResponse(instance, binding))
+	}
+
+	credentials, err := newCredentials()
+	if err != nil {
+		return respondError(ctx.Context, 500, "", "The credentials can't be generated: "+err.Error())
+	}
+
+	binding := requested
+	binding.Credentials = credentials
+
+	if asyncBinding(ctx.Context) {
+		err = b.state.AddBinding(binding)
+		if err != nil {
+			return respondError(ctx.Context, 500, "", "The binding can't be stored: "+err.Error())
+		}
+
+		operation, err := b.begin(ctx, binding, storage.BindOperation)
+		if err != nil {
+			b.state.DeleteInstanceBinding(ctx.InstanceId, ctx.BindingId)
+			return respondError(ctx.Context, 500, "", "The operation can't be started: "+err.Error())
+		}
+
+		return ctx.JSON(202, OperationResponse{Operation: operation.ID})
+	}
+
+	access := b.accessTo(instance)
+	err = access.Grant(ctx.InstanceId, credentials)
+	if err != nil {
+		return respondError(ctx.Context, 500, "", "The credentials can't be granted: "+err.Error())
 	}
 
-	err := b.state.AddInstanceBinding(ctx.InstanceId, ctx.BindingId)
+	err = b.state.AddBinding(binding)
 	if err != nil {
-		return ctx.InternalServerError()
+		access.Revoke(ctx.InstanceId, credentials.Username)
+		return respondError(ctx.Context, 500, "", "The binding can't be stored: "+err.Error())
 	}
 
-	return ctx.Created()
+	return ctx.JSON(201, b.newBindingResponse(instance, &binding))
 }
 
+// Delete revokes the user of the binding before forgetting about it, so
+// a failed unbind never leaves access behind.
 func (b *Binding) Delete(ctx *app.DeleteBindingContext) error {
-	if !b.state.InstanceExists(ctx.InstanceId) {
+	instance, err := b.state.Instance(ctx.InstanceId)
+	if err != nil {
 		return ctx.Gone()
 	}
 
@@ -43,10 +194,226 @@ func (b *Binding) Delete(ctx *app.DeleteBindingContext) error {
 		return ctx.Gone()
 	}
 
-	err := b.state.DeleteInstanceBinding(ctx.InstanceId, ctx.BindingId)
+	if _, busy := b.busy(ctx.InstanceId, ctx.BindingId); busy {
+		return concurrencyError(ctx.Context, "binding "+ctx.BindingId)
+	}
+
+	binding, err := b.state.Binding(ctx.InstanceId, ctx.BindingId)
 	if err != nil {
-		return ctx.InternalServerError()
+		return respondError(ctx.Context, 500, "", err.Error())
+	}
+
+	if asyncBinding(ctx.Context) {
+		operation, err := b.begin(ctx, *binding, storage.UnbindOperation)
+		if err != nil {
+			return respondError(ctx.Context, 500, "", "The operation can't be started: "+err.Error())
+		}
+
+		return ctx.JSON(202, OperationResponse{Operation: operation.ID})
+	}
+
+	err = b.unbind(instance, binding)
+	if err != nil {
+		return respondError(ctx.Context, 500, "", "The binding can't be deleted: "+err.Error())
 	}
 
 	return ctx.OK(&app.CfbrokerDashboard{})
 }
+
+// Show returns the credentials of the binding, as they were issued when it
+// was created. It can't be fetched while an operation on it is in progress.
+func (b *Binding) Show(ctx *app.ShowServiceBindingContext) error {
+	if !apiVersion(ctx.Context).AtLeast(fetchVersion) {
+		return refuseVersion(ctx.Context, fetchVersion)
+	}
+
+	instance, err := b.state.Instance(ctx.InstanceId)
+	if err != nil {
+		return respondError(ctx.Context, 404, "", unknownInstance(ctx.InstanceId))
+	}
+
+	if !b.state.InstanceBindingExists(ctx.InstanceId, ctx.BindingId) {
+		return respondError(ctx.Context, 404, "", unknownBinding(ctx.InstanceId, ctx.BindingId))
+	}
+
+	if _, busy := b.busy(ctx.InstanceId, ctx.BindingId); busy {
+		return concurrencyError(ctx.Context, "binding "+ctx.BindingId)
+	}
+
+	binding, err := b.state.Binding(ctx.InstanceId, ctx.BindingId)
+	if err != nil {
+		return respondError(ctx.Context, 500, "", err.Error())
+	}
+
+	return ctx.JSON(200, b.newBindingResponse(instance, binding))
+}
+
+// Resume runs the operations a restart of the broker interrupted again. Each
+// of them is safe to repeat.
+func (b *Binding) Resume(log Logger) error {
+	instances, err := b.state.Instances()
+	if err != nil {
+		return err
+	}
+
+	for _, instance := range instances {
+		for _, bindingID := range instance.Bindings {
+			operation, err := b.state.BindingOperation(instance.ID, bindingID)
+			if err == nil && operation.InProgress() {
+				b.queue.Enqueue(func() { b.run(log, *operation) })
+			}
+		}
+	}
+
+	return nil
+}
+
+// begin records a new operation on the binding and enqueues it.
+func (b *Binding) begin(log Logger, binding storage.Binding, operationType string) (storage.Operation, error) {
+	operation, err := newOperation(binding.InstanceID, operationType)
+	if err != nil {
+		return operation, err
+	}
+
+	operation.BindingID = binding.ID
+	return operation, enqueue(b.state, b.queue, operation, func(operation storage.Operation) {
+		b.run(log, operation)
+	})
+}
+
+// run does the work of the operation and records its outcome. Nothing is
+// left to record once a binding is unbound.
+func (b *Binding) run(log Logger, operation storage.Operation) {
+	instance, err := b.state.Instance(operation.InstanceID)
+	if err != nil {
+		return
+	}
+
+	binding, err := b.state.Binding(operation.InstanceID, operation.BindingID)
+	if err != nil {
+		return
+	}
+
+	switch operation.Type {
+	case storage.BindOperation:
+		err = b.accessTo(instance).Grant(instance.ID, binding.Credentials)
+	case storage.UnbindOperation:
+		err = b.unbind(instance, binding)
+		if err == nil {
+			return
+		}
+	}
+
+	err = b.state.SaveOperation(finish(operation, err))
+	if err != nil {
+		log.Error("failed to record the operation", "instance", operation.InstanceID, "binding", operation.BindingID, "operation", operation.ID, "error", err.Error())
+	}
+}
+
+// busy tells whether an operation on the binding is still running, and
+// returns it.
+func (b *Binding) busy(instanceID, bindingID string) (*storage.Operation, bool) {
+	operation, err := b.state.BindingOperation(instanceID, bindingID)
+	if err != nil || !operation.InProgress() {
+		return nil, false
+	}
+
+	return operation, true
+}
+
+// failed tells whether the last operation on the binding was a bind that
+// failed, and returns it.
+func (b *Binding) failed(instanceID, bindingID string) (*storage.Operation, bool) {
+	operation, err := b.state.BindingOperation(instanceID, bindingID)
+	if err != nil || operation.Type != storage.BindOperation || operation.State != storage.OperationFailed {
+		return nil, false
+	}
+
+	return operation, true
+}
+
+// unbind revokes the user of the binding, then forgets the binding. The
+// embedded server and the proxy disconnect the clients of the user right
+// away. A supervised memcached only does with RestartOnRevoke, which
+// flushes the instance. Otherwise they stay connected, but can't
+// authenticate again.
+func (b *Binding) unbind(instance *repository.Instance, binding *storage.Binding) error {
+	if binding.Credentials.Username != "" {
+		err := b.accessTo(instance).Revoke(instance.ID, binding.Credentials.Username)
+		if err != nil {
+			return err
+		}
+	}
+
+	return b.state.DeleteInstanceBinding(instance.ID, binding.ID)
+}
+
+func (b *Binding) accessTo(instance *repository.Instance) access {
+	if shared(b.router, instance.PlanID) {
+		return b.router
+	}
+
+	return b.authenticator
+}
+
+func (b *Binding) newBindingResponse(instance *repository.Instance, binding *storage.Binding) BindingResponse {
+	host, port := instance.Host, instance.Port
+	if shared(b.router, instance.PlanID) {
+		host, port = b.router.Address()
+	}
+
+	uri := url.URL{
+		Scheme: "memcached",
+		User:   url.UserPassword(binding.Credentials.Username, binding.Credentials.Password),
+		Host:   net.JoinHostPort(host, port),
+	}
+
+	return BindingResponse{
+		Credentials: BindingCredentials{
+			Host:     host,
+			Port:     port,
+			Username: binding.Credentials.Username,
+			Password: binding.Credentials.Password,
+			URI:      uri.String(),
+		},
+	}
+}
+
+// sameBinding tells whether the binding was requested with the same
+// attributes. Bindings recorded before their attributes were match any.
+func sameBinding(binding, requested *storage.Binding) bool {
+	if binding.ServiceID == "" && binding.PlanID == "" && binding.AppGUID == "" && binding.Parameters == "" {
+		return true
+	}
+
+	return binding.ServiceID == requested.ServiceID &&
+		binding.PlanID == requested.PlanID &&
+		binding.AppGUID == requested.AppGUID &&
+		binding.Parameters == requested.Parameters
+}
+
+func newCredentials() (storage.Credentials, error) {
+	username, err := randomHex(8)
+	if err != nil {
+		return storage.Credentials{}, err
+	}
+
+	password, err := randomHex(16)
+	if err != nil {
+		return storage.Credentials{}, err
+	}
+
+	return storage.Credentials{
+		Username: username,
+		Password: password,
+	}, nil
+}
+
+func randomHex(size int) (string, error) {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(data), nil
+}
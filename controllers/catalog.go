@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/raphael/goa"
+	"github.com/tscolari/memcached-broker/app"
+	"github.com/tscolari/memcached-broker/proxy"
+)
+
+type Catalog struct {
+	goa.Controller
+	catalog CatalogResponse
+}
+
+// CatalogResponse is the configured catalog, with what the broker supports
+// for every service on top. The descriptions of the plans served through the
+// proxy tell that their memory limit is best-effort.
+type CatalogResponse struct {
+	Services []CatalogService `json:"services"`
+}
+
+// CatalogService is a configured service. Its instances and bindings can
+// always be fetched.
+type CatalogService struct {
+	*app.CfbrokerService
+	InstancesRetrievable bool `json:"instances_retrievable"`
+	BindingsRetrievable  bool `json:"bindings_retrievable"`
+}
+
+func NewCatalog(catalog app.CfbrokerCatalog, router proxy.Router) *Catalog {
+	services := []CatalogService{}
+	for _, service := range catalog.Services {
+		described := *service
+		described.Plans = make([]*app.CfbrokerPlan, len(service.Plans))
+		for i, plan := range service.Plans {
+			described.Plans[i] = plan
+			if shared(router, plan.ID) {
+				sharedPlan := *plan
+				sharedPlan.Description = strings.TrimSpace(plan.Description + " " + proxy.QuotaNotice)
+				described.Plans[i] = &sharedPlan
+			}
+		}
+
+		services = append(services, CatalogService{
+			CfbrokerService:      &described,
+			InstancesRetrievable: true,
+			BindingsRetrievable:  true,
+		})
+	}
+
+	return &Catalog{
+		catalog: CatalogResponse{Services: services},
+	}
+}
+
+func (c *Catalog) Show(ctx *app.ShowCatalogContext) error {
+	return ctx.JSON(200, c.catalog)
+}
+
+// resolvePlan finds the service and plan of a request in the catalog.
+func resolvePlan(catalog app.CfbrokerCatalog, serviceID, planID string) (*app.CfbrokerService, *app.CfbrokerPlan, error) {
+	for _, service := range catalog.Services {
+		if service.ID != serviceID {
+			continue
+		}
+
+		for _, plan := range service.Plans {
+			if plan.ID == planID {
+				return service, plan, nil
+			}
+		}
+
+		return nil, nil, fmt.Errorf("Unknown plan %q of service %q", planID, serviceID)
+	}
+
+	return nil, nil, fmt.Errorf("Unknown service %q", serviceID)
+}
@@ -0,0 +1,91 @@
+package controllers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/raphael/goa"
+	"github.com/tscolari/memcached-broker/app"
+	"github.com/tscolari/memcached-broker/controllers"
+	"github.com/tscolari/memcached-broker/proxy"
+	proxyfakes "github.com/tscolari/memcached-broker/proxy/fakes"
+	"golang.org/x/net/context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Catalog", func() {
+	var catalogController *controllers.Catalog
+	var goaContext *goa.Context
+	var responseWriter *httptest.ResponseRecorder
+	var router *proxyfakes.FakeRouter
+
+	BeforeEach(func() {
+		router = new(proxyfakes.FakeRouter)
+		router.ServesStub = func(planID string) bool {
+			return planID == "shared-plan"
+		}
+
+		catalogController = controllers.NewCatalog(app.CfbrokerCatalog{
+			Services: []*app.CfbrokerService{
+				{
+					ID:            "service-1",
+					Name:          "memcached",
+					Bindable:      true,
+					PlanUpdatable: true,
+					Plans: []*app.CfbrokerPlan{
+						{ID: "plan-1", Name: "small", Description: "64mb memory limit"},
+						{ID: "shared-plan", Name: "shared", Description: "shared 1mb memory limit"},
+					},
+				},
+			},
+		}, router)
+
+		gctx := context.Background()
+		req := http.Request{}
+		responseWriter = httptest.NewRecorder()
+		params := url.Values{}
+		payload := map[string]string{}
+
+		goaContext = goa.NewContext(gctx, &req, responseWriter, params, payload)
+	})
+
+	Describe("#Show", func() {
+		var catalog map[string][]map[string]interface{}
+
+		BeforeEach(func() {
+			catalogContext, err := app.NewShowCatalogContext(goaContext)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(catalogController.Show(catalogContext)).To(Succeed())
+			Expect(json.Unmarshal(responseWriter.Body.Bytes(), &catalog)).To(Succeed())
+		})
+
+		It("responds with the configured services", func() {
+			Expect(goaContext.ResponseStatus()).To(Equal(200))
+			Expect(catalog["services"]).To(HaveLen(1))
+
+			service := catalog["services"][0]
+			Expect(service["id"]).To(Equal("service-1"))
+			Expect(service["name"]).To(Equal("memcached"))
+			Expect(service["bindable"]).To(BeTrue())
+			Expect(service["plan_updatable"]).To(BeTrue())
+			Expect(service["plans"]).To(HaveLen(2))
+		})
+
+		It("tells that the memory limit of shared plans is best-effort", func() {
+			plans := catalog["services"][0]["plans"].([]interface{})
+			Expect(plans[0].(map[string]interface{})["description"]).To(Equal("64mb memory limit"))
+			Expect(plans[1].(map[string]interface{})["description"]).To(Equal("shared 1mb memory limit " + proxy.QuotaNotice))
+		})
+
+		It("advertises that instances and bindings can be fetched", func() {
+			service := catalog["services"][0]
+			Expect(service["instances_retrievable"]).To(BeTrue())
+			Expect(service["bindings_retrievable"]).To(BeTrue())
+		})
+	})
+})
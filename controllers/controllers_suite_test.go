@@ -1,6 +1,11 @@
 package controllers_test
 
 import (
+	"net/http"
+
+	"github.com/raphael/goa"
+	"github.com/tscolari/memcached-broker/middleware"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
@@ -11,3 +16,13 @@ func TestControllers(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Controllers Suite")
 }
+
+// negotiate runs the request through the API version middleware, the way
+// the service does before it reaches the controllers.
+func negotiate(ctx *goa.Context, version string) {
+	ctx.Request().Header = http.Header{}
+	ctx.Request().Header.Set(middleware.APIVersionHeader, version)
+
+	handler := middleware.APIVersion()(func(*goa.Context) error { return nil })
+	Expect(handler(ctx)).To(Succeed())
+}
@@ -0,0 +1,73 @@
+package controllers
+
+import (
+	"fmt"
+
+	"github.com/raphael/goa"
+	"github.com/tscolari/memcached-broker/middleware"
+)
+
+// The error codes of the service broker API, for the platform to act on.
+const (
+	// AsyncRequired refuses a request the broker can only answer with a
+	// 202, to a platform that doesn't accept incomplete requests.
+	AsyncRequired = "AsyncRequired"
+
+	// ConcurrencyError refuses a request while another operation on the
+	// instance, or the binding, is in progress.
+	ConcurrencyError = "ConcurrencyError"
+
+	// MaintenanceInfoConflict refuses a request whose maintenance_info
+	// doesn't match the catalog.
+	MaintenanceInfoConflict = "MaintenanceInfoConflict"
+)
+
+// ErrorResponse is the body of a refused request, it tells the platform
+// and its users what went wrong. Error is one of the codes above, when the
+// platform has something to act on.
+type ErrorResponse struct {
+	Error       string `json:"error,omitempty"`
+	Description string `json:"description"`
+}
+
+// respondError refuses the request with the status, the error code, and
+// the description of why.
+func respondError(ctx *goa.Context, status int, code, description string) error {
+	return ctx.JSON(status, ErrorResponse{Error: code, Description: description})
+}
+
+// concurrencyError refuses the request while an operation of what is named
+// is in progress.
+func concurrencyError(ctx *goa.Context, name string) error {
+	return respondError(ctx, 422, ConcurrencyError, fmt.Sprintf("Another operation on %s is in progress", name))
+}
+
+// asyncRequired refuses to repeat a request that still is in progress, to
+// a platform that can't poll for its outcome.
+func asyncRequired(ctx *goa.Context, name string) error {
+	return respondError(ctx, 422, AsyncRequired, fmt.Sprintf("%s is still in progress, it can only be polled with accepts_incomplete", name))
+}
+
+// refuseVersion answers a request for what the broker API version of the
+// request doesn't have yet.
+func refuseVersion(ctx *goa.Context, introduced middleware.Version) error {
+	return respondError(ctx, 412, "", fmt.Sprintf("This needs broker API version %s, the request is for %s", introduced, apiVersion(ctx)))
+}
+
+// maintenanceInfoConflict refuses a request with maintenance_info, which
+// none of the plans in the catalog have.
+func maintenanceInfoConflict(ctx *goa.Context) error {
+	return respondError(ctx, 422, MaintenanceInfoConflict, "The plans of the catalog have no maintenance_info")
+}
+
+func unknownInstance(instanceID string) string {
+	return fmt.Sprintf("Instance %s doesn't exist", instanceID)
+}
+
+func unknownBinding(instanceID, bindingID string) string {
+	return fmt.Sprintf("Binding %s of instance %s doesn't exist", bindingID, instanceID)
+}
+
+func unknownOperation(operationID string) string {
+	return fmt.Sprintf("Operation %s isn't the last one", operationID)
+}
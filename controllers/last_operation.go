@@ -0,0 +1,68 @@
+package controllers
+
+import (
+	"github.com/raphael/goa"
+	"github.com/tscolari/memcached-broker/app"
+	"github.com/tscolari/memcached-broker/storage"
+)
+
+type LastOperation struct {
+	goa.Controller
+	state storage.Storage
+}
+
+func NewLastOperation(state storage.Storage) *LastOperation {
+	return &LastOperation{
+		state: state,
+	}
+}
+
+// Instance reports the last asynchronous operation on the instance. A
+// deprovisioned instance is gone, which the platform takes as the
+// deprovision having succeeded.
+func (l *LastOperation) Instance(ctx *app.InstanceLastOperationContext) error {
+	if !l.state.InstanceExists(ctx.InstanceId) {
+		return ctx.Gone()
+	}
+
+	operation, err := l.state.Operation(ctx.InstanceId)
+	if err != nil {
+		return respondError(ctx.Context, 400, "", "There is no operation on instance "+ctx.InstanceId)
+	}
+
+	if ctx.Operation != "" && ctx.Operation != operation.ID {
+		return respondError(ctx.Context, 400, "", unknownOperation(ctx.Operation))
+	}
+
+	return ctx.OK(newLastOperationMedia(operation))
+}
+
+// Binding reports the last asynchronous operation on the binding. An
+// unbound binding is gone, which the platform takes as the unbind having
+// succeeded.
+func (l *LastOperation) Binding(ctx *app.BindingLastOperationContext) error {
+	if !l.state.InstanceBindingExists(ctx.InstanceId, ctx.BindingId) {
+		return ctx.Gone()
+	}
+
+	operation, err := l.state.BindingOperation(ctx.InstanceId, ctx.BindingId)
+	if err != nil {
+		return respondError(ctx.Context, 400, "", "There is no operation on binding "+ctx.BindingId)
+	}
+
+	if ctx.Operation != "" && ctx.Operation != operation.ID {
+		return respondError(ctx.Context, 400, "", unknownOperation(ctx.Operation))
+	}
+
+	return ctx.OK(newLastOperationMedia(operation))
+}
+
+func newLastOperationMedia(operation *storage.Operation) *app.CfbrokerLastOperation {
+	media := &app.CfbrokerLastOperation{State: operation.State}
+	if operation.Description != "" {
+		description := operation.Description
+		media.Description = &description
+	}
+
+	return media
+}
@@ -0,0 +1,176 @@
+package controllers_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/raphael/goa"
+	"github.com/tscolari/memcached-broker/app"
+	"github.com/tscolari/memcached-broker/controllers"
+	"github.com/tscolari/memcached-broker/storage"
+	"github.com/tscolari/memcached-broker/storage/fakes"
+	"golang.org/x/net/context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LastOperation", func() {
+	var lastOperationController *controllers.LastOperation
+	var goaContext *goa.Context
+	var responseWriter *httptest.ResponseRecorder
+	var state *fakes.FakeStorage
+
+	BeforeEach(func() {
+		state = new(fakes.FakeStorage)
+		lastOperationController = controllers.NewLastOperation(state)
+
+		gctx := context.Background()
+		req := http.Request{}
+		responseWriter = httptest.NewRecorder()
+		params := url.Values{}
+		payload := map[string]string{}
+
+		goaContext = goa.NewContext(gctx, &req, responseWriter, params, payload)
+	})
+
+	Describe("#Instance", func() {
+		var lastOperationContext *app.InstanceLastOperationContext
+
+		BeforeEach(func() {
+			var err error
+			lastOperationContext, err = app.NewInstanceLastOperationContext(goaContext)
+			Expect(err).ToNot(HaveOccurred())
+
+			lastOperationContext.InstanceId = "some-instance-id"
+			lastOperationContext.Operation = "operation-1"
+
+			state.InstanceExistsReturns(true)
+			state.OperationReturns(&storage.Operation{
+				ID:         "operation-1",
+				InstanceID: "some-instance-id",
+				State:      storage.OperationInProgress,
+			}, nil)
+		})
+
+		It("reports the state of the operation", func() {
+			Expect(lastOperationController.Instance(lastOperationContext)).To(Succeed())
+
+			Expect(goaContext.ResponseStatus()).To(Equal(200))
+			Expect(responseWriter.Body.String()).To(MatchJSON(`{"state":"in progress"}`))
+			Expect(state.OperationArgsForCall(0)).To(Equal("some-instance-id"))
+		})
+
+		Context("when the operation failed", func() {
+			It("reports why", func() {
+				state.OperationReturns(&storage.Operation{
+					ID:          "operation-1",
+					State:       storage.OperationFailed,
+					Description: "no such file",
+				}, nil)
+
+				Expect(lastOperationController.Instance(lastOperationContext)).To(Succeed())
+				Expect(responseWriter.Body.String()).To(MatchJSON(`{"state":"failed","description":"no such file"}`))
+			})
+		})
+
+		Context("when no operation is given", func() {
+			It("reports the last one", func() {
+				lastOperationContext.Operation = ""
+
+				Expect(lastOperationController.Instance(lastOperationContext)).To(Succeed())
+				Expect(goaContext.ResponseStatus()).To(Equal(200))
+			})
+		})
+
+		Context("when the operation isn't the last one", func() {
+			It("responds with 400 and why", func() {
+				lastOperationContext.Operation = "operation-0"
+
+				Expect(lastOperationController.Instance(lastOperationContext)).To(Succeed())
+				Expect(goaContext.ResponseStatus()).To(Equal(400))
+				Expect(responseWriter.Body.String()).To(MatchJSON(`{"description":"Operation operation-0 isn't the last one"}`))
+			})
+		})
+
+		Context("when the instance has no operation", func() {
+			It("responds with 400", func() {
+				state.OperationReturns(nil, errors.New("Operation not found"))
+
+				Expect(lastOperationController.Instance(lastOperationContext)).To(Succeed())
+				Expect(goaContext.ResponseStatus()).To(Equal(400))
+			})
+		})
+
+		Context("when the instance is gone", func() {
+			It("responds with 410", func() {
+				state.InstanceExistsReturns(false)
+
+				Expect(lastOperationController.Instance(lastOperationContext)).To(Succeed())
+				Expect(goaContext.ResponseStatus()).To(Equal(410))
+			})
+		})
+	})
+
+	Describe("#Binding", func() {
+		var lastOperationContext *app.BindingLastOperationContext
+
+		BeforeEach(func() {
+			var err error
+			lastOperationContext, err = app.NewBindingLastOperationContext(goaContext)
+			Expect(err).ToNot(HaveOccurred())
+
+			lastOperationContext.InstanceId = "some-instance-id"
+			lastOperationContext.BindingId = "some-binding-id"
+			lastOperationContext.Operation = "operation-1"
+
+			state.InstanceBindingExistsReturns(true)
+			state.BindingOperationReturns(&storage.Operation{
+				ID:         "operation-1",
+				InstanceID: "some-instance-id",
+				BindingID:  "some-binding-id",
+				State:      storage.OperationSucceeded,
+			}, nil)
+		})
+
+		It("reports the state of the operation", func() {
+			Expect(lastOperationController.Binding(lastOperationContext)).To(Succeed())
+
+			Expect(goaContext.ResponseStatus()).To(Equal(200))
+			Expect(responseWriter.Body.String()).To(MatchJSON(`{"state":"succeeded"}`))
+
+			instanceID, bindingID := state.BindingOperationArgsForCall(0)
+			Expect(instanceID).To(Equal("some-instance-id"))
+			Expect(bindingID).To(Equal("some-binding-id"))
+		})
+
+		Context("when the operation isn't the last one", func() {
+			It("responds with 400", func() {
+				lastOperationContext.Operation = "operation-0"
+
+				Expect(lastOperationController.Binding(lastOperationContext)).To(Succeed())
+				Expect(goaContext.ResponseStatus()).To(Equal(400))
+			})
+		})
+
+		Context("when the binding has no operation", func() {
+			It("responds with 400", func() {
+				state.BindingOperationReturns(nil, errors.New("Operation not found"))
+
+				Expect(lastOperationController.Binding(lastOperationContext)).To(Succeed())
+				Expect(goaContext.ResponseStatus()).To(Equal(400))
+			})
+		})
+
+		Context("when the binding is gone", func() {
+			It("responds with 410", func() {
+				state.InstanceBindingExistsReturns(false)
+
+				Expect(lastOperationController.Binding(lastOperationContext)).To(Succeed())
+				Expect(goaContext.ResponseStatus()).To(Equal(410))
+			})
+		})
+	})
+})
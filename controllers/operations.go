@@ -0,0 +1,111 @@
+package controllers
+
+import (
+	"encoding/json"
+
+	"github.com/raphael/goa"
+	"github.com/tscolari/memcached-broker/middleware"
+	"github.com/tscolari/memcached-broker/storage"
+	"github.com/tscolari/memcached-broker/worker"
+)
+
+// Logger reports what goes wrong in the background, after the request that
+// started the work got its answer. goa contexts and services are loggers.
+type Logger interface {
+	Error(msg string, ctx ...interface{})
+}
+
+// OperationResponse is the body of a request accepted to finish in the
+// background.
+type OperationResponse struct {
+	Operation string `json:"operation"`
+}
+
+// The broker API versions that introduced what the broker only offers to
+// platforms that speak them.
+var (
+	asyncBindingsVersion = middleware.Version{Major: 2, Minor: 14}
+	fetchVersion         = middleware.Version{Major: 2, Minor: 14}
+)
+
+// acceptsIncomplete tells whether the platform takes a 202 for an answer,
+// and will poll last_operation for the outcome.
+func acceptsIncomplete(ctx *goa.Context) bool {
+	value, _ := ctx.Get("accepts_incomplete")
+	return value == "true"
+}
+
+// asyncBinding tells whether the platform takes a 202 for a bind or unbind.
+// Platforms from before asynchronous bindings only poll for instances.
+func asyncBinding(ctx *goa.Context) bool {
+	return acceptsIncomplete(ctx) && apiVersion(ctx).AtLeast(asyncBindingsVersion)
+}
+
+// apiVersion is the broker API version of the request. It's the latest one
+// when none was negotiated.
+func apiVersion(ctx *goa.Context) middleware.Version {
+	if version, ok := middleware.RequestVersion(ctx); ok {
+		return version
+	}
+
+	return middleware.LatestVersion
+}
+
+// requestParameters returns the configuration parameters in the body of the
+// request, encoded as JSON. Keys are sorted, so equal parameters always
+// encode the same.
+func requestParameters(ctx *goa.Context) (string, error) {
+	body, _ := ctx.Payload().(map[string]interface{})
+	parameters, _ := body["parameters"].(map[string]interface{})
+	if len(parameters) == 0 {
+		return "", nil
+	}
+
+	encoded, err := json.Marshal(parameters)
+	return string(encoded), err
+}
+
+// hasMaintenanceInfo tells whether the body of the request has
+// maintenance_info.
+func hasMaintenanceInfo(ctx *goa.Context) bool {
+	body, _ := ctx.Payload().(map[string]interface{})
+	_, exists := body["maintenance_info"]
+	return exists
+}
+
+func newOperation(instanceID, operationType string) (storage.Operation, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return storage.Operation{}, err
+	}
+
+	return storage.Operation{
+		ID:         id,
+		InstanceID: instanceID,
+		Type:       operationType,
+		State:      storage.OperationInProgress,
+	}, nil
+}
+
+// enqueue stores the operation, then has the queue run it.
+func enqueue(state storage.Storage, queue worker.Queue, operation storage.Operation, run func(operation storage.Operation)) error {
+	err := state.SaveOperation(operation)
+	if err != nil {
+		return err
+	}
+
+	queue.Enqueue(func() { run(operation) })
+	return nil
+}
+
+// finish records the outcome of the operation.
+func finish(operation storage.Operation, err error) storage.Operation {
+	operation.State = storage.OperationSucceeded
+	operation.Description = ""
+	if err != nil {
+		operation.State = storage.OperationFailed
+		operation.Description = err.Error()
+	}
+
+	return operation
+}
@@ -1,25 +1,95 @@
 package controllers
 
 import (
+	"errors"
+	"fmt"
+	"sync"
+
 	"github.com/raphael/goa"
 	"github.com/tscolari/cf-broker-api/common/repository"
 	"github.com/tscolari/memcached-broker/app"
+	"github.com/tscolari/memcached-broker/auth"
+	"github.com/tscolari/memcached-broker/inventory"
+	"github.com/tscolari/memcached-broker/proxy"
+	"github.com/tscolari/memcached-broker/runner"
+	"github.com/tscolari/memcached-broker/storage"
+	"github.com/tscolari/memcached-broker/worker"
+)
+
+var (
+	errNoPlanCapacity      = errors.New("No capacity left for the new plan")
+	errPlanMove            = errors.New("Instances can't move between shared and dedicated plans")
+	errOperationInProgress = errors.New("Another operation on the instance is in progress")
 )
 
 type Provisioning struct {
 	goa.Controller
-	state repository.State
+	catalog       app.CfbrokerCatalog
+	state         storage.Storage
+	inventory     *inventory.Inventory
+	authenticator auth.Authenticator
+	runner        runner.Runner
+
+	// router serves the instances of shared plans, it's nil when there is
+	// no proxy.
+	router proxy.Router
+
+	// queue runs the operations of requests that accept to finish in the
+	// background.
+	queue worker.Queue
+
+	// allocation makes picking a slot and storing the instance on it a
+	// single step.
+	allocation sync.Mutex
+
+	// operations makes checking that no operation on an instance is in
+	// progress and recording a new one a single step.
+	operations sync.Mutex
 }
 
-func NewProvisioning(state repository.State) *Provisioning {
+func NewProvisioning(catalog app.CfbrokerCatalog, state storage.Storage, inventory *inventory.Inventory, authenticator auth.Authenticator, runner runner.Runner, router proxy.Router, queue worker.Queue) *Provisioning {
 	return &Provisioning{
-		state: state,
+		catalog:       catalog,
+		state:         state,
+		inventory:     inventory,
+		authenticator: authenticator,
+		runner:        runner,
+		router:        router,
+		queue:         queue,
 	}
 }
 
+// Create stores the instance and starts serving it. The service and plan
+// must be in the catalog. Instances of shared
+// plans get a route through the proxy, the others a memcached of their own
+// on a free slot of the inventory.
+//
+// With accepts_incomplete the capacity and the slot are taken right away,
+// and the instance is started in the background. When that fails the
+// instance is kept, for the platform to deprovision.
+//
+// Provisioning an existing instance again with the same attributes and
+// parameters succeeds without changing anything, as platforms retry
+// requests they got no answer for.
+//
+// Only picking the slot and storing the instance is done one provision at
+// a time, a slow start doesn't hold up the others.
+//
+// Failures are answered with the description of what went wrong, running
+// out of capacity included.
 func (p *Provisioning) Create(ctx *app.CreateProvisioningContext) error {
-	if p.state.InstanceExists(ctx.InstanceId) {
-		return ctx.Conflict()
+	_, _, err := resolvePlan(p.catalog, ctx.ServiceId, ctx.PlanId)
+	if err != nil {
+		return respondError(ctx.Context, 400, "", err.Error())
+	}
+
+	if hasMaintenanceInfo(ctx.Context) {
+		return maintenanceInfoConflict(ctx.Context)
+	}
+
+	parameters, err := requestParameters(ctx.Context)
+	if err != nil {
+		return respondError(ctx.Context, 400, "", "The parameters can't be encoded: "+err.Error())
 	}
 
 	instance := repository.Instance{
@@ -30,37 +100,442 @@ func (p *Provisioning) Create(ctx *app.CreateProvisioningContext) error {
 		SpaceID:        ctx.SpaceId,
 	}
 
-	err := p.state.AddInstance(instance)
+	p.allocation.Lock()
+	answered, err := p.reserve(ctx, &instance, parameters)
+	p.allocation.Unlock()
+	if answered {
+		return err
+	}
+
+	if acceptsIncomplete(ctx.Context) {
+		operation, err := p.begin(ctx, instance.ID, storage.ProvisionOperation, "")
+		if err != nil {
+			p.state.DeleteInstance(instance.ID)
+			return respondError(ctx.Context, 503, "", "The operation can't be started: "+err.Error())
+		}
+
+		return ctx.JSON(202, OperationResponse{Operation: operation.ID})
+	}
+
+	err = p.start(instance)
 	if err != nil {
-		return ctx.ServiceUnavailable()
+		p.state.DeleteInstance(instance.ID)
+		return respondError(ctx.Context, 503, "", err.Error())
 	}
 
 	return ctx.Created()
 }
 
+// reserve stores the instance, on a free slot of the inventory unless its
+// plan is shared, along with its parameters. When that can't be done, or
+// the instance exists already, the request is answered here and reserve
+// tells so. Callers hold the allocation lock.
+func (p *Provisioning) reserve(ctx *app.CreateProvisioningContext, instance *repository.Instance, parameters string) (bool, error) {
+	if p.state.InstanceExists(ctx.InstanceId) {
+		return true, p.provisioned(ctx, *instance, parameters)
+	}
+
+	if !shared(p.router, instance.PlanID) {
+		instances, err := p.state.Instances()
+		if err != nil {
+			return true, respondError(ctx.Context, 503, "", "The instances can't be listed: "+err.Error())
+		}
+
+		slot, err := p.inventory.Allocate(instances)
+		if err != nil {
+			return true, respondError(ctx.Context, 503, "", noCapacity(instance.PlanID, err))
+		}
+
+		instance.Host = slot.Host
+		instance.Port = slot.Port
+	}
+
+	err := p.state.AddInstance(*instance)
+	if err == storage.ErrNoCapacity {
+		return true, respondError(ctx.Context, 503, "", noCapacity(instance.PlanID, err))
+	}
+	if err != nil {
+		return true, respondError(ctx.Context, 503, "", "The instance can't be stored: "+err.Error())
+	}
+
+	if parameters != "" {
+		err = p.state.SaveInstanceParameters(instance.ID, parameters)
+		if err != nil {
+			p.state.DeleteInstance(instance.ID)
+			return true, respondError(ctx.Context, 503, "", "The parameters can't be stored: "+err.Error())
+		}
+	}
+
+	return false, nil
+}
+
+// provisioned answers a provision of an instance that exists already. Only
+// a repeat of the request that created it isn't a conflict, it gets the
+// answer the original got, or is told to keep polling.
+func (p *Provisioning) provisioned(ctx *app.CreateProvisioningContext, requested repository.Instance, parameters string) error {
+	instance, err := p.state.Instance(requested.ID)
+	if err != nil {
+		return respondError(ctx.Context, 503, "", err.Error())
+	}
+
+	storedParameters, err := p.state.InstanceParameters(requested.ID)
+	if err != nil {
+		return respondError(ctx.Context, 503, "", err.Error())
+	}
+
+	if instance.ServiceID != requested.ServiceID ||
+		instance.PlanID != requested.PlanID ||
+		instance.OrganizationID != requested.OrganizationID ||
+		instance.SpaceID != requested.SpaceID ||
+		storedParameters != parameters {
+		return respondError(ctx.Context, 409, "", fmt.Sprintf("Instance %s exists with other attributes or parameters", instance.ID))
+	}
+
+	operation, err := p.state.Operation(instance.ID)
+	if err == nil && operation.InProgress() && operation.Type == storage.ProvisionOperation {
+		if !acceptsIncomplete(ctx.Context) {
+			return asyncRequired(ctx.Context, "The provision of instance "+instance.ID)
+		}
+
+		return ctx.JSON(202, OperationResponse{Operation: operation.ID})
+	}
+
+	return ctx.JSON(200, &app.CfbrokerDashboard{})
+}
+
+// Update changes the plan of the instance. The plan stays the same when the
+// request has none, and can only change when the service allows it. The
+// service stays the one of the instance.
+//
+// The instance is resized to the new plan before the plan is recorded, see
+// changePlan. What can be checked up front is checked before a request
+// that accepts_incomplete is accepted. Either way the update is recorded as
+// an operation on the instance, so no other one runs at the same time.
 func (p *Provisioning) Update(ctx *app.UpdateProvisioningContext) error {
 	instance, err := p.state.Instance(ctx.InstanceId)
 	if err != nil {
-		return ctx.NotFound()
+		return respondError(ctx.Context, 404, "", unknownInstance(ctx.InstanceId))
+	}
+
+	if hasMaintenanceInfo(ctx.Context) {
+		return maintenanceInfoConflict(ctx.Context)
+	}
+
+	planID := ctx.PlanId
+	if planID == "" {
+		planID = instance.PlanID
+	}
+
+	service, _, err := resolvePlan(p.catalog, ctx.ServiceId, planID)
+	if err != nil {
+		return respondError(ctx.Context, 400, "", err.Error())
 	}
 
-	instance.ServiceID = ctx.ServiceId
-	instance.PlanID = ctx.PlanId
+	if ctx.ServiceId != instance.ServiceID {
+		return respondError(ctx.Context, 400, "", fmt.Sprintf("Instance %s is an instance of service %q", instance.ID, instance.ServiceID))
+	}
+
+	if planID != instance.PlanID && !service.PlanUpdatable {
+		return respondError(ctx.Context, 422, "", fmt.Sprintf("The plan of service %q can't be changed", service.ID))
+	}
 
-	p.state.UpdateInstance(*instance)
+	if p.busy(instance.ID) {
+		return concurrencyError(ctx.Context, "instance "+instance.ID)
+	}
+
+	err = p.checkPlanChange(*instance, planID)
+	if err != nil {
+		return p.refuseUpdate(ctx, err)
+	}
+
+	if acceptsIncomplete(ctx.Context) {
+		operation, err := p.begin(ctx, instance.ID, storage.UpdateOperation, planID)
+		if err == errOperationInProgress {
+			return concurrencyError(ctx.Context, "instance "+instance.ID)
+		}
+		if err != nil {
+			return respondError(ctx.Context, 500, "", "The operation can't be started: "+err.Error())
+		}
+
+		return ctx.JSON(202, OperationResponse{Operation: operation.ID})
+	}
+
+	operation, err := p.claim(instance.ID, storage.UpdateOperation, planID)
+	if err == errOperationInProgress {
+		return concurrencyError(ctx.Context, "instance "+instance.ID)
+	}
+	if err != nil {
+		return respondError(ctx.Context, 500, "", "The operation can't be started: "+err.Error())
+	}
+
+	err = p.changePlan(*instance, planID)
+	p.record(ctx, operation, err)
+	if err != nil {
+		return p.refuseUpdate(ctx, err)
+	}
 
 	return ctx.OK(&app.CfbrokerDashboard{})
 }
 
+// refuseUpdate answers an update that failed with why.
+func (p *Provisioning) refuseUpdate(ctx *app.UpdateProvisioningContext, err error) error {
+	switch err {
+	case errNoPlanCapacity:
+		return respondError(ctx.Context, 503, "", err.Error())
+	case errPlanMove, runner.ErrOverflow:
+		return respondError(ctx.Context, 422, "", err.Error())
+	default:
+		return respondError(ctx.Context, 500, "", err.Error())
+	}
+}
+
+// Delete stops serving the instance and forgets about it. An instance that
+// doesn't exist is gone already.
 func (p *Provisioning) Delete(ctx *app.DeleteProvisioningContext) error {
-	if !p.state.InstanceExists(ctx.InstanceId) {
+	instance, err := p.state.Instance(ctx.InstanceId)
+	if err != nil {
 		return ctx.Gone()
 	}
 
-	err := p.state.DeleteInstance(ctx.InstanceId)
+	if p.busy(instance.ID) {
+		return concurrencyError(ctx.Context, "instance "+instance.ID)
+	}
+
+	if acceptsIncomplete(ctx.Context) {
+		operation, err := p.begin(ctx, instance.ID, storage.DeprovisionOperation, "")
+		if err == errOperationInProgress {
+			return concurrencyError(ctx.Context, "instance "+instance.ID)
+		}
+		if err != nil {
+			return respondError(ctx.Context, 500, "", "The operation can't be started: "+err.Error())
+		}
+
+		return ctx.JSON(202, OperationResponse{Operation: operation.ID})
+	}
+
+	err = p.deprovision(ctx, instance)
 	if err != nil {
-		return ctx.Gone()
+		return respondError(ctx.Context, 500, "", "The instance can't be deleted: "+err.Error())
 	}
 
 	return ctx.OK(&app.CfbrokerDashboard{})
 }
+
+// InstanceResponse is the body of a fetched instance.
+type InstanceResponse struct {
+	ServiceID string `json:"service_id"`
+	PlanID    string `json:"plan_id"`
+}
+
+// Show lets the platform recover what it knows about the instance. It can't
+// be fetched while an operation on it is in progress.
+func (p *Provisioning) Show(ctx *app.ShowInstanceContext) error {
+	if !apiVersion(ctx.Context).AtLeast(fetchVersion) {
+		return refuseVersion(ctx.Context, fetchVersion)
+	}
+
+	instance, err := p.state.Instance(ctx.InstanceId)
+	if err != nil {
+		return respondError(ctx.Context, 404, "", unknownInstance(ctx.InstanceId))
+	}
+
+	if p.busy(instance.ID) {
+		return concurrencyError(ctx.Context, "instance "+instance.ID)
+	}
+
+	return ctx.JSON(200, InstanceResponse{
+		ServiceID: instance.ServiceID,
+		PlanID:    instance.PlanID,
+	})
+}
+
+// Resume runs the operations a restart of the broker interrupted again. Each
+// of them is safe to repeat.
+func (p *Provisioning) Resume(log Logger) error {
+	instances, err := p.state.Instances()
+	if err != nil {
+		return err
+	}
+
+	for _, instance := range instances {
+		operation, err := p.state.Operation(instance.ID)
+		if err == nil && operation.InProgress() {
+			p.queue.Enqueue(func() { p.run(log, *operation) })
+		}
+	}
+
+	return nil
+}
+
+// begin records a new operation on the instance and enqueues it.
+func (p *Provisioning) begin(log Logger, instanceID, operationType, planID string) (storage.Operation, error) {
+	operation, err := p.claim(instanceID, operationType, planID)
+	if err != nil {
+		return operation, err
+	}
+
+	p.queue.Enqueue(func() { p.run(log, operation) })
+	return operation, nil
+}
+
+// claim records a new operation on the instance, unless another one is in
+// progress.
+func (p *Provisioning) claim(instanceID, operationType, planID string) (storage.Operation, error) {
+	operation, err := newOperation(instanceID, operationType)
+	if err != nil {
+		return operation, err
+	}
+
+	operation.PlanID = planID
+
+	p.operations.Lock()
+	defer p.operations.Unlock()
+
+	if p.busy(instanceID) {
+		return operation, errOperationInProgress
+	}
+
+	return operation, p.state.SaveOperation(operation)
+}
+
+// run does the work of the operation and records its outcome. Nothing is
+// left to record once an instance is deprovisioned.
+func (p *Provisioning) run(log Logger, operation storage.Operation) {
+	instance, err := p.state.Instance(operation.InstanceID)
+	if err != nil {
+		return
+	}
+
+	switch operation.Type {
+	case storage.ProvisionOperation:
+		err = p.start(*instance)
+	case storage.UpdateOperation:
+		err = p.changePlan(*instance, operation.PlanID)
+	case storage.DeprovisionOperation:
+		err = p.deprovision(log, instance)
+		if err == nil {
+			return
+		}
+	}
+
+	p.record(log, operation, err)
+}
+
+// record saves the outcome of the operation.
+func (p *Provisioning) record(log Logger, operation storage.Operation, err error) {
+	err = p.state.SaveOperation(finish(operation, err))
+	if err != nil {
+		log.Error("failed to record the operation", "instance", operation.InstanceID, "operation", operation.ID, "error", err.Error())
+	}
+}
+
+// busy tells whether an operation on the instance is still running.
+func (p *Provisioning) busy(instanceID string) bool {
+	operation, err := p.state.Operation(instanceID)
+	return err == nil && operation.InProgress()
+}
+
+// start serves the instance, through the proxy or a memcached of its own.
+func (p *Provisioning) start(instance repository.Instance) error {
+	if shared(p.router, instance.PlanID) {
+		return p.router.AddRoute(instance)
+	}
+
+	return p.runner.Start(instance)
+}
+
+// checkPlanChange tells whether the instance can move to the plan: it must
+// stay shared or dedicated, and the plan must fit in the capacity left.
+func (p *Provisioning) checkPlanChange(instance repository.Instance, planID string) error {
+	if planID == instance.PlanID {
+		return nil
+	}
+
+	if shared(p.router, instance.PlanID) != shared(p.router, planID) {
+		return errPlanMove
+	}
+
+	if !p.state.PlanChangeFits(instance.ID, planID) {
+		return errNoPlanCapacity
+	}
+
+	return nil
+}
+
+// changePlan resizes the instance to the plan, and only then records the
+// plan. When recording fails, the instance is resized back.
+func (p *Provisioning) changePlan(instance repository.Instance, planID string) error {
+	resized := instance
+	resized.PlanID = planID
+	if planID == instance.PlanID {
+		return p.state.UpdateInstance(resized)
+	}
+
+	err := p.checkPlanChange(instance, planID)
+	if err != nil {
+		return err
+	}
+
+	err = p.resize(resized)
+	if err != nil {
+		return err
+	}
+
+	err = p.state.UpdateInstance(resized)
+	if err != nil {
+		p.resize(instance)
+		return err
+	}
+
+	return nil
+}
+
+// resize serves the instance with the memory of its plan, through the proxy
+// or its own memcached.
+func (p *Provisioning) resize(instance repository.Instance) error {
+	if shared(p.router, instance.PlanID) {
+		return p.router.AddRoute(instance)
+	}
+
+	return p.runner.Resize(instance)
+}
+
+// deprovision stops serving the instance and forgets about it. Only
+// failing to forget it is an error, the rest is logged.
+func (p *Provisioning) deprovision(log Logger, instance *repository.Instance) error {
+	var err error
+	if shared(p.router, instance.PlanID) {
+		err = p.router.RemoveRoute(instance.ID)
+		if err != nil {
+			log.Error("failed to remove the proxy route", "instance", instance.ID, "error", err.Error())
+		}
+	} else {
+		err = p.runner.Stop(instance.ID)
+		if err != nil {
+			log.Error("failed to stop memcached", "instance", instance.ID, "error", err.Error())
+		}
+	}
+
+	err = p.state.DeleteInstance(instance.ID)
+	if err != nil {
+		return err
+	}
+
+	err = p.authenticator.Remove(instance.ID)
+	if err != nil {
+		log.Error("failed to remove the users", "instance", instance.ID, "error", err.Error())
+	}
+
+	return nil
+}
+
+// noCapacity describes running out of room for another instance of the
+// plan, and why.
+func noCapacity(planID string, err error) string {
+	return fmt.Sprintf("No capacity left for another instance of plan %s: %s", planID, err.Error())
+}
+
+// shared tells whether instances of the plan are served through the proxy.
+func shared(router proxy.Router, planID string) bool {
+	return router != nil && router.Serves(planID)
+}
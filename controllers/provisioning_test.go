@@ -1,6 +1,7 @@
 package controllers_test
 
 import (
+	"encoding/json"
 	"errors"
 	"net/http"
 	"net/http/httptest"
@@ -8,9 +9,16 @@ import (
 
 	"github.com/raphael/goa"
 	"github.com/tscolari/cf-broker-api/common/repository"
-	"github.com/tscolari/cf-broker-api/common/repository/fakes"
 	"github.com/tscolari/memcached-broker/app"
+	authfakes "github.com/tscolari/memcached-broker/auth/fakes"
 	"github.com/tscolari/memcached-broker/controllers"
+	"github.com/tscolari/memcached-broker/inventory"
+	proxyfakes "github.com/tscolari/memcached-broker/proxy/fakes"
+	"github.com/tscolari/memcached-broker/runner"
+	runnerfakes "github.com/tscolari/memcached-broker/runner/fakes"
+	"github.com/tscolari/memcached-broker/storage"
+	"github.com/tscolari/memcached-broker/storage/fakes"
+	workerfakes "github.com/tscolari/memcached-broker/worker/fakes"
 	"golang.org/x/net/context"
 
 	. "github.com/onsi/ginkgo"
@@ -21,17 +29,54 @@ var _ = Describe("Provisioning", func() {
 	var provisioningController *controllers.Provisioning
 	var goaContext *goa.Context
 	var responseWriter *httptest.ResponseRecorder
-	var state *fakes.FakeState
+	var state *fakes.FakeStorage
+	var authenticator *authfakes.FakeAuthenticator
+	var memcachedRunner *runnerfakes.FakeRunner
+	var router *proxyfakes.FakeRouter
+	var queue *workerfakes.FakeQueue
+	var params url.Values
+	var payload map[string]interface{}
 
 	BeforeEach(func() {
-		state = new(fakes.FakeState)
-		provisioningController = controllers.NewProvisioning(state)
+		state = new(fakes.FakeStorage)
+		authenticator = new(authfakes.FakeAuthenticator)
+		memcachedRunner = new(runnerfakes.FakeRunner)
+		router = new(proxyfakes.FakeRouter)
+		router.ServesStub = func(planID string) bool {
+			return planID == "shared-plan"
+		}
+		queue = new(workerfakes.FakeQueue)
+		queue.EnqueueStub = func(job func()) {
+			job()
+		}
+		state.OperationReturns(nil, errors.New("Operation not found"))
+		state.PlanChangeFitsReturns(true)
+		nodes, err := inventory.New([]inventory.Node{{Host: "10.0.0.1", PortRange: "11211-11212"}})
+		Expect(err).ToNot(HaveOccurred())
+		catalog := app.CfbrokerCatalog{
+			Services: []*app.CfbrokerService{
+				{
+					ID:            "service-1",
+					PlanUpdatable: true,
+					Plans: []*app.CfbrokerPlan{
+						{ID: "plan-1"}, {ID: "plan-2"}, {ID: "shared-plan"},
+					},
+				},
+				{
+					ID: "service-2",
+					Plans: []*app.CfbrokerPlan{
+						{ID: "plan-3"}, {ID: "plan-4"},
+					},
+				},
+			},
+		}
+		provisioningController = controllers.NewProvisioning(catalog, state, nodes, authenticator, memcachedRunner, router, queue)
 
 		gctx := context.Background()
 		req := http.Request{}
 		responseWriter = httptest.NewRecorder()
-		params := url.Values{}
-		payload := map[string]string{}
+		params = url.Values{}
+		payload = map[string]interface{}{}
 
 		goaContext = goa.NewContext(gctx, &req, responseWriter, params, payload)
 	})
@@ -69,18 +114,418 @@ var _ = Describe("Provisioning", func() {
 				Expect(recordedInstance.ServiceID).To(Equal("service-1"))
 				Expect(recordedInstance.PlanID).To(Equal("plan-1"))
 			})
+
+			It("places the instance on the first free slot", func() {
+				recordedInstance := state.AddInstanceArgsForCall(0)
+				Expect(recordedInstance.Host).To(Equal("10.0.0.1"))
+				Expect(recordedInstance.Port).To(Equal("11211"))
+			})
+
+			It("starts the memcached of the instance", func() {
+				Expect(memcachedRunner.StartCallCount()).To(Equal(1))
+				Expect(memcachedRunner.StartArgsForCall(0)).To(Equal(state.AddInstanceArgsForCall(0)))
+			})
+		})
+
+		Context("when memcached fails to start", func() {
+			BeforeEach(func() {
+				memcachedRunner.StartReturns(errors.New("no such file"))
+
+				err := provisioningController.Create(provisioningContext)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("responds with 503", func() {
+				Expect(goaContext.ResponseStatus()).To(Equal(503))
+			})
+
+			It("removes the instance again", func() {
+				Expect(state.DeleteInstanceCallCount()).To(Equal(1))
+				Expect(state.DeleteInstanceArgsForCall(0)).To(Equal("some-instance-id"))
+			})
+		})
+
+		Context("when memcached is slow to start", func() {
+			var started, release, done chan struct{}
+
+			BeforeEach(func() {
+				started = make(chan struct{})
+				release = make(chan struct{})
+				done = make(chan struct{})
+				memcachedRunner.StartStub = func(instance repository.Instance) error {
+					if instance.ID == "some-instance-id" {
+						close(started)
+						<-release
+					}
+					return nil
+				}
+
+				go func() {
+					defer GinkgoRecover()
+					defer close(done)
+
+					err := provisioningController.Create(provisioningContext)
+					Expect(err).ToNot(HaveOccurred())
+				}()
+				Eventually(started).Should(BeClosed())
+			})
+
+			AfterEach(func() {
+				close(release)
+				Eventually(done).Should(BeClosed())
+			})
+
+			It("provisions other instances in the meantime", func() {
+				otherWriter := httptest.NewRecorder()
+				otherContext, err := app.NewCreateProvisioningContext(goa.NewContext(context.Background(), &http.Request{}, otherWriter, url.Values{}, map[string]interface{}{}))
+				Expect(err).ToNot(HaveOccurred())
+				otherContext.InstanceId = "other-instance-id"
+				otherContext.ServiceId = "service-1"
+				otherContext.PlanId = "plan-1"
+
+				err = provisioningController.Create(otherContext)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(otherWriter.Code).To(Equal(201))
+				Expect(state.AddInstanceCallCount()).To(Equal(2))
+				Expect(memcachedRunner.StartCallCount()).To(Equal(2))
+			})
+		})
+
+		Context("when other instances use some of the slots", func() {
+			BeforeEach(func() {
+				state.InstancesReturns([]repository.Instance{
+					{ID: "other-instance-id", Host: "10.0.0.1", Port: "11211"},
+				}, nil)
+
+				err := provisioningController.Create(provisioningContext)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("places the instance on a free one", func() {
+				recordedInstance := state.AddInstanceArgsForCall(0)
+				Expect(recordedInstance.Host).To(Equal("10.0.0.1"))
+				Expect(recordedInstance.Port).To(Equal("11212"))
+			})
+		})
+
+		Context("when every slot is taken", func() {
+			BeforeEach(func() {
+				state.InstancesReturns([]repository.Instance{
+					{ID: "instance-1", Host: "10.0.0.1", Port: "11211"},
+					{ID: "instance-2", Host: "10.0.0.1", Port: "11212"},
+				}, nil)
+
+				err := provisioningController.Create(provisioningContext)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("responds with 503 and tells there is no capacity left", func() {
+				Expect(goaContext.ResponseStatus()).To(Equal(503))
+				Expect(responseWriter.Body.String()).To(MatchJSON(`{
+					"description": "No capacity left for another instance of plan plan-1: No free memcached slot left"
+				}`))
+			})
+
+			It("doesn't store the instance", func() {
+				Expect(state.AddInstanceCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the capacity is used up", func() {
+			BeforeEach(func() {
+				state.AddInstanceReturns(storage.ErrNoCapacity)
+
+				err := provisioningController.Create(provisioningContext)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("responds with 503 and tells there is no capacity left", func() {
+				Expect(goaContext.ResponseStatus()).To(Equal(503))
+				Expect(responseWriter.Body.String()).To(MatchJSON(`{
+					"description": "No capacity left for another instance of plan plan-1: Can't allocate instance, no capacity"
+				}`))
+				Expect(memcachedRunner.StartCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the request has maintenance_info", func() {
+			BeforeEach(func() {
+				payload["maintenance_info"] = map[string]interface{}{"version": "1.0.0"}
+
+				err := provisioningController.Create(provisioningContext)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("responds with 422 and a maintenance info conflict", func() {
+				Expect(goaContext.ResponseStatus()).To(Equal(422))
+				Expect(responseWriter.Body.String()).To(MatchJSON(`{
+					"error": "MaintenanceInfoConflict",
+					"description": "The plans of the catalog have no maintenance_info"
+				}`))
+				Expect(state.AddInstanceCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the service isn't in the catalog", func() {
+			BeforeEach(func() {
+				provisioningContext.ServiceId = "unknown-service"
+
+				err := provisioningController.Create(provisioningContext)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("responds with 400 and why", func() {
+				Expect(goaContext.ResponseStatus()).To(Equal(400))
+				Expect(responseWriter.Body.String()).To(MatchJSON(`{"description":"Unknown service \"unknown-service\""}`))
+			})
+
+			It("doesn't store the instance", func() {
+				Expect(state.AddInstanceCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the plan isn't one of the service", func() {
+			BeforeEach(func() {
+				provisioningContext.PlanId = "plan-3"
+
+				err := provisioningController.Create(provisioningContext)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("responds with 400 and why", func() {
+				Expect(goaContext.ResponseStatus()).To(Equal(400))
+				Expect(responseWriter.Body.String()).To(MatchJSON(`{"description":"Unknown plan \"plan-3\" of service \"service-1\""}`))
+				Expect(state.AddInstanceCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the instances can't be listed", func() {
+			BeforeEach(func() {
+				state.InstancesReturns(nil, errors.New("disk on fire"))
+
+				err := provisioningController.Create(provisioningContext)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("responds with 503", func() {
+				Expect(goaContext.ResponseStatus()).To(Equal(503))
+			})
+		})
+
+		Context("when the plan is shared", func() {
+			BeforeEach(func() {
+				provisioningContext.PlanId = "shared-plan"
+			})
+
+			JustBeforeEach(func() {
+				err := provisioningController.Create(provisioningContext)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("routes the instance through the proxy", func() {
+				Expect(goaContext.ResponseStatus()).To(Equal(201))
+				Expect(router.AddRouteCallCount()).To(Equal(1))
+				Expect(router.AddRouteArgsForCall(0)).To(Equal(state.AddInstanceArgsForCall(0)))
+			})
+
+			It("doesn't take a slot nor start memcached", func() {
+				instance := state.AddInstanceArgsForCall(0)
+				Expect(instance.Host).To(BeEmpty())
+				Expect(instance.Port).To(BeEmpty())
+				Expect(memcachedRunner.StartCallCount()).To(Equal(0))
+			})
+
+			Context("when the route can't be added", func() {
+				BeforeEach(func() {
+					router.AddRouteReturns(errors.New("no route"))
+				})
+
+				It("responds with 503 and removes the instance again", func() {
+					Expect(goaContext.ResponseStatus()).To(Equal(503))
+					Expect(state.DeleteInstanceCallCount()).To(Equal(1))
+				})
+			})
+		})
+
+		Context("when the platform accepts an incomplete provision", func() {
+			var instance repository.Instance
+
+			BeforeEach(func() {
+				params.Set("accepts_incomplete", "true")
+				state.InstanceStub = func(instanceID string) (*repository.Instance, error) {
+					return &instance, nil
+				}
+				queue.EnqueueStub = nil
+			})
+
+			JustBeforeEach(func() {
+				err := provisioningController.Create(provisioningContext)
+				Expect(err).ToNot(HaveOccurred())
+				instance = state.AddInstanceArgsForCall(0)
+			})
+
+			It("responds with 202 and the operation", func() {
+				Expect(goaContext.ResponseStatus()).To(Equal(202))
+
+				operation := state.SaveOperationArgsForCall(0)
+				Expect(operation.InstanceID).To(Equal("some-instance-id"))
+				Expect(operation.Type).To(Equal(storage.ProvisionOperation))
+				Expect(operation.State).To(Equal(storage.OperationInProgress))
+				Expect(responseWriter.Body.String()).To(MatchJSON(`{"operation":"` + operation.ID + `"}`))
+			})
+
+			It("starts memcached in the background", func() {
+				Expect(memcachedRunner.StartCallCount()).To(Equal(0))
+				Expect(queue.EnqueueCallCount()).To(Equal(1))
+
+				queue.EnqueueArgsForCall(0)()
+				Expect(memcachedRunner.StartCallCount()).To(Equal(1))
+				Expect(memcachedRunner.StartArgsForCall(0)).To(Equal(instance))
+
+				operation := state.SaveOperationArgsForCall(1)
+				Expect(operation.ID).To(Equal(state.SaveOperationArgsForCall(0).ID))
+				Expect(operation.State).To(Equal(storage.OperationSucceeded))
+			})
+
+			Context("when memcached fails to start", func() {
+				BeforeEach(func() {
+					memcachedRunner.StartReturns(errors.New("no such file"))
+				})
+
+				It("records the failure and keeps the instance", func() {
+					queue.EnqueueArgsForCall(0)()
+
+					operation := state.SaveOperationArgsForCall(1)
+					Expect(operation.State).To(Equal(storage.OperationFailed))
+					Expect(operation.Description).To(Equal("no such file"))
+					Expect(state.DeleteInstanceCallCount()).To(Equal(0))
+				})
+			})
+
+			Context("when the operation can't be stored", func() {
+				BeforeEach(func() {
+					state.SaveOperationReturns(errors.New("disk full"))
+				})
+
+				It("responds with 503 and removes the instance again", func() {
+					Expect(goaContext.ResponseStatus()).To(Equal(503))
+					Expect(queue.EnqueueCallCount()).To(Equal(0))
+					Expect(state.DeleteInstanceArgsForCall(0)).To(Equal("some-instance-id"))
+				})
+			})
+		})
+
+		Context("when the request has parameters", func() {
+			BeforeEach(func() {
+				payload["parameters"] = map[string]interface{}{"ttl": 60, "eviction": false}
+
+				err := provisioningController.Create(provisioningContext)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("stores them", func() {
+				instanceID, parameters := state.SaveInstanceParametersArgsForCall(0)
+				Expect(instanceID).To(Equal("some-instance-id"))
+				Expect(parameters).To(Equal(`{"eviction":false,"ttl":60}`))
+			})
 		})
 
 		Context("when the instance id already exists", func() {
+			var existing repository.Instance
+
 			BeforeEach(func() {
+				existing = repository.Instance{
+					ID:             "some-instance-id",
+					ServiceID:      "service-1",
+					PlanID:         "plan-1",
+					OrganizationID: "org-1",
+					SpaceID:        "space-1",
+					Host:           "10.0.0.1",
+					Port:           "11211",
+				}
+
 				state.InstanceExistsReturns(true)
+				state.InstanceReturns(&existing, nil)
+				state.InstanceParametersReturns(`{"ttl":60}`, nil)
+				payload["parameters"] = map[string]interface{}{"ttl": 60}
+			})
 
+			JustBeforeEach(func() {
 				err := provisioningController.Create(provisioningContext)
 				Expect(err).ToNot(HaveOccurred())
 			})
 
-			It("responds with 409", func() {
-				Expect(goaContext.ResponseStatus()).To(Equal(409))
+			Context("and the request is the same", func() {
+				It("responds with 200 without changing anything", func() {
+					Expect(goaContext.ResponseStatus()).To(Equal(200))
+					Expect(responseWriter.Body.String()).To(MatchJSON(`{}`))
+					Expect(state.AddInstanceCallCount()).To(Equal(0))
+					Expect(memcachedRunner.StartCallCount()).To(Equal(0))
+				})
+
+				Context("and it's still being provisioned", func() {
+					BeforeEach(func() {
+						state.OperationReturns(&storage.Operation{
+							ID:    "operation-1",
+							Type:  storage.ProvisionOperation,
+							State: storage.OperationInProgress,
+						}, nil)
+						params.Set("accepts_incomplete", "true")
+					})
+
+					It("responds with 202 and the same operation", func() {
+						Expect(goaContext.ResponseStatus()).To(Equal(202))
+						Expect(responseWriter.Body.String()).To(MatchJSON(`{"operation":"operation-1"}`))
+						Expect(state.SaveOperationCallCount()).To(Equal(0))
+					})
+
+					Context("but the platform doesn't accept incomplete requests", func() {
+						BeforeEach(func() {
+							params.Del("accepts_incomplete")
+						})
+
+						It("responds with 422 and tells that async is required", func() {
+							Expect(goaContext.ResponseStatus()).To(Equal(422))
+							Expect(responseWriter.Body.String()).To(MatchJSON(`{
+								"error": "AsyncRequired",
+								"description": "The provision of instance some-instance-id is still in progress, it can only be polled with accepts_incomplete"
+							}`))
+						})
+					})
+				})
+			})
+
+			Context("and the request has another plan", func() {
+				BeforeEach(func() {
+					existing.PlanID = "plan-2"
+				})
+
+				It("responds with 409 and why", func() {
+					Expect(goaContext.ResponseStatus()).To(Equal(409))
+					Expect(responseWriter.Body.String()).To(MatchJSON(`{
+						"description": "Instance some-instance-id exists with other attributes or parameters"
+					}`))
+				})
+			})
+
+			Context("and the request has another space", func() {
+				BeforeEach(func() {
+					existing.SpaceID = "space-2"
+				})
+
+				It("responds with 409", func() {
+					Expect(goaContext.ResponseStatus()).To(Equal(409))
+				})
+			})
+
+			Context("and the request has other parameters", func() {
+				BeforeEach(func() {
+					payload["parameters"] = map[string]interface{}{"ttl": 120}
+				})
+
+				It("responds with 409", func() {
+					Expect(goaContext.ResponseStatus()).To(Equal(409))
+				})
 			})
 		})
 
@@ -106,6 +551,8 @@ var _ = Describe("Provisioning", func() {
 			Expect(err).ToNot(HaveOccurred())
 
 			provisioningContext.InstanceId = "some-instance-id"
+			provisioningContext.ServiceId = "service-1"
+			provisioningContext.PlanId = "plan-2"
 		})
 
 		Context("when all goes ok", func() {
@@ -120,8 +567,6 @@ var _ = Describe("Provisioning", func() {
 
 				state.InstanceReturns(&instance, nil)
 
-				provisioningContext.ServiceId = "service-2"
-				provisioningContext.PlanId = "plan-2"
 				err := provisioningController.Update(provisioningContext)
 				Expect(err).ToNot(HaveOccurred())
 			})
@@ -135,9 +580,303 @@ var _ = Describe("Provisioning", func() {
 				Expect(recordedInstance.ID).To(Equal("some-instance-id"))
 				Expect(recordedInstance.OrganizationID).To(Equal("org-1"))
 				Expect(recordedInstance.SpaceID).To(Equal("space-1"))
-				Expect(recordedInstance.ServiceID).To(Equal("service-2"))
+				Expect(recordedInstance.ServiceID).To(Equal("service-1"))
 				Expect(recordedInstance.PlanID).To(Equal("plan-2"))
 			})
+
+			It("records the update as an operation on the instance", func() {
+				Expect(state.SaveOperationCallCount()).To(Equal(2))
+
+				operation := state.SaveOperationArgsForCall(0)
+				Expect(operation.InstanceID).To(Equal("some-instance-id"))
+				Expect(operation.Type).To(Equal(storage.UpdateOperation))
+				Expect(operation.PlanID).To(Equal("plan-2"))
+				Expect(operation.State).To(Equal(storage.OperationInProgress))
+
+				Expect(state.SaveOperationArgsForCall(1).ID).To(Equal(operation.ID))
+				Expect(state.SaveOperationArgsForCall(1).State).To(Equal(storage.OperationSucceeded))
+			})
+
+			It("resizes memcached to the new plan first", func() {
+				Expect(state.PlanChangeFitsCallCount()).ToNot(BeZero())
+				instanceID, planID := state.PlanChangeFitsArgsForCall(0)
+				Expect(instanceID).To(Equal("some-instance-id"))
+				Expect(planID).To(Equal("plan-2"))
+
+				Expect(memcachedRunner.ResizeCallCount()).To(Equal(1))
+				Expect(memcachedRunner.ResizeArgsForCall(0)).To(Equal(state.UpdateInstanceArgsForCall(0)))
+			})
+		})
+
+		Context("when the plan is shared", func() {
+			BeforeEach(func() {
+				state.InstanceReturns(&repository.Instance{ID: "some-instance-id", ServiceID: "service-1", PlanID: "shared-plan"}, nil)
+				router.ServesStub = func(planID string) bool {
+					return planID == "shared-plan" || planID == "plan-2"
+				}
+
+				err := provisioningController.Update(provisioningContext)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("changes the quota of the proxy route", func() {
+				Expect(goaContext.ResponseStatus()).To(Equal(200))
+				Expect(router.AddRouteCallCount()).To(Equal(1))
+				Expect(router.AddRouteArgsForCall(0).PlanID).To(Equal("plan-2"))
+				Expect(memcachedRunner.ResizeCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the new plan is shared and the old one isn't", func() {
+			BeforeEach(func() {
+				state.InstanceReturns(&repository.Instance{ID: "some-instance-id", ServiceID: "service-1", PlanID: "plan-1"}, nil)
+				provisioningContext.PlanId = "shared-plan"
+
+				err := provisioningController.Update(provisioningContext)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("responds with 422", func() {
+				Expect(goaContext.ResponseStatus()).To(Equal(422))
+				Expect(router.AddRouteCallCount()).To(Equal(0))
+				Expect(state.UpdateInstanceCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the new plan doesn't fit in the capacity left", func() {
+			BeforeEach(func() {
+				state.InstanceReturns(&repository.Instance{ID: "some-instance-id", ServiceID: "service-1", PlanID: "plan-1"}, nil)
+				state.PlanChangeFitsReturns(false)
+
+				err := provisioningController.Update(provisioningContext)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("responds with 503 without resizing", func() {
+				Expect(goaContext.ResponseStatus()).To(Equal(503))
+				Expect(responseWriter.Body.String()).To(MatchJSON(`{"description":"No capacity left for the new plan"}`))
+				Expect(memcachedRunner.ResizeCallCount()).To(Equal(0))
+				Expect(state.UpdateInstanceCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the instance stores more than the new plan allows", func() {
+			BeforeEach(func() {
+				state.InstanceReturns(&repository.Instance{ID: "some-instance-id", ServiceID: "service-1", PlanID: "plan-1"}, nil)
+				memcachedRunner.ResizeReturns(runner.ErrOverflow)
+
+				err := provisioningController.Update(provisioningContext)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("responds with 422 and keeps the plan", func() {
+				Expect(goaContext.ResponseStatus()).To(Equal(422))
+				Expect(state.UpdateInstanceCallCount()).To(Equal(0))
+			})
+
+			It("records the update as failed", func() {
+				operation := state.SaveOperationArgsForCall(1)
+				Expect(operation.State).To(Equal(storage.OperationFailed))
+				Expect(operation.Description).To(Equal(runner.ErrOverflow.Error()))
+			})
+		})
+
+		Context("when another update of the instance starts at the same time", func() {
+			BeforeEach(func() {
+				state.InstanceReturns(&repository.Instance{ID: "some-instance-id", ServiceID: "service-1", PlanID: "plan-1"}, nil)
+				state.OperationReturnsOnCall(1, &storage.Operation{Type: storage.UpdateOperation, State: storage.OperationInProgress}, nil)
+
+				err := provisioningController.Update(provisioningContext)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("responds with 422 and a concurrency error without resizing", func() {
+				Expect(goaContext.ResponseStatus()).To(Equal(422))
+				Expect(responseWriter.Body.String()).To(MatchJSON(`{
+					"error": "ConcurrencyError",
+					"description": "Another operation on instance some-instance-id is in progress"
+				}`))
+				Expect(state.SaveOperationCallCount()).To(Equal(0))
+				Expect(memcachedRunner.ResizeCallCount()).To(Equal(0))
+				Expect(state.UpdateInstanceCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the request names another service than the instance's", func() {
+			BeforeEach(func() {
+				state.InstanceReturns(&repository.Instance{ID: "some-instance-id", ServiceID: "service-2", PlanID: "plan-3"}, nil)
+
+				err := provisioningController.Update(provisioningContext)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("responds with 400", func() {
+				Expect(goaContext.ResponseStatus()).To(Equal(400))
+				Expect(responseWriter.Body.String()).To(MatchJSON(`{"description":"Instance some-instance-id is an instance of service \"service-2\""}`))
+				Expect(memcachedRunner.ResizeCallCount()).To(Equal(0))
+				Expect(state.UpdateInstanceCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the new plan can't be recorded", func() {
+			BeforeEach(func() {
+				state.InstanceReturns(&repository.Instance{ID: "some-instance-id", ServiceID: "service-1", PlanID: "plan-1"}, nil)
+				state.UpdateInstanceReturns(errors.New("Can't allocate instance, no capacity"))
+
+				err := provisioningController.Update(provisioningContext)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("responds with 500", func() {
+				Expect(goaContext.ResponseStatus()).To(Equal(500))
+			})
+
+			It("resizes memcached back to the old plan", func() {
+				Expect(memcachedRunner.ResizeCallCount()).To(Equal(2))
+				Expect(memcachedRunner.ResizeArgsForCall(1).PlanID).To(Equal("plan-1"))
+			})
+		})
+
+		Context("when the request has no plan", func() {
+			BeforeEach(func() {
+				state.InstanceReturns(&repository.Instance{ID: "some-instance-id", ServiceID: "service-1", PlanID: "plan-1"}, nil)
+
+				provisioningContext.PlanId = ""
+				err := provisioningController.Update(provisioningContext)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("keeps the plan of the instance", func() {
+				Expect(goaContext.ResponseStatus()).To(Equal(200))
+				Expect(state.UpdateInstanceArgsForCall(0).PlanID).To(Equal("plan-1"))
+			})
+		})
+
+		Context("when the plan isn't in the catalog", func() {
+			BeforeEach(func() {
+				state.InstanceReturns(&repository.Instance{ID: "some-instance-id", ServiceID: "service-1", PlanID: "plan-1"}, nil)
+
+				provisioningContext.PlanId = "unknown-plan"
+				err := provisioningController.Update(provisioningContext)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("responds with 400 and why", func() {
+				Expect(goaContext.ResponseStatus()).To(Equal(400))
+				Expect(responseWriter.Body.String()).To(MatchJSON(`{"description":"Unknown plan \"unknown-plan\" of service \"service-1\""}`))
+				Expect(state.UpdateInstanceCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the service doesn't allow changing plans", func() {
+			BeforeEach(func() {
+				state.InstanceReturns(&repository.Instance{ID: "some-instance-id", ServiceID: "service-2", PlanID: "plan-3"}, nil)
+				provisioningContext.ServiceId = "service-2"
+			})
+
+			Context("and the plan changes", func() {
+				BeforeEach(func() {
+					provisioningContext.PlanId = "plan-4"
+					err := provisioningController.Update(provisioningContext)
+					Expect(err).ToNot(HaveOccurred())
+				})
+
+				It("responds with 422", func() {
+					Expect(goaContext.ResponseStatus()).To(Equal(422))
+					Expect(responseWriter.Body.String()).To(MatchJSON(`{"description":"The plan of service \"service-2\" can't be changed"}`))
+					Expect(state.UpdateInstanceCallCount()).To(Equal(0))
+				})
+			})
+
+			Context("and the plan stays the same", func() {
+				BeforeEach(func() {
+					provisioningContext.PlanId = "plan-3"
+					err := provisioningController.Update(provisioningContext)
+					Expect(err).ToNot(HaveOccurred())
+				})
+
+				It("responds with 200", func() {
+					Expect(goaContext.ResponseStatus()).To(Equal(200))
+				})
+			})
+		})
+
+		Context("when the platform accepts an incomplete update", func() {
+			BeforeEach(func() {
+				params.Set("accepts_incomplete", "true")
+				state.InstanceReturns(&repository.Instance{ID: "some-instance-id", ServiceID: "service-1", PlanID: "plan-1"}, nil)
+			})
+
+			JustBeforeEach(func() {
+				err := provisioningController.Update(provisioningContext)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("responds with 202", func() {
+				Expect(goaContext.ResponseStatus()).To(Equal(202))
+			})
+
+			It("changes the plan in the background", func() {
+				Expect(queue.EnqueueCallCount()).To(Equal(1))
+				Expect(state.UpdateInstanceArgsForCall(0).PlanID).To(Equal("plan-2"))
+
+				operation := state.SaveOperationArgsForCall(1)
+				Expect(operation.Type).To(Equal(storage.UpdateOperation))
+				Expect(operation.PlanID).To(Equal("plan-2"))
+				Expect(operation.State).To(Equal(storage.OperationSucceeded))
+			})
+
+			Context("and the instance stores more than the new plan allows", func() {
+				BeforeEach(func() {
+					memcachedRunner.ResizeReturns(runner.ErrOverflow)
+				})
+
+				It("fails the operation and keeps the plan", func() {
+					Expect(state.UpdateInstanceCallCount()).To(Equal(0))
+
+					operation := state.SaveOperationArgsForCall(1)
+					Expect(operation.State).To(Equal(storage.OperationFailed))
+					Expect(operation.Description).To(Equal(runner.ErrOverflow.Error()))
+				})
+			})
+		})
+
+		Context("when an operation on the instance is in progress", func() {
+			BeforeEach(func() {
+				state.InstanceReturns(&repository.Instance{ID: "some-instance-id", ServiceID: "service-1", PlanID: "plan-1"}, nil)
+				state.OperationReturns(&storage.Operation{State: storage.OperationInProgress}, nil)
+
+				err := provisioningController.Update(provisioningContext)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("responds with 422 and a concurrency error", func() {
+				Expect(goaContext.ResponseStatus()).To(Equal(422))
+				Expect(responseWriter.Body.String()).To(MatchJSON(`{
+					"error": "ConcurrencyError",
+					"description": "Another operation on instance some-instance-id is in progress"
+				}`))
+				Expect(state.UpdateInstanceCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the request has maintenance_info", func() {
+			BeforeEach(func() {
+				state.InstanceReturns(&repository.Instance{ID: "some-instance-id", ServiceID: "service-1", PlanID: "plan-1"}, nil)
+				payload["maintenance_info"] = map[string]interface{}{"version": "1.0.0"}
+
+				err := provisioningController.Update(provisioningContext)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("responds with 422 and a maintenance info conflict", func() {
+				Expect(goaContext.ResponseStatus()).To(Equal(422))
+
+				var response controllers.ErrorResponse
+				Expect(json.Unmarshal(responseWriter.Body.Bytes(), &response)).To(Succeed())
+				Expect(response.Error).To(Equal("MaintenanceInfoConflict"))
+				Expect(state.UpdateInstanceCallCount()).To(Equal(0))
+			})
 		})
 
 		Context("when the instance doesn't exist", func() {
@@ -166,7 +905,7 @@ var _ = Describe("Provisioning", func() {
 
 		Context("when all goes ok", func() {
 			BeforeEach(func() {
-				state.InstanceExistsReturns(true)
+				state.InstanceReturns(&repository.Instance{ID: "some-instance-id", PlanID: "plan-1"}, nil)
 
 				err := provisioningController.Delete(provisioningContext)
 				Expect(err).ToNot(HaveOccurred())
@@ -180,10 +919,92 @@ var _ = Describe("Provisioning", func() {
 				instanceID := state.DeleteInstanceArgsForCall(0)
 				Expect(instanceID).To(Equal("some-instance-id"))
 			})
+
+			It("stops the memcached of the instance", func() {
+				Expect(memcachedRunner.StopCallCount()).To(Equal(1))
+				Expect(memcachedRunner.StopArgsForCall(0)).To(Equal("some-instance-id"))
+			})
+
+			It("removes the users of the instance", func() {
+				Expect(authenticator.RemoveCallCount()).To(Equal(1))
+				Expect(authenticator.RemoveArgsForCall(0)).To(Equal("some-instance-id"))
+			})
+		})
+
+		Context("when the plan is shared", func() {
+			BeforeEach(func() {
+				state.InstanceReturns(&repository.Instance{ID: "some-instance-id", PlanID: "shared-plan"}, nil)
+
+				err := provisioningController.Delete(provisioningContext)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("removes the proxy route of the instance", func() {
+				Expect(goaContext.ResponseStatus()).To(Equal(200))
+				Expect(router.RemoveRouteCallCount()).To(Equal(1))
+				Expect(router.RemoveRouteArgsForCall(0)).To(Equal("some-instance-id"))
+				Expect(memcachedRunner.StopCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the platform accepts an incomplete deprovision", func() {
+			BeforeEach(func() {
+				params.Set("accepts_incomplete", "true")
+				state.InstanceReturns(&repository.Instance{ID: "some-instance-id", PlanID: "plan-1"}, nil)
+				queue.EnqueueStub = nil
+
+				err := provisioningController.Delete(provisioningContext)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("responds with 202", func() {
+				Expect(goaContext.ResponseStatus()).To(Equal(202))
+				Expect(state.SaveOperationArgsForCall(0).Type).To(Equal(storage.DeprovisionOperation))
+				Expect(state.DeleteInstanceCallCount()).To(Equal(0))
+			})
+
+			It("deletes the instance in the background", func() {
+				queue.EnqueueArgsForCall(0)()
+
+				Expect(memcachedRunner.StopArgsForCall(0)).To(Equal("some-instance-id"))
+				Expect(state.DeleteInstanceArgsForCall(0)).To(Equal("some-instance-id"))
+				Expect(authenticator.RemoveArgsForCall(0)).To(Equal("some-instance-id"))
+				Expect(state.SaveOperationCallCount()).To(Equal(1))
+			})
+
+			Context("when the instance can't be deleted", func() {
+				BeforeEach(func() {
+					state.DeleteInstanceReturns(errors.New("disk full"))
+				})
+
+				It("records the failure", func() {
+					queue.EnqueueArgsForCall(0)()
+
+					operation := state.SaveOperationArgsForCall(1)
+					Expect(operation.State).To(Equal(storage.OperationFailed))
+					Expect(operation.Description).To(Equal("disk full"))
+				})
+			})
+		})
+
+		Context("when an operation on the instance is in progress", func() {
+			BeforeEach(func() {
+				state.InstanceReturns(&repository.Instance{ID: "some-instance-id"}, nil)
+				state.OperationReturns(&storage.Operation{State: storage.OperationInProgress}, nil)
+
+				err := provisioningController.Delete(provisioningContext)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("responds with 422", func() {
+				Expect(goaContext.ResponseStatus()).To(Equal(422))
+				Expect(state.DeleteInstanceCallCount()).To(Equal(0))
+			})
 		})
 
 		Context("when the instance doesn't exist", func() {
 			BeforeEach(func() {
+				state.InstanceReturns(nil, errors.New("Not here!"))
 				err := provisioningController.Delete(provisioningContext)
 				Expect(err).ToNot(HaveOccurred())
 			})
@@ -193,4 +1014,113 @@ var _ = Describe("Provisioning", func() {
 			})
 		})
 	})
+
+	Describe("#Show", func() {
+		var provisioningContext *app.ShowInstanceContext
+
+		BeforeEach(func() {
+			var err error
+			provisioningContext, err = app.NewShowInstanceContext(goaContext)
+			Expect(err).ToNot(HaveOccurred())
+
+			provisioningContext.InstanceId = "some-instance-id"
+			state.InstanceReturns(&repository.Instance{ID: "some-instance-id", ServiceID: "service-1", PlanID: "plan-1"}, nil)
+		})
+
+		It("responds with the service and plan of the instance", func() {
+			Expect(provisioningController.Show(provisioningContext)).To(Succeed())
+
+			Expect(goaContext.ResponseStatus()).To(Equal(200))
+			Expect(responseWriter.Body.String()).To(MatchJSON(`{"service_id":"service-1","plan_id":"plan-1"}`))
+			Expect(state.InstanceArgsForCall(0)).To(Equal("some-instance-id"))
+		})
+
+		Context("on a broker API version from before fetching instances", func() {
+			It("responds with 412", func() {
+				negotiate(goaContext, "2.13")
+
+				Expect(provisioningController.Show(provisioningContext)).To(Succeed())
+				Expect(goaContext.ResponseStatus()).To(Equal(412))
+				Expect(responseWriter.Body.String()).To(MatchJSON(`{"description":"This needs broker API version 2.14, the request is for 2.13"}`))
+				Expect(state.InstanceCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("on a newer minor broker API version", func() {
+			It("responds with 200", func() {
+				negotiate(goaContext, "2.17")
+
+				Expect(provisioningController.Show(provisioningContext)).To(Succeed())
+				Expect(goaContext.ResponseStatus()).To(Equal(200))
+			})
+		})
+
+		Context("when an operation on the instance is in progress", func() {
+			It("responds with 422", func() {
+				state.OperationReturns(&storage.Operation{State: storage.OperationInProgress}, nil)
+
+				Expect(provisioningController.Show(provisioningContext)).To(Succeed())
+				Expect(goaContext.ResponseStatus()).To(Equal(422))
+			})
+		})
+
+		Context("when the last operation on the instance is over", func() {
+			It("responds with 200", func() {
+				state.OperationReturns(&storage.Operation{State: storage.OperationFailed}, nil)
+
+				Expect(provisioningController.Show(provisioningContext)).To(Succeed())
+				Expect(goaContext.ResponseStatus()).To(Equal(200))
+			})
+		})
+
+		Context("when the instance doesn't exist", func() {
+			It("responds with 404", func() {
+				state.InstanceReturns(nil, errors.New("Not here!"))
+
+				Expect(provisioningController.Show(provisioningContext)).To(Succeed())
+				Expect(goaContext.ResponseStatus()).To(Equal(404))
+			})
+		})
+	})
+
+	Describe("#Resume", func() {
+		BeforeEach(func() {
+			instances := []repository.Instance{
+				{ID: "instance-1", PlanID: "plan-1"},
+				{ID: "instance-2", PlanID: "plan-1"},
+			}
+			state.InstancesReturns(instances, nil)
+			state.InstanceStub = func(instanceID string) (*repository.Instance, error) {
+				for _, instance := range instances {
+					if instance.ID == instanceID {
+						return &instance, nil
+					}
+				}
+				return nil, errors.New("Not here!")
+			}
+			state.OperationStub = func(instanceID string) (*storage.Operation, error) {
+				operation := storage.Operation{ID: "operation-1", InstanceID: instanceID, Type: storage.ProvisionOperation, State: storage.OperationSucceeded}
+				if instanceID == "instance-2" {
+					operation.State = storage.OperationInProgress
+				}
+				return &operation, nil
+			}
+		})
+
+		It("runs the operations in progress again", func() {
+			Expect(provisioningController.Resume(goaContext)).To(Succeed())
+
+			Expect(queue.EnqueueCallCount()).To(Equal(1))
+			Expect(memcachedRunner.StartCallCount()).To(Equal(1))
+			Expect(memcachedRunner.StartArgsForCall(0).ID).To(Equal("instance-2"))
+			Expect(state.SaveOperationArgsForCall(0).State).To(Equal(storage.OperationSucceeded))
+		})
+
+		Context("when the instances can't be listed", func() {
+			It("returns an error", func() {
+				state.InstancesReturns(nil, errors.New("disk on fire"))
+				Expect(provisioningController.Resume(goaContext)).To(MatchError("disk on fire"))
+			})
+		})
+	})
 })
@@ -0,0 +1,98 @@
+// Package design adds the endpoints of this broker to the service broker API
+// described in github.com/tscolari/cf-broker-api/design. Run
+// scripts/generate-app after changing it.
+package design
+
+import (
+	. "github.com/raphael/goa/design"
+	. "github.com/raphael/goa/design/dsl"
+
+	// The catalog, provisioning and binding resources.
+	_ "github.com/tscolari/cf-broker-api/design"
+)
+
+// LastOperationMedia is the state of the last asynchronous operation on an
+// instance, or a binding.
+var LastOperationMedia = MediaType("application/vnd.cfbroker.last-operation+json", func() {
+	Description("The state of an asynchronous operation")
+	Attributes(func() {
+		Attribute("state", String, "The state of the operation", func() {
+			Enum("in progress", "succeeded", "failed")
+		})
+		Attribute("description", String, "What the operation is doing, or why it failed")
+		Required("state")
+	})
+	View("default", func() {
+		Attribute("state")
+		Attribute("description")
+	})
+})
+
+var _ = Resource("last_operation", func() {
+	BasePath("/v2/service_instances")
+
+	Action("instance", func() {
+		Description("Polls the last asynchronous operation on an instance")
+		Routing(GET("/:instance_id/last_operation"))
+		Params(func() {
+			Param("instance_id", String, "The instance")
+			Param("service_id", String, "The service of the instance")
+			Param("plan_id", String, "The plan of the instance")
+			Param("operation", String, "The operation returned when it was accepted")
+		})
+		Response(OK, func() {
+			Media(LastOperationMedia)
+		})
+		Response(BadRequest)
+		Response(Gone)
+	})
+
+	Action("binding", func() {
+		Description("Polls the last asynchronous operation on a binding")
+		Routing(GET("/:instance_id/service_bindings/:binding_id/last_operation"))
+		Params(func() {
+			Param("instance_id", String, "The instance")
+			Param("binding_id", String, "The binding")
+			Param("service_id", String, "The service of the instance")
+			Param("plan_id", String, "The plan of the instance")
+			Param("operation", String, "The operation returned when it was accepted")
+		})
+		Response(OK, func() {
+			Media(LastOperationMedia)
+		})
+		Response(BadRequest)
+		Response(Gone)
+	})
+})
+
+var _ = Resource("instance", func() {
+	BasePath("/v2/service_instances")
+
+	Action("show", func() {
+		Description("Fetches an instance")
+		Routing(GET("/:instance_id"))
+		Params(func() {
+			Param("instance_id", String, "The instance")
+		})
+		Response(OK)
+		Response(NotFound)
+		Response(UnprocessableEntity)
+	})
+})
+
+var _ = Resource("service_binding", func() {
+	BasePath("/v2/service_instances/:instance_id/service_bindings")
+
+	Action("show", func() {
+		Description("Fetches a binding, with its credentials")
+		Routing(GET("/:binding_id"))
+		Params(func() {
+			Param("instance_id", String, "The instance")
+			Param("binding_id", String, "The binding")
+		})
+		Response(OK)
+		Response(NotFound)
+		Response(UnprocessableEntity)
+		Response(InternalServerError)
+	})
+})
@@ -0,0 +1,141 @@
+package inventory
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tscolari/cf-broker-api/common/repository"
+)
+
+var errNoFreeSlot = errors.New("No free memcached slot left")
+
+// Node is a memcached host and the ports instances can use on it, given as
+// a `first-last` range, a list, or both.
+type Node struct {
+	Host      string `yaml:"host"`
+	PortRange string `yaml:"port_range"`
+	Ports     []int  `yaml:"ports"`
+}
+
+// Slot is a host and port an instance can be provisioned on.
+type Slot struct {
+	Host string
+	Port string
+}
+
+// Inventory hands out the slots of the configured nodes.
+//
+// It keeps no state of its own: a slot is taken while an instance points at
+// it. Allocate always picks the first free slot, in the order of the
+// configuration, so the outcome only depends on the stored instances and
+// survives restarts.
+type Inventory struct {
+	slots []Slot
+}
+
+func New(nodes []Node) (*Inventory, error) {
+	inventory := &Inventory{}
+	seen := map[Slot]bool{}
+
+	for _, node := range nodes {
+		if node.Host == "" {
+			return nil, errors.New("Memcached node without a host")
+		}
+
+		ports, err := node.ports()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, port := range ports {
+			slot := Slot{Host: node.Host, Port: strconv.Itoa(port)}
+			if seen[slot] {
+				return nil, fmt.Errorf("Memcached slot %s:%s is listed twice", slot.Host, slot.Port)
+			}
+
+			seen[slot] = true
+			inventory.slots = append(inventory.slots, slot)
+		}
+	}
+
+	return inventory, nil
+}
+
+// Slots returns every slot of the inventory, in allocation order.
+func (i *Inventory) Slots() []Slot {
+	return append([]Slot{}, i.slots...)
+}
+
+// Allocate returns the first slot none of the instances points at.
+func (i *Inventory) Allocate(instances []repository.Instance) (Slot, error) {
+	taken := map[Slot]bool{}
+	for _, instance := range instances {
+		taken[Slot{Host: instance.Host, Port: instance.Port}] = true
+	}
+
+	for _, slot := range i.slots {
+		if !taken[slot] {
+			return slot, nil
+		}
+	}
+
+	return Slot{}, errNoFreeSlot
+}
+
+func (n Node) ports() ([]int, error) {
+	ports := []int{}
+
+	if n.PortRange != "" {
+		bounds := strings.SplitN(n.PortRange, "-", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("Invalid port range for %s: %s", n.Host, n.PortRange)
+		}
+
+		first, err := parsePort(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid port range for %s: %s", n.Host, err.Error())
+		}
+
+		last, err := parsePort(bounds[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid port range for %s: %s", n.Host, err.Error())
+		}
+
+		if last < first {
+			return nil, fmt.Errorf("Invalid port range for %s: %s", n.Host, n.PortRange)
+		}
+
+		for port := first; port <= last; port++ {
+			ports = append(ports, port)
+		}
+	}
+
+	for _, port := range n.Ports {
+		if port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("Invalid port for %s: %d", n.Host, port)
+		}
+
+		ports = append(ports, port)
+	}
+
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("Memcached node %s has no ports", n.Host)
+	}
+
+	return ports, nil
+}
+
+func parsePort(rawPort string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(rawPort))
+	if err != nil {
+		return 0, err
+	}
+
+	if port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("port %d out of range", port)
+	}
+
+	return port, nil
+}
@@ -0,0 +1,118 @@
+package inventory_test
+
+import (
+	"github.com/tscolari/cf-broker-api/common/repository"
+	"github.com/tscolari/memcached-broker/inventory"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Inventory", func() {
+	var nodes []inventory.Node
+
+	BeforeEach(func() {
+		nodes = []inventory.Node{
+			{Host: "10.0.0.1", PortRange: "11211-11212"},
+			{Host: "10.0.0.2", Ports: []int{11300, 11211}},
+		}
+	})
+
+	Describe("New", func() {
+		It("lists the slots in the order of the configuration", func() {
+			nodeInventory, err := inventory.New(nodes)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(nodeInventory.Slots()).To(Equal([]inventory.Slot{
+				{Host: "10.0.0.1", Port: "11211"},
+				{Host: "10.0.0.1", Port: "11212"},
+				{Host: "10.0.0.2", Port: "11300"},
+				{Host: "10.0.0.2", Port: "11211"},
+			}))
+		})
+
+		Context("when a node has no host", func() {
+			It("fails", func() {
+				_, err := inventory.New([]inventory.Node{{PortRange: "11211-11212"}})
+				Expect(err).To(MatchError("Memcached node without a host"))
+			})
+		})
+
+		Context("when a node has no ports", func() {
+			It("fails", func() {
+				_, err := inventory.New([]inventory.Node{{Host: "10.0.0.1"}})
+				Expect(err).To(MatchError("Memcached node 10.0.0.1 has no ports"))
+			})
+		})
+
+		Context("when the port range is invalid", func() {
+			It("fails", func() {
+				for _, portRange := range []string{"11211", "a-b", "11212-11211", "0-10", "65535-65536"} {
+					_, err := inventory.New([]inventory.Node{{Host: "10.0.0.1", PortRange: portRange}})
+					Expect(err).To(HaveOccurred(), portRange)
+					Expect(err.Error()).To(ContainSubstring("Invalid port range for 10.0.0.1"))
+				}
+			})
+		})
+
+		Context("when a port is invalid", func() {
+			It("fails", func() {
+				_, err := inventory.New([]inventory.Node{{Host: "10.0.0.1", Ports: []int{70000}}})
+				Expect(err).To(MatchError("Invalid port for 10.0.0.1: 70000"))
+			})
+		})
+
+		Context("when a slot is listed twice", func() {
+			It("fails", func() {
+				_, err := inventory.New([]inventory.Node{{Host: "10.0.0.1", PortRange: "11211-11212", Ports: []int{11212}}})
+				Expect(err).To(MatchError("Memcached slot 10.0.0.1:11212 is listed twice"))
+			})
+		})
+	})
+
+	Describe("Allocate", func() {
+		var nodeInventory *inventory.Inventory
+
+		BeforeEach(func() {
+			var err error
+			nodeInventory, err = inventory.New(nodes)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("picks the first slot", func() {
+			slot, err := nodeInventory.Allocate([]repository.Instance{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(slot).To(Equal(inventory.Slot{Host: "10.0.0.1", Port: "11211"}))
+		})
+
+		It("skips the slots instances point at", func() {
+			slot, err := nodeInventory.Allocate([]repository.Instance{
+				{ID: "instance-1", Host: "10.0.0.1", Port: "11211"},
+				{ID: "instance-2", Host: "10.0.0.1", Port: "11212"},
+				{ID: "instance-3", Host: "10.0.0.2", Port: "11300"},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(slot).To(Equal(inventory.Slot{Host: "10.0.0.2", Port: "11211"}))
+		})
+
+		It("reuses the slots of deleted instances", func() {
+			slot, err := nodeInventory.Allocate([]repository.Instance{
+				{ID: "instance-2", Host: "10.0.0.1", Port: "11212"},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(slot).To(Equal(inventory.Slot{Host: "10.0.0.1", Port: "11211"}))
+		})
+
+		Context("when every slot is taken", func() {
+			It("fails", func() {
+				instances := []repository.Instance{}
+				for _, slot := range nodeInventory.Slots() {
+					instances = append(instances, repository.Instance{Host: slot.Host, Port: slot.Port})
+				}
+
+				_, err := nodeInventory.Allocate(instances)
+				Expect(err).To(MatchError("No free memcached slot left"))
+			})
+		})
+	})
+})
@@ -1,13 +1,21 @@
 package main
 
 import (
+	_ "github.com/mattn/go-sqlite3"
 	"github.com/raphael/goa"
 	"github.com/raphael/goa/examples/cellar/swagger"
-	commoncontrollers "github.com/tscolari/cf-broker-api/common/controllers"
+	"github.com/tscolari/cf-broker-api/common/repository"
 	"github.com/tscolari/memcached-broker/app"
+	"github.com/tscolari/memcached-broker/auth"
 	"github.com/tscolari/memcached-broker/config"
 	"github.com/tscolari/memcached-broker/controllers"
+	"github.com/tscolari/memcached-broker/inventory"
+	"github.com/tscolari/memcached-broker/memcache"
+	"github.com/tscolari/memcached-broker/middleware"
+	"github.com/tscolari/memcached-broker/proxy"
+	"github.com/tscolari/memcached-broker/runner"
 	"github.com/tscolari/memcached-broker/storage"
+	"github.com/tscolari/memcached-broker/worker"
 )
 
 func main() {
@@ -17,17 +25,111 @@ func main() {
 		panic(err)
 	}
 
-	store, err := storage.NewLocalFile("/tmp/data")
+	basicAuth, err := middleware.BasicAuth(configuration.Credentials)
 	if err != nil {
 		panic(err)
 	}
 
-	provisioningController := controllers.NewProvisioning(store)
-	catalogController := commoncontrollers.NewCatalog(configuration.Catalog)
+	service.Use(basicAuth)
+	service.Use(middleware.APIVersion())
+
+	store, err := storage.New(configuration.Storage)
+	if err != nil {
+		panic(err)
+	}
+
+	nodes, err := inventory.New(configuration.Nodes)
+	if err != nil {
+		panic(err)
+	}
+
+	passwordDB, err := auth.NewPasswordDB(configuration.AuthDirectory)
+	if err != nil {
+		panic(err)
+	}
+
+	memcached, err := newRunner(configuration, passwordDB)
+	if err != nil {
+		panic(err)
+	}
+	passwordDB.Server = memcached
+
+	router, err := newRouter(configuration, store)
+	if err != nil {
+		panic(err)
+	}
+
+	instances, err := store.Instances()
+	if err != nil {
+		panic(err)
+	}
+
+	dedicated := []repository.Instance{}
+	for _, instance := range instances {
+		if router == nil || !router.Serves(instance.PlanID) {
+			dedicated = append(dedicated, instance)
+		}
+	}
+
+	err = memcached.Recover(dedicated)
+	if err != nil {
+		panic(err)
+	}
+
+	queue := worker.NewPool(worker.DefaultWorkers)
+	defer queue.Stop()
+
+	provisioningController := controllers.NewProvisioning(configuration.Catalog, store, nodes, passwordDB, memcached, router, queue)
+	bindingController := controllers.NewBinding(store, passwordDB, router, queue)
+	lastOperationController := controllers.NewLastOperation(store)
+	catalogController := controllers.NewCatalog(configuration.Catalog, router)
+
+	err = provisioningController.Resume(service)
+	if err != nil {
+		panic(err)
+	}
+
+	err = bindingController.Resume(service)
+	if err != nil {
+		panic(err)
+	}
 
 	app.MountCatalogController(service, catalogController)
 	app.MountProvisioningController(service, provisioningController)
+	app.MountBindingController(service, bindingController)
+	app.MountInstanceController(service, provisioningController)
+	app.MountServiceBindingController(service, bindingController)
+	app.MountLastOperationController(service, lastOperationController)
 
 	swagger.MountController(service)
 	service.ListenAndServe(":8080")
 }
+
+type recoverableRunner interface {
+	runner.Runner
+	auth.Server
+	Recover(instances []repository.Instance) error
+}
+
+func newRunner(configuration config.Config, passwordDB *auth.PasswordDB) (recoverableRunner, error) {
+	if configuration.Embedded {
+		return memcache.New(configuration.Storage.PlanSizes, passwordDB.Users), nil
+	}
+
+	return runner.NewSupervisor(configuration.Runner, configuration.Storage.PlanSizes, passwordDB.Path)
+}
+
+// newRouter starts the proxy of the shared plans, when one is configured.
+func newRouter(configuration config.Config, store storage.Storage) (proxy.Router, error) {
+	if configuration.Proxy.Listen == "" {
+		return nil, nil
+	}
+
+	memcachedProxy := proxy.New(configuration.Proxy, configuration.Storage.PlanSizes)
+	err := memcachedProxy.Recover(store)
+	if err != nil {
+		return nil, err
+	}
+
+	return memcachedProxy, memcachedProxy.Listen()
+}
@@ -0,0 +1,438 @@
+package memcache
+
+import (
+	"container/list"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxKeyLength is the longest key memcached accepts.
+	MaxKeyLength = 250
+
+	// itemOverhead is charged against the budget for every item, on top of
+	// its key and value.
+	itemOverhead = 48
+
+	// relativeExptimeLimit is the largest exptime memcached reads as seconds
+	// from now, larger ones are unix timestamps.
+	relativeExptimeLimit = 60 * 60 * 24 * 30
+)
+
+// The errors of the cache read as the replies of the text protocol.
+var (
+	errNotStored  = errors.New("NOT_STORED")
+	errExists     = errors.New("EXISTS")
+	errNotFound   = errors.New("NOT_FOUND")
+	errTooLarge   = errors.New("SERVER_ERROR object too large for cache")
+	errNotNumeric = errors.New("CLIENT_ERROR cannot increment or decrement non-numeric value")
+)
+
+// Item is a value stored in a Cache.
+type Item struct {
+	Key   string
+	Flags uint32
+	Value []byte
+	CAS   uint64
+
+	expires time.Time
+	stored  time.Time
+}
+
+// Stats are the counters memcached reports through `stats`.
+type Stats struct {
+	CurrentItems int
+	TotalItems   int
+	Bytes        int64
+	Limit        int64
+	Evictions    int
+
+	Gets      int
+	Sets      int
+	Flushes   int
+	Touches   int
+	GetHits   int
+	GetMisses int
+
+	DeleteHits   int
+	DeleteMisses int
+	IncrHits     int
+	IncrMisses   int
+	DecrHits     int
+	DecrMisses   int
+	CASHits      int
+	CASMisses    int
+	CASBadValues int
+	TouchHits    int
+	TouchMisses  int
+}
+
+func NewCache(limit int64) *Cache {
+	return &Cache{
+		Now: time.Now,
+
+		limit: limit,
+		items: map[string]*list.Element{},
+		lru:   list.New(),
+	}
+}
+
+// Cache is the keyspace of a single tenant. It holds at most limit bytes,
+// evicting the least recently used items to make room for new ones.
+// Expired items are dropped when they are next looked at.
+type Cache struct {
+	Now func() time.Time
+
+	limit   int64
+	used    int64
+	items   map[string]*list.Element
+	lru     *list.List
+	cas     uint64
+	flushAt time.Time
+	stats   Stats
+	lock    sync.Mutex
+}
+
+// Get returns the item stored under key.
+func (c *Cache) Get(key string) (Item, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.stats.Gets++
+	item, found := c.lookup(key)
+	if !found {
+		c.stats.GetMisses++
+		return Item{}, false
+	}
+
+	c.stats.GetHits++
+	return *item, true
+}
+
+// Set stores the value under key.
+func (c *Cache) Set(key string, flags uint32, exptime int64, value []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.stats.Sets++
+	return c.store(key, flags, c.expiry(exptime), value)
+}
+
+// Add stores the value under key, unless there is one already.
+func (c *Cache) Add(key string, flags uint32, exptime int64, value []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.stats.Sets++
+	if _, found := c.lookup(key); found {
+		return errNotStored
+	}
+
+	return c.store(key, flags, c.expiry(exptime), value)
+}
+
+// Replace stores the value under key, only if there is one already.
+func (c *Cache) Replace(key string, flags uint32, exptime int64, value []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.stats.Sets++
+	if _, found := c.lookup(key); !found {
+		return errNotStored
+	}
+
+	return c.store(key, flags, c.expiry(exptime), value)
+}
+
+// Append adds the data after the value stored under key. The flags and the
+// expiration of the item stay as they are.
+func (c *Cache) Append(key string, data []byte) error {
+	return c.concatenate(key, func(value []byte) []byte {
+		return append(value, data...)
+	})
+}
+
+// Prepend adds the data before the value stored under key. The flags and
+// the expiration of the item stay as they are.
+func (c *Cache) Prepend(key string, data []byte) error {
+	return c.concatenate(key, func(value []byte) []byte {
+		return append(append([]byte{}, data...), value...)
+	})
+}
+
+// CompareAndSwap stores the value under key, only if nobody else stored one
+// since the caller read the item with the given CAS.
+func (c *Cache) CompareAndSwap(key string, flags uint32, exptime int64, value []byte, cas uint64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.stats.Sets++
+	item, found := c.lookup(key)
+	if !found {
+		c.stats.CASMisses++
+		return errNotFound
+	}
+
+	if item.CAS != cas {
+		c.stats.CASBadValues++
+		return errExists
+	}
+
+	c.stats.CASHits++
+	return c.store(key, flags, c.expiry(exptime), value)
+}
+
+// Delete removes the item stored under key.
+func (c *Cache) Delete(key string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, found := c.lookup(key); !found {
+		c.stats.DeleteMisses++
+		return errNotFound
+	}
+
+	c.stats.DeleteHits++
+	c.remove(c.items[key])
+	return nil
+}
+
+// Increment adds delta to the number stored under key, wrapping around at
+// 64 bits.
+func (c *Cache) Increment(key string, delta uint64) (uint64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	value, err := c.count(key, func(value uint64) uint64 {
+		return value + delta
+	})
+
+	if err == errNotFound {
+		c.stats.IncrMisses++
+	} else if err == nil {
+		c.stats.IncrHits++
+	}
+
+	return value, err
+}
+
+// Decrement subtracts delta from the number stored under key, stopping at
+// zero.
+func (c *Cache) Decrement(key string, delta uint64) (uint64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	value, err := c.count(key, func(value uint64) uint64 {
+		if delta > value {
+			return 0
+		}
+		return value - delta
+	})
+
+	if err == errNotFound {
+		c.stats.DecrMisses++
+	} else if err == nil {
+		c.stats.DecrHits++
+	}
+
+	return value, err
+}
+
+// Touch changes the expiration of the item stored under key.
+func (c *Cache) Touch(key string, exptime int64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.stats.Touches++
+	item, found := c.lookup(key)
+	if !found {
+		c.stats.TouchMisses++
+		return errNotFound
+	}
+
+	c.stats.TouchHits++
+	item.expires = c.expiry(exptime)
+	return nil
+}
+
+// Flush invalidates every item in the cache, after delay seconds.
+func (c *Cache) Flush(delay int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.stats.Flushes++
+	if delay > 0 {
+		c.flushAt = c.Now().Add(time.Duration(delay) * time.Second)
+		return
+	}
+
+	c.flushAt = time.Time{}
+	c.items = map[string]*list.Element{}
+	c.lru.Init()
+	c.used = 0
+}
+
+// Stats returns the counters of the cache.
+func (c *Cache) Stats() Stats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stats := c.stats
+	stats.CurrentItems = len(c.items)
+	stats.Bytes = c.used
+	stats.Limit = c.limit
+	return stats
+}
+
+// Limit returns how many bytes the cache holds at most.
+func (c *Cache) Limit() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.limit
+}
+
+// Resize changes how many bytes the cache holds at most. Nothing is
+// evicted for it: once the expired items are dropped, what is stored must
+// fit in the new limit, or the limit stays as it was.
+func (c *Cache) Resize(limit int64) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.used > limit {
+		now := c.Now()
+		for element := c.lru.Back(); element != nil; {
+			previous := element.Prev()
+			if c.stale(element.Value.(*Item), now) {
+				c.remove(element)
+			}
+			element = previous
+		}
+	}
+
+	if c.used > limit {
+		return false
+	}
+
+	c.limit = limit
+	return true
+}
+
+// lookup returns the item stored under key, dropping it when it's no longer
+// valid.
+func (c *Cache) lookup(key string) (*Item, bool) {
+	element, found := c.items[key]
+	if !found {
+		return nil, false
+	}
+
+	item := element.Value.(*Item)
+	if c.stale(item, c.Now()) {
+		c.remove(element)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(element)
+	return item, true
+}
+
+// stale tells whether the item expired or was flushed.
+func (c *Cache) stale(item *Item, now time.Time) bool {
+	expired := !item.expires.IsZero() && !now.Before(item.expires)
+	flushed := !c.flushAt.IsZero() && !now.Before(c.flushAt) && item.stored.Before(c.flushAt)
+	return expired || flushed
+}
+
+// store replaces whatever is stored under key, evicting items until the new
+// one fits.
+func (c *Cache) store(key string, flags uint32, expires time.Time, value []byte) error {
+	size := itemSize(key, value)
+	if size > c.limit {
+		return errTooLarge
+	}
+
+	if element, found := c.items[key]; found {
+		c.remove(element)
+	}
+
+	for c.used+size > c.limit {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+
+	c.cas++
+	item := &Item{
+		Key:     key,
+		Flags:   flags,
+		Value:   value,
+		CAS:     c.cas,
+		expires: expires,
+		stored:  c.Now(),
+	}
+
+	c.items[key] = c.lru.PushFront(item)
+	c.used += size
+	c.stats.TotalItems++
+	return nil
+}
+
+func (c *Cache) concatenate(key string, concatenate func(value []byte) []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.stats.Sets++
+	item, found := c.lookup(key)
+	if !found {
+		return errNotStored
+	}
+
+	value := concatenate(append([]byte{}, item.Value...))
+	return c.store(key, item.Flags, item.expires, value)
+}
+
+func (c *Cache) count(key string, count func(value uint64) uint64) (uint64, error) {
+	item, found := c.lookup(key)
+	if !found {
+		return 0, errNotFound
+	}
+
+	value, err := strconv.ParseUint(string(item.Value), 10, 64)
+	if err != nil {
+		return 0, errNotNumeric
+	}
+
+	value = count(value)
+	err = c.store(key, item.Flags, item.expires, []byte(strconv.FormatUint(value, 10)))
+	return value, err
+}
+
+func (c *Cache) expiry(exptime int64) time.Time {
+	return Expiry(exptime, c.Now())
+}
+
+func (c *Cache) remove(element *list.Element) {
+	item := c.lru.Remove(element).(*Item)
+	delete(c.items, item.Key)
+	c.used -= itemSize(item.Key, item.Value)
+}
+
+func itemSize(key string, value []byte) int64 {
+	return int64(len(key) + len(value) + itemOverhead)
+}
+
+// Expiry turns a memcached exptime into the time the item expires at. Zero
+// never expires, negative ones already have.
+func Expiry(exptime int64, now time.Time) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return now
+	case exptime <= relativeExptimeLimit:
+		return now.Add(time.Duration(exptime) * time.Second)
+	default:
+		return time.Unix(exptime, 0)
+	}
+}
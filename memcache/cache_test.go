@@ -0,0 +1,336 @@
+package memcache_test
+
+import (
+	"time"
+
+	"github.com/tscolari/memcached-broker/memcache"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cache", func() {
+	var cache *memcache.Cache
+	var now time.Time
+
+	BeforeEach(func() {
+		now = time.Unix(1500000000, 0)
+		cache = memcache.NewCache(1024)
+		cache.Now = func() time.Time { return now }
+	})
+
+	value := func(key string) string {
+		item, found := cache.Get(key)
+		Expect(found).To(BeTrue(), key)
+		return string(item.Value)
+	}
+
+	missing := func(key string) bool {
+		_, found := cache.Get(key)
+		return !found
+	}
+
+	Describe("Set", func() {
+		It("stores the value and its flags", func() {
+			Expect(cache.Set("key", 42, 0, []byte("value"))).To(Succeed())
+
+			item, found := cache.Get("key")
+			Expect(found).To(BeTrue())
+			Expect(item.Flags).To(Equal(uint32(42)))
+			Expect(string(item.Value)).To(Equal("value"))
+		})
+
+		It("gives every stored value a new CAS", func() {
+			Expect(cache.Set("key", 0, 0, []byte("1"))).To(Succeed())
+			first, _ := cache.Get("key")
+			Expect(cache.Set("key", 0, 0, []byte("2"))).To(Succeed())
+			second, _ := cache.Get("key")
+
+			Expect(second.CAS).ToNot(Equal(first.CAS))
+		})
+
+		Context("when the item is larger than the cache", func() {
+			It("fails", func() {
+				err := cache.Set("key", 0, 0, make([]byte, 1024))
+				Expect(err).To(MatchError("SERVER_ERROR object too large for cache"))
+			})
+		})
+	})
+
+	Describe("Add", func() {
+		It("stores a new key", func() {
+			Expect(cache.Add("key", 0, 0, []byte("value"))).To(Succeed())
+			Expect(value("key")).To(Equal("value"))
+		})
+
+		It("doesn't replace an existing key", func() {
+			Expect(cache.Set("key", 0, 0, []byte("old"))).To(Succeed())
+			Expect(cache.Add("key", 0, 0, []byte("new"))).To(MatchError("NOT_STORED"))
+			Expect(value("key")).To(Equal("old"))
+		})
+	})
+
+	Describe("Replace", func() {
+		It("replaces an existing key", func() {
+			Expect(cache.Set("key", 0, 0, []byte("old"))).To(Succeed())
+			Expect(cache.Replace("key", 0, 0, []byte("new"))).To(Succeed())
+			Expect(value("key")).To(Equal("new"))
+		})
+
+		It("doesn't store a new key", func() {
+			Expect(cache.Replace("key", 0, 0, []byte("new"))).To(MatchError("NOT_STORED"))
+			Expect(missing("key")).To(BeTrue())
+		})
+	})
+
+	Describe("Append and Prepend", func() {
+		BeforeEach(func() {
+			Expect(cache.Set("key", 7, 0, []byte("middle"))).To(Succeed())
+		})
+
+		It("add the data around the value, keeping the flags", func() {
+			Expect(cache.Append("key", []byte(">"))).To(Succeed())
+			Expect(cache.Prepend("key", []byte("<"))).To(Succeed())
+
+			item, _ := cache.Get("key")
+			Expect(string(item.Value)).To(Equal("<middle>"))
+			Expect(item.Flags).To(Equal(uint32(7)))
+		})
+
+		It("don't store a new key", func() {
+			Expect(cache.Append("other", []byte(">"))).To(MatchError("NOT_STORED"))
+			Expect(cache.Prepend("other", []byte("<"))).To(MatchError("NOT_STORED"))
+			Expect(missing("other")).To(BeTrue())
+		})
+	})
+
+	Describe("CompareAndSwap", func() {
+		var cas uint64
+
+		BeforeEach(func() {
+			Expect(cache.Set("key", 0, 0, []byte("old"))).To(Succeed())
+			item, _ := cache.Get("key")
+			cas = item.CAS
+		})
+
+		It("stores the value when the CAS matches", func() {
+			Expect(cache.CompareAndSwap("key", 0, 0, []byte("new"), cas)).To(Succeed())
+			Expect(value("key")).To(Equal("new"))
+		})
+
+		It("doesn't store the value when the item changed since", func() {
+			Expect(cache.Set("key", 0, 0, []byte("other"))).To(Succeed())
+			Expect(cache.CompareAndSwap("key", 0, 0, []byte("new"), cas)).To(MatchError("EXISTS"))
+			Expect(value("key")).To(Equal("other"))
+		})
+
+		It("doesn't store a new key", func() {
+			Expect(cache.CompareAndSwap("other", 0, 0, []byte("new"), cas)).To(MatchError("NOT_FOUND"))
+		})
+	})
+
+	Describe("Delete", func() {
+		It("removes the key", func() {
+			Expect(cache.Set("key", 0, 0, []byte("value"))).To(Succeed())
+			Expect(cache.Delete("key")).To(Succeed())
+			Expect(missing("key")).To(BeTrue())
+			Expect(cache.Stats().Bytes).To(BeZero())
+		})
+
+		Context("when the key doesn't exist", func() {
+			It("fails", func() {
+				Expect(cache.Delete("key")).To(MatchError("NOT_FOUND"))
+			})
+		})
+	})
+
+	Describe("Increment and Decrement", func() {
+		It("count the number stored under the key", func() {
+			Expect(cache.Set("counter", 0, 0, []byte("10"))).To(Succeed())
+
+			count, err := cache.Increment("counter", 5)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(count).To(Equal(uint64(15)))
+
+			count, err = cache.Decrement("counter", 3)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(count).To(Equal(uint64(12)))
+
+			Expect(value("counter")).To(Equal("12"))
+		})
+
+		It("wrap around at 64 bits when incrementing", func() {
+			Expect(cache.Set("counter", 0, 0, []byte("18446744073709551615"))).To(Succeed())
+
+			count, err := cache.Increment("counter", 2)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(count).To(Equal(uint64(1)))
+		})
+
+		It("stop at zero when decrementing", func() {
+			Expect(cache.Set("counter", 0, 0, []byte("2"))).To(Succeed())
+
+			count, err := cache.Decrement("counter", 5)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(count).To(BeZero())
+		})
+
+		Context("when the value isn't a number", func() {
+			It("fails", func() {
+				Expect(cache.Set("counter", 0, 0, []byte("ten"))).To(Succeed())
+
+				_, err := cache.Increment("counter", 1)
+				Expect(err).To(MatchError("CLIENT_ERROR cannot increment or decrement non-numeric value"))
+			})
+		})
+
+		Context("when the key doesn't exist", func() {
+			It("fails", func() {
+				_, err := cache.Decrement("counter", 1)
+				Expect(err).To(MatchError("NOT_FOUND"))
+			})
+		})
+	})
+
+	Describe("expiration", func() {
+		It("drops items after their exptime in seconds", func() {
+			Expect(cache.Set("key", 0, 10, []byte("value"))).To(Succeed())
+
+			now = now.Add(9 * time.Second)
+			Expect(missing("key")).To(BeFalse())
+
+			now = now.Add(time.Second)
+			Expect(missing("key")).To(BeTrue())
+		})
+
+		It("reads large exptimes as unix timestamps", func() {
+			Expect(cache.Set("key", 0, now.Unix()+60*60*24*60, []byte("value"))).To(Succeed())
+
+			now = now.Add(59 * 24 * time.Hour)
+			Expect(missing("key")).To(BeFalse())
+
+			now = now.Add(24 * time.Hour)
+			Expect(missing("key")).To(BeTrue())
+		})
+
+		It("expires items with a negative exptime right away", func() {
+			Expect(cache.Set("key", 0, -1, []byte("value"))).To(Succeed())
+			Expect(missing("key")).To(BeTrue())
+		})
+
+		It("can be changed with Touch", func() {
+			Expect(cache.Set("key", 0, 10, []byte("value"))).To(Succeed())
+			Expect(cache.Touch("key", 0)).To(Succeed())
+
+			now = now.Add(time.Hour)
+			Expect(missing("key")).To(BeFalse())
+			Expect(cache.Touch("other", 0)).To(MatchError("NOT_FOUND"))
+		})
+	})
+
+	Describe("Flush", func() {
+		BeforeEach(func() {
+			Expect(cache.Set("key-1", 0, 0, []byte("value"))).To(Succeed())
+			Expect(cache.Set("key-2", 0, 0, []byte("value"))).To(Succeed())
+		})
+
+		It("drops every item", func() {
+			cache.Flush(0)
+
+			Expect(missing("key-1")).To(BeTrue())
+			Expect(missing("key-2")).To(BeTrue())
+			Expect(cache.Stats().Bytes).To(BeZero())
+		})
+
+		Context("with a delay", func() {
+			It("drops the items stored before the delay is over", func() {
+				cache.Flush(10)
+				Expect(missing("key-1")).To(BeFalse())
+
+				now = now.Add(5 * time.Second)
+				Expect(cache.Set("key-2", 0, 0, []byte("value"))).To(Succeed())
+
+				now = now.Add(5 * time.Second)
+				Expect(cache.Set("key-3", 0, 0, []byte("value"))).To(Succeed())
+				Expect(missing("key-1")).To(BeTrue())
+				Expect(missing("key-2")).To(BeTrue())
+				Expect(missing("key-3")).To(BeFalse())
+			})
+		})
+	})
+
+	Describe("eviction", func() {
+		BeforeEach(func() {
+			// Every item with a single letter key and value takes 50 bytes.
+			cache = memcache.NewCache(150)
+			Expect(cache.Set("a", 0, 0, []byte("1"))).To(Succeed())
+			Expect(cache.Set("b", 0, 0, []byte("2"))).To(Succeed())
+			Expect(cache.Set("c", 0, 0, []byte("3"))).To(Succeed())
+		})
+
+		It("drops the least recently used items to make room", func() {
+			Expect(missing("a")).To(BeFalse())
+			Expect(cache.Set("d", 0, 0, []byte("4"))).To(Succeed())
+
+			Expect(missing("b")).To(BeTrue())
+			Expect(missing("a")).To(BeFalse())
+			Expect(missing("c")).To(BeFalse())
+			Expect(missing("d")).To(BeFalse())
+		})
+
+		It("never goes over the limit", func() {
+			Expect(cache.Set("d", 0, 0, make([]byte, 50))).To(Succeed())
+
+			stats := cache.Stats()
+			Expect(stats.Bytes).To(Equal(int64(149)))
+			Expect(stats.CurrentItems).To(Equal(2))
+			Expect(stats.Evictions).To(Equal(2))
+		})
+	})
+
+	Describe("Resize", func() {
+		BeforeEach(func() {
+			// Every item with a single letter key and value takes 50 bytes.
+			Expect(cache.Set("a", 0, 0, []byte("1"))).To(Succeed())
+			Expect(cache.Set("b", 0, 10, []byte("2"))).To(Succeed())
+		})
+
+		It("changes the limit, keeping the items", func() {
+			Expect(cache.Resize(100)).To(BeTrue())
+			Expect(cache.Limit()).To(Equal(int64(100)))
+			Expect(value("a")).To(Equal("1"))
+			Expect(value("b")).To(Equal("2"))
+		})
+
+		Context("when the items don't fit in the new limit", func() {
+			It("keeps the limit and the items", func() {
+				Expect(cache.Resize(99)).To(BeFalse())
+				Expect(cache.Limit()).To(Equal(int64(1024)))
+				Expect(value("a")).To(Equal("1"))
+				Expect(value("b")).To(Equal("2"))
+			})
+
+			It("doesn't count the expired ones", func() {
+				now = now.Add(10 * time.Second)
+				Expect(cache.Resize(50)).To(BeTrue())
+				Expect(value("a")).To(Equal("1"))
+			})
+		})
+	})
+
+	Describe("Stats", func() {
+		It("counts the hits and misses", func() {
+			Expect(cache.Set("key", 0, 0, []byte("value"))).To(Succeed())
+			cache.Get("key")
+			cache.Get("other")
+
+			stats := cache.Stats()
+			Expect(stats.Sets).To(Equal(1))
+			Expect(stats.Gets).To(Equal(2))
+			Expect(stats.GetHits).To(Equal(1))
+			Expect(stats.GetMisses).To(Equal(1))
+			Expect(stats.TotalItems).To(Equal(1))
+			Expect(stats.Limit).To(Equal(int64(1024)))
+		})
+	})
+})
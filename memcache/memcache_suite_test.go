@@ -0,0 +1,13 @@
+package memcache_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestMemcache(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Memcache Suite")
+}
@@ -0,0 +1,403 @@
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// maxItemSize is the largest value memcached stores by default, like with
+// `-I 1m`.
+const maxItemSize = 1024 * 1024
+
+var (
+	errBadFormat       = errors.New("CLIENT_ERROR bad command line format")
+	errBadDataChunk    = errors.New("CLIENT_ERROR bad data chunk")
+	errBadDelta        = errors.New("CLIENT_ERROR invalid numeric delta argument")
+	errLineTooLong     = errors.New("CLIENT_ERROR line too long")
+	errUnauthenticated = errors.New("CLIENT_ERROR unauthenticated")
+	errAuthentication  = errors.New("CLIENT_ERROR authentication failure")
+	errUnknownCommand  = errors.New("ERROR")
+)
+
+// session speaks the memcached text protocol on a single connection.
+type session struct {
+	reader *bufio.Reader
+	writer *bufio.Writer
+	cache  *Cache
+	stats  func() []string
+
+	// authenticate is nil when clients don't have to authenticate.
+	authenticate  func(username, password string) bool
+	authenticated bool
+
+	// err stops the session, once reading or writing failed.
+	err error
+}
+
+// storageCommand is a parsed storage command, with its data block.
+type storageCommand struct {
+	key     string
+	flags   uint32
+	exptime int64
+	cas     uint64
+	value   []byte
+	noreply bool
+}
+
+func newSession(connection net.Conn, cache *Cache) *session {
+	return &session{
+		reader: bufio.NewReader(connection),
+		writer: bufio.NewWriter(connection),
+		cache:  cache,
+	}
+}
+
+func (s *session) run() {
+	for s.err == nil {
+		line, err := s.reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			s.reply(false, errLineTooLong.Error())
+			s.writer.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		quit := s.handle(strings.Fields(string(line)))
+
+		// Pipelined commands get their replies in one write.
+		if quit || s.reader.Buffered() == 0 {
+			if err := s.writer.Flush(); err != nil {
+				return
+			}
+		}
+
+		if quit {
+			return
+		}
+	}
+}
+
+// handle runs a command, and tells whether the client asked to quit.
+func (s *session) handle(fields []string) bool {
+	if len(fields) == 0 {
+		s.reply(false, errUnknownCommand.Error())
+		return false
+	}
+
+	command, arguments := fields[0], fields[1:]
+
+	if s.authenticate != nil && !s.authenticated {
+		if command != "set" {
+			s.reply(false, errUnauthenticated.Error())
+			return false
+		}
+
+		s.login(arguments)
+		return false
+	}
+
+	switch command {
+	case "get":
+		s.get(arguments, false)
+	case "gets":
+		s.get(arguments, true)
+	case "set", "add", "replace", "append", "prepend", "cas":
+		s.store(command, arguments)
+	case "delete":
+		s.delete(arguments)
+	case "incr", "decr":
+		s.count(command, arguments)
+	case "touch":
+		s.touch(arguments)
+	case "flush_all":
+		s.flush(arguments)
+	case "stats":
+		s.statistics(arguments)
+	case "version":
+		s.reply(false, "VERSION "+Version)
+	case "verbosity":
+		_, noreply := stripNoreply(arguments)
+		s.reply(noreply, "OK")
+	case "quit":
+		return true
+	default:
+		s.reply(false, errUnknownCommand.Error())
+	}
+
+	return false
+}
+
+// login reads the credentials of the client from the data of a `set`.
+func (s *session) login(arguments []string) {
+	command, err := s.readStorage(arguments, false)
+	if err != nil {
+		s.reply(false, err.Error())
+		return
+	}
+
+	credentials := strings.SplitN(string(command.value), " ", 2)
+	if len(credentials) != 2 || !s.authenticate(credentials[0], credentials[1]) {
+		s.reply(false, errAuthentication.Error())
+		return
+	}
+
+	s.authenticated = true
+	s.reply(false, "STORED")
+}
+
+func (s *session) get(keys []string, withCAS bool) {
+	if len(keys) == 0 {
+		s.reply(false, errUnknownCommand.Error())
+		return
+	}
+
+	for _, key := range keys {
+		if !validKey(key) {
+			s.reply(false, errBadFormat.Error())
+			return
+		}
+	}
+
+	for _, key := range keys {
+		item, found := s.cache.Get(key)
+		if !found {
+			continue
+		}
+
+		if withCAS {
+			fmt.Fprintf(s.writer, "VALUE %s %d %d %d\r\n", item.Key, item.Flags, len(item.Value), item.CAS)
+		} else {
+			fmt.Fprintf(s.writer, "VALUE %s %d %d\r\n", item.Key, item.Flags, len(item.Value))
+		}
+		s.writer.Write(item.Value)
+		s.writer.WriteString("\r\n")
+	}
+
+	s.reply(false, "END")
+}
+
+func (s *session) store(name string, arguments []string) {
+	command, err := s.readStorage(arguments, name == "cas")
+	if err != nil {
+		s.reply(command.noreply, err.Error())
+		return
+	}
+
+	switch name {
+	case "set":
+		err = s.cache.Set(command.key, command.flags, command.exptime, command.value)
+	case "add":
+		err = s.cache.Add(command.key, command.flags, command.exptime, command.value)
+	case "replace":
+		err = s.cache.Replace(command.key, command.flags, command.exptime, command.value)
+	case "append":
+		err = s.cache.Append(command.key, command.value)
+	case "prepend":
+		err = s.cache.Prepend(command.key, command.value)
+	case "cas":
+		err = s.cache.CompareAndSwap(command.key, command.flags, command.exptime, command.value, command.cas)
+	}
+
+	s.result(command.noreply, err, "STORED")
+}
+
+func (s *session) delete(arguments []string) {
+	arguments, noreply := stripNoreply(arguments)
+
+	// Old clients send a hold time, memcached only accepts zero.
+	if len(arguments) == 2 && arguments[1] == "0" {
+		arguments = arguments[:1]
+	}
+
+	if len(arguments) != 1 || !validKey(arguments[0]) {
+		s.reply(noreply, errBadFormat.Error())
+		return
+	}
+
+	s.result(noreply, s.cache.Delete(arguments[0]), "DELETED")
+}
+
+func (s *session) count(command string, arguments []string) {
+	arguments, noreply := stripNoreply(arguments)
+	if len(arguments) != 2 || !validKey(arguments[0]) {
+		s.reply(noreply, errBadFormat.Error())
+		return
+	}
+
+	delta, err := strconv.ParseUint(arguments[1], 10, 64)
+	if err != nil {
+		s.reply(noreply, errBadDelta.Error())
+		return
+	}
+
+	var value uint64
+	if command == "incr" {
+		value, err = s.cache.Increment(arguments[0], delta)
+	} else {
+		value, err = s.cache.Decrement(arguments[0], delta)
+	}
+
+	s.result(noreply, err, strconv.FormatUint(value, 10))
+}
+
+func (s *session) touch(arguments []string) {
+	arguments, noreply := stripNoreply(arguments)
+	if len(arguments) != 2 || !validKey(arguments[0]) {
+		s.reply(noreply, errBadFormat.Error())
+		return
+	}
+
+	exptime, err := strconv.ParseInt(arguments[1], 10, 64)
+	if err != nil {
+		s.reply(noreply, errBadFormat.Error())
+		return
+	}
+
+	s.result(noreply, s.cache.Touch(arguments[0], exptime), "TOUCHED")
+}
+
+func (s *session) flush(arguments []string) {
+	arguments, noreply := stripNoreply(arguments)
+
+	var delay int64
+	if len(arguments) > 1 {
+		s.reply(noreply, errBadFormat.Error())
+		return
+	}
+
+	if len(arguments) == 1 {
+		var err error
+		delay, err = strconv.ParseInt(arguments[0], 10, 64)
+		if err != nil {
+			s.reply(noreply, errBadFormat.Error())
+			return
+		}
+	}
+
+	s.cache.Flush(delay)
+	s.reply(noreply, "OK")
+}
+
+func (s *session) statistics(arguments []string) {
+	// Only the general statistics are kept.
+	if len(arguments) != 0 {
+		s.reply(false, errUnknownCommand.Error())
+		return
+	}
+
+	if s.stats != nil {
+		for _, line := range s.stats() {
+			s.reply(false, line)
+		}
+	}
+
+	s.reply(false, "END")
+}
+
+// readStorage parses a storage command and reads its data block. When the
+// data doesn't fit the command, or is larger than an item can be, it's
+// skipped so the next command can be read, without buffering it.
+func (s *session) readStorage(arguments []string, withCAS bool) (storageCommand, error) {
+	var command storageCommand
+	arguments, command.noreply = stripNoreply(arguments)
+
+	expected := 4
+	if withCAS {
+		expected = 5
+	}
+
+	if len(arguments) != expected {
+		return command, errBadFormat
+	}
+
+	length, err := strconv.Atoi(arguments[3])
+	if err != nil || length < 0 {
+		return command, errBadFormat
+	}
+
+	command.key = arguments[0]
+	flags, flagsErr := strconv.ParseUint(arguments[1], 10, 32)
+	exptime, exptimeErr := strconv.ParseInt(arguments[2], 10, 64)
+
+	var casErr error
+	if withCAS {
+		command.cas, casErr = strconv.ParseUint(arguments[4], 10, 64)
+	}
+
+	if !validKey(command.key) || flagsErr != nil || exptimeErr != nil || casErr != nil {
+		s.skip(length + 2)
+		return command, errBadFormat
+	}
+
+	if length > maxItemSize || itemSize(command.key, nil)+int64(length) > s.cache.Limit() {
+		s.skip(length + 2)
+		return command, errTooLarge
+	}
+
+	command.flags = uint32(flags)
+	command.exptime = exptime
+
+	data := make([]byte, length+2)
+	_, err = io.ReadFull(s.reader, data)
+	if err != nil {
+		s.err = err
+		return command, err
+	}
+
+	if !bytes.HasSuffix(data, []byte("\r\n")) {
+		return command, errBadDataChunk
+	}
+
+	command.value = data[:length]
+	return command, nil
+}
+
+func (s *session) skip(length int) {
+	_, err := io.CopyN(ioutil.Discard, s.reader, int64(length))
+	if err != nil {
+		s.err = err
+	}
+}
+
+// result replies with the error, or with success when there is none. The
+// errors of the cache read as the replies of the protocol.
+func (s *session) result(noreply bool, err error, success string) {
+	if err != nil {
+		s.reply(noreply, err.Error())
+		return
+	}
+
+	s.reply(noreply, success)
+}
+
+func (s *session) reply(noreply bool, line string) {
+	if noreply || s.err != nil {
+		return
+	}
+
+	_, err := s.writer.WriteString(line + "\r\n")
+	if err != nil {
+		s.err = err
+	}
+}
+
+func stripNoreply(arguments []string) ([]string, bool) {
+	if last := len(arguments) - 1; last >= 0 && arguments[last] == "noreply" {
+		return arguments[:last], true
+	}
+
+	return arguments, false
+}
+
+func validKey(key string) bool {
+	return len(key) > 0 && len(key) <= MaxKeyLength
+}
@@ -0,0 +1,305 @@
+package memcache
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tscolari/cf-broker-api/common/repository"
+	"github.com/tscolari/memcached-broker/runner"
+)
+
+// Version is the memcached release whose text protocol the server speaks.
+const Version = "1.4.25"
+
+// Users returns the users of an instance and their passwords.
+type Users func(instanceID string) (map[string]string, error)
+
+func New(memory map[string]int, users Users) *Server {
+	return &Server{
+		memory:  memory,
+		users:   users,
+		tenants: map[string]*tenant{},
+	}
+}
+
+// Server serves the instances from inside the broker, instead of running a
+// memcached process for each of them. Every instance gets its own listener
+// on its host and port, and its own Cache holding as many megabytes as the
+// size of its plan.
+//
+// When users is set, clients authenticate the way memcached does with `-Y`:
+// their first command is a `set` of "username password" for any key.
+// Disconnect drops the connections of a user once it's revoked.
+//
+// Nothing is persisted, the instances start empty whenever the broker does.
+type Server struct {
+	memory  map[string]int
+	users   Users
+	tenants map[string]*tenant
+	lock    sync.Mutex
+}
+
+var _ runner.Runner = &Server{}
+
+type tenant struct {
+	instance    repository.Instance
+	cache       *Cache
+	listener    net.Listener
+	started     time.Time
+	connections map[net.Conn]string
+	total       int
+	stopped     bool
+	done        sync.WaitGroup
+	lock        sync.Mutex
+}
+
+// Start serves the instance, unless it's served already.
+func (s *Server) Start(instance repository.Instance) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, running := s.tenants[instance.ID]; running {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(instance.Host, instance.Port))
+	if err != nil {
+		return fmt.Errorf("Failed to start memcached for %s: %s", instance.ID, err.Error())
+	}
+
+	t := &tenant{
+		instance:    instance,
+		cache:       NewCache(s.limit(instance.PlanID)),
+		listener:    listener,
+		started:     time.Now(),
+		connections: map[net.Conn]string{},
+	}
+
+	s.tenants[instance.ID] = t
+	t.done.Add(1)
+	go s.accept(t)
+	return nil
+}
+
+// Resize gives the cache of the instance the memory of its plan, keeping
+// its items. It fails with runner.ErrOverflow when they don't fit in the new
+// limit. An instance that isn't served yet is started.
+func (s *Server) Resize(instance repository.Instance) error {
+	s.lock.Lock()
+	t, running := s.tenants[instance.ID]
+	s.lock.Unlock()
+
+	if !running {
+		return s.Start(instance)
+	}
+
+	if !t.cache.Resize(s.limit(instance.PlanID)) {
+		return runner.ErrOverflow
+	}
+
+	return nil
+}
+
+// Recover serves each of the instances.
+func (s *Server) Recover(instances []repository.Instance) error {
+	for _, instance := range instances {
+		if err := s.Start(instance); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Stop closes the listener and the connections of the instance, and drops
+// its data.
+func (s *Server) Stop(instanceID string) error {
+	s.lock.Lock()
+	t, running := s.tenants[instanceID]
+	delete(s.tenants, instanceID)
+	s.lock.Unlock()
+
+	if !running {
+		return nil
+	}
+
+	err := t.listener.Close()
+
+	t.lock.Lock()
+	t.stopped = true
+	for connection := range t.connections {
+		connection.Close()
+	}
+	t.lock.Unlock()
+
+	t.done.Wait()
+	return err
+}
+
+// Reload does nothing, the users are read on every authentication.
+func (s *Server) Reload(instanceID string) error {
+	return nil
+}
+
+// Disconnect closes the connections that authenticated as the user on the
+// instance.
+func (s *Server) Disconnect(instanceID, username string) error {
+	s.lock.Lock()
+	t, running := s.tenants[instanceID]
+	s.lock.Unlock()
+
+	if !running {
+		return nil
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for connection, connectionUsername := range t.connections {
+		if connectionUsername == username {
+			connection.Close()
+		}
+	}
+
+	return nil
+}
+
+// Address returns where the instance is served.
+func (s *Server) Address(instanceID string) (net.Addr, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	t, running := s.tenants[instanceID]
+	if !running {
+		return nil, false
+	}
+
+	return t.listener.Addr(), true
+}
+
+func (s *Server) limit(planID string) int64 {
+	memory, exists := s.memory[planID]
+	if !exists || memory <= 0 {
+		memory = runner.DefaultMemory
+	}
+
+	return int64(memory) * 1024 * 1024
+}
+
+func (s *Server) accept(t *tenant) {
+	defer t.done.Done()
+
+	for {
+		connection, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		t.lock.Lock()
+		if t.stopped {
+			t.lock.Unlock()
+			connection.Close()
+			return
+		}
+		t.connections[connection] = ""
+		t.total++
+		t.lock.Unlock()
+
+		t.done.Add(1)
+		go func() {
+			defer t.done.Done()
+			s.serve(t, connection)
+
+			t.lock.Lock()
+			delete(t.connections, connection)
+			t.lock.Unlock()
+			connection.Close()
+		}()
+	}
+}
+
+func (s *Server) serve(t *tenant, connection net.Conn) {
+	session := newSession(connection, t.cache)
+	session.stats = t.stats
+	if s.users != nil {
+		session.authenticate = func(username, password string) bool {
+			// Checking the users and recording the user of the connection
+			// in one step, a Disconnect can't run in between and miss it.
+			t.lock.Lock()
+			defer t.lock.Unlock()
+
+			if !s.authenticate(t.instance.ID, username, password) {
+				return false
+			}
+
+			t.connections[connection] = username
+			return true
+		}
+	}
+
+	session.run()
+}
+
+func (s *Server) authenticate(instanceID, username, password string) bool {
+	users, err := s.users(instanceID)
+	if err != nil {
+		return false
+	}
+
+	expected, exists := users[username]
+	if !exists {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
+
+// stats are the lines of the reply to `stats`.
+func (t *tenant) stats() []string {
+	t.lock.Lock()
+	current, total := len(t.connections), t.total
+	t.lock.Unlock()
+
+	stats := t.cache.Stats()
+	now := time.Now()
+
+	lines := []string{}
+	add := func(name string, value interface{}) {
+		lines = append(lines, fmt.Sprintf("STAT %s %v", name, value))
+	}
+
+	add("pid", os.Getpid())
+	add("uptime", int64(now.Sub(t.started)/time.Second))
+	add("time", now.Unix())
+	add("version", Version)
+	add("curr_connections", current)
+	add("total_connections", total)
+	add("cmd_get", stats.Gets)
+	add("cmd_set", stats.Sets)
+	add("cmd_flush", stats.Flushes)
+	add("cmd_touch", stats.Touches)
+	add("get_hits", stats.GetHits)
+	add("get_misses", stats.GetMisses)
+	add("delete_misses", stats.DeleteMisses)
+	add("delete_hits", stats.DeleteHits)
+	add("incr_misses", stats.IncrMisses)
+	add("incr_hits", stats.IncrHits)
+	add("decr_misses", stats.DecrMisses)
+	add("decr_hits", stats.DecrHits)
+	add("cas_misses", stats.CASMisses)
+	add("cas_hits", stats.CASHits)
+	add("cas_badval", stats.CASBadValues)
+	add("touch_hits", stats.TouchHits)
+	add("touch_misses", stats.TouchMisses)
+	add("limit_maxbytes", stats.Limit)
+	add("bytes", stats.Bytes)
+	add("curr_items", stats.CurrentItems)
+	add("total_items", stats.TotalItems)
+	add("evictions", stats.Evictions)
+
+	return lines
+}
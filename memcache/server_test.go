@@ -0,0 +1,413 @@
+package memcache_test
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/tscolari/cf-broker-api/common/repository"
+	"github.com/tscolari/memcached-broker/memcache"
+	"github.com/tscolari/memcached-broker/runner"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type client struct {
+	connection net.Conn
+	reader     *bufio.Reader
+}
+
+func (c *client) send(command string) {
+	c.connection.SetWriteDeadline(time.Now().Add(time.Second))
+	_, err := fmt.Fprint(c.connection, command)
+	Expect(err).ToNot(HaveOccurred())
+}
+
+func (c *client) line() string {
+	c.connection.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := c.reader.ReadString('\n')
+	Expect(err).ToNot(HaveOccurred())
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+// call sends the command and reads the reply, up to its last line.
+func (c *client) call(command string, last string) []string {
+	c.send(command)
+
+	lines := []string{}
+	for {
+		line := c.line()
+		lines = append(lines, line)
+		if line == last {
+			return lines
+		}
+	}
+}
+
+var _ = Describe("Server", func() {
+	var server *memcache.Server
+	var users memcache.Users
+	var instance repository.Instance
+
+	connect := func(instanceID string) *client {
+		address, running := server.Address(instanceID)
+		Expect(running).To(BeTrue())
+
+		connection, err := net.Dial("tcp", address.String())
+		Expect(err).ToNot(HaveOccurred())
+		return &client{connection: connection, reader: bufio.NewReader(connection)}
+	}
+
+	BeforeEach(func() {
+		users = nil
+		instance = repository.Instance{
+			ID:     "instance-1",
+			PlanID: "plan-1",
+			Host:   "127.0.0.1",
+			Port:   "0",
+		}
+	})
+
+	JustBeforeEach(func() {
+		server = memcache.New(map[string]int{"plan-1": 1, "plan-64": 64}, users)
+		Expect(server.Start(instance)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(server.Stop("instance-1")).To(Succeed())
+		Expect(server.Stop("instance-2")).To(Succeed())
+	})
+
+	Describe("the text protocol", func() {
+		var memcached *client
+
+		JustBeforeEach(func() {
+			memcached = connect("instance-1")
+		})
+
+		It("stores and retrieves values", func() {
+			Expect(memcached.call("set key 5 0 5\r\nvalue\r\n", "STORED")).To(Equal([]string{"STORED"}))
+			Expect(memcached.call("get key other\r\n", "END")).To(Equal([]string{"VALUE key 5 5", "value", "END"}))
+		})
+
+		It("supports the other storage commands", func() {
+			memcached.send("add key 0 0 1\r\nb\r\n")
+			Expect(memcached.line()).To(Equal("STORED"))
+			memcached.send("add key 0 0 1\r\nx\r\n")
+			Expect(memcached.line()).To(Equal("NOT_STORED"))
+			memcached.send("append key 0 0 1\r\nc\r\n")
+			Expect(memcached.line()).To(Equal("STORED"))
+			memcached.send("prepend key 0 0 1\r\na\r\n")
+			Expect(memcached.line()).To(Equal("STORED"))
+			memcached.send("replace other 0 0 1\r\nx\r\n")
+			Expect(memcached.line()).To(Equal("NOT_STORED"))
+
+			Expect(memcached.call("get key\r\n", "END")).To(Equal([]string{"VALUE key 0 3", "abc", "END"}))
+		})
+
+		It("supports compare and swap", func() {
+			memcached.call("set key 0 0 3\r\nold\r\n", "STORED")
+			reply := memcached.call("gets key\r\n", "END")
+
+			var cas uint64
+			_, err := fmt.Sscanf(reply[0], "VALUE key 0 3 %d", &cas)
+			Expect(err).ToNot(HaveOccurred())
+
+			memcached.send(fmt.Sprintf("cas key 0 0 3 %d\r\nnew\r\n", cas))
+			Expect(memcached.line()).To(Equal("STORED"))
+			memcached.send(fmt.Sprintf("cas key 0 0 3 %d\r\nnew\r\n", cas))
+			Expect(memcached.line()).To(Equal("EXISTS"))
+			memcached.send("cas other 0 0 3 1\r\nnew\r\n")
+			Expect(memcached.line()).To(Equal("NOT_FOUND"))
+		})
+
+		It("supports delete, incr, decr and touch", func() {
+			memcached.call("set counter 0 0 2\r\n10\r\n", "STORED")
+
+			memcached.send("incr counter 5\r\n")
+			Expect(memcached.line()).To(Equal("15"))
+			memcached.send("decr counter 20\r\n")
+			Expect(memcached.line()).To(Equal("0"))
+			memcached.send("touch counter 100\r\n")
+			Expect(memcached.line()).To(Equal("TOUCHED"))
+			memcached.send("delete counter\r\n")
+			Expect(memcached.line()).To(Equal("DELETED"))
+			memcached.send("delete counter\r\n")
+			Expect(memcached.line()).To(Equal("NOT_FOUND"))
+			memcached.send("incr counter 1\r\n")
+			Expect(memcached.line()).To(Equal("NOT_FOUND"))
+		})
+
+		It("doesn't reply to noreply commands", func() {
+			memcached.send("set key 0 0 5 noreply\r\nvalue\r\n")
+			memcached.send("append key 0 0 1 noreply\r\n!\r\n")
+			Expect(memcached.call("get key\r\n", "END")).To(Equal([]string{"VALUE key 0 6", "value!", "END"}))
+		})
+
+		It("answers pipelined commands in order", func() {
+			memcached.send("set a 0 0 1\r\n1\r\nset b 0 0 1\r\n2\r\nget a b\r\n")
+			Expect(memcached.line()).To(Equal("STORED"))
+			Expect(memcached.line()).To(Equal("STORED"))
+			Expect(memcached.call("", "END")).To(Equal([]string{"VALUE a 0 1", "1", "VALUE b 0 1", "2", "END"}))
+		})
+
+		It("flushes the instance", func() {
+			memcached.call("set key 0 0 5\r\nvalue\r\n", "STORED")
+			memcached.send("flush_all\r\n")
+			Expect(memcached.line()).To(Equal("OK"))
+			Expect(memcached.call("get key\r\n", "END")).To(Equal([]string{"END"}))
+		})
+
+		It("reports the statistics of the instance", func() {
+			memcached.call("set key 0 0 5\r\nvalue\r\n", "STORED")
+
+			stats := memcached.call("stats\r\n", "END")
+			Expect(stats).To(ContainElement("STAT limit_maxbytes 1048576"))
+			Expect(stats).To(ContainElement("STAT curr_items 1"))
+			Expect(stats).To(ContainElement("STAT cmd_set 1"))
+			Expect(stats).To(ContainElement("STAT curr_connections 1"))
+		})
+
+		It("reports its version", func() {
+			memcached.send("version\r\n")
+			Expect(memcached.line()).To(Equal("VERSION " + memcache.Version))
+		})
+
+		Context("when the command is unknown", func() {
+			It("replies with an error", func() {
+				memcached.send("bogus\r\n")
+				Expect(memcached.line()).To(Equal("ERROR"))
+			})
+		})
+
+		Context("when the command line is malformed", func() {
+			It("replies with an error and keeps reading", func() {
+				memcached.send("set key 0 zero 5\r\nvalue\r\n")
+				Expect(memcached.line()).To(Equal("CLIENT_ERROR bad command line format"))
+
+				memcached.send(fmt.Sprintf("get %s\r\n", strings.Repeat("k", 251)))
+				Expect(memcached.line()).To(Equal("CLIENT_ERROR bad command line format"))
+
+				memcached.send("incr key one\r\n")
+				Expect(memcached.line()).To(Equal("CLIENT_ERROR invalid numeric delta argument"))
+
+				Expect(memcached.call("get key\r\n", "END")).To(Equal([]string{"END"}))
+			})
+		})
+
+		Context("when the data doesn't match its length", func() {
+			It("replies with an error", func() {
+				memcached.send("set key 0 0 2\r\nvalue\r\n")
+				Expect(memcached.line()).To(Equal("CLIENT_ERROR bad data chunk"))
+			})
+		})
+
+		Context("when the item doesn't fit the instance", func() {
+			It("skips the data", func() {
+				memcached.send(fmt.Sprintf("set key 0 0 1048576\r\n%s\r\n", strings.Repeat("v", 1048576)))
+				Expect(memcached.line()).To(Equal("SERVER_ERROR object too large for cache"))
+				Expect(memcached.call("get key\r\n", "END")).To(Equal([]string{"END"}))
+			})
+		})
+
+		Context("when the item is larger than memcached allows", func() {
+			BeforeEach(func() {
+				instance.PlanID = "plan-64"
+			})
+
+			It("skips the data", func() {
+				memcached.send(fmt.Sprintf("set key 0 0 1048577\r\n%s\r\n", strings.Repeat("v", 1048577)))
+				Expect(memcached.line()).To(Equal("SERVER_ERROR object too large for cache"))
+				Expect(memcached.call("get key\r\n", "END")).To(Equal([]string{"END"}))
+
+				memcached.send(fmt.Sprintf("set key 0 0 1048576\r\n%s\r\n", strings.Repeat("v", 1048576)))
+				Expect(memcached.line()).To(Equal("STORED"))
+			})
+		})
+
+		Context("when the client quits", func() {
+			It("closes the connection", func() {
+				memcached.send("quit\r\n")
+
+				memcached.connection.SetReadDeadline(time.Now().Add(time.Second))
+				_, err := memcached.reader.ReadString('\n')
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("tenants", func() {
+		BeforeEach(func() {
+			instance.ID = "instance-2"
+		})
+
+		JustBeforeEach(func() {
+			instance.ID = "instance-1"
+			Expect(server.Start(instance)).To(Succeed())
+		})
+
+		It("keeps the keyspaces of the instances apart", func() {
+			first := connect("instance-1")
+			second := connect("instance-2")
+
+			first.call("set key 0 0 5\r\nfirst\r\n", "STORED")
+			Expect(second.call("get key\r\n", "END")).To(Equal([]string{"END"}))
+
+			second.send("flush_all\r\n")
+			Expect(second.line()).To(Equal("OK"))
+			Expect(first.call("get key\r\n", "END")).To(Equal([]string{"VALUE key 0 5", "first", "END"}))
+		})
+	})
+
+	Describe("Start", func() {
+		It("doesn't start an instance twice", func() {
+			address, _ := server.Address("instance-1")
+			Expect(server.Start(instance)).To(Succeed())
+
+			sameAddress, _ := server.Address("instance-1")
+			Expect(sameAddress).To(Equal(address))
+		})
+
+		Context("when the address is taken", func() {
+			It("fails", func() {
+				address, _ := server.Address("instance-1")
+
+				instance.ID = "instance-2"
+				instance.Port = fmt.Sprint(address.(*net.TCPAddr).Port)
+				err := server.Start(instance)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("Failed to start memcached for instance-2"))
+			})
+		})
+	})
+
+	Describe("Resize", func() {
+		It("gives the instance the memory of its new plan, keeping its items", func() {
+			memcached := connect("instance-1")
+			memcached.call("set key 0 0 5\r\nvalue\r\n", "STORED")
+
+			instance.PlanID = "plan-2"
+			Expect(server.Resize(instance)).To(Succeed())
+
+			Expect(memcached.call("stats\r\n", "END")).To(ContainElement("STAT limit_maxbytes 67108864"))
+			Expect(memcached.call("get key\r\n", "END")).To(Equal([]string{"VALUE key 0 5", "value", "END"}))
+		})
+
+		Context("when the items don't fit in the new plan", func() {
+			BeforeEach(func() {
+				instance.PlanID = "plan-2"
+			})
+
+			It("fails and keeps the memory of the old one", func() {
+				memcached := connect("instance-1")
+				for _, key := range []string{"first", "second"} {
+					memcached.send(fmt.Sprintf("set %s 0 0 600000\r\n%s\r\n", key, strings.Repeat("v", 600000)))
+					Expect(memcached.line()).To(Equal("STORED"))
+				}
+
+				instance.PlanID = "plan-1"
+				Expect(server.Resize(instance)).To(Equal(runner.ErrOverflow))
+				Expect(memcached.call("stats\r\n", "END")).To(ContainElement("STAT limit_maxbytes 67108864"))
+			})
+		})
+
+		Context("when the instance isn't served", func() {
+			It("starts it", func() {
+				instance.ID = "instance-2"
+				Expect(server.Resize(instance)).To(Succeed())
+
+				_, running := server.Address("instance-2")
+				Expect(running).To(BeTrue())
+			})
+		})
+	})
+
+	Describe("Stop", func() {
+		It("closes the connections and the listener", func() {
+			memcached := connect("instance-1")
+			address, _ := server.Address("instance-1")
+
+			Expect(server.Stop("instance-1")).To(Succeed())
+
+			memcached.connection.SetReadDeadline(time.Now().Add(time.Second))
+			_, err := memcached.reader.ReadString('\n')
+			Expect(err).To(HaveOccurred())
+
+			_, err = net.Dial("tcp", address.String())
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when clients have to authenticate", func() {
+		var memcached *client
+
+		BeforeEach(func() {
+			users = func(instanceID string) (map[string]string, error) {
+				if instanceID != "instance-1" {
+					return nil, errors.New("unknown instance")
+				}
+				return map[string]string{"user": "secret", "other-user": "other-secret"}, nil
+			}
+		})
+
+		JustBeforeEach(func() {
+			memcached = connect("instance-1")
+		})
+
+		It("refuses commands until they do", func() {
+			memcached.send("get key\r\n")
+			Expect(memcached.line()).To(Equal("CLIENT_ERROR unauthenticated"))
+		})
+
+		It("accepts the credentials of the instance", func() {
+			memcached.send("set auth 0 0 11\r\nuser secret\r\n")
+			Expect(memcached.line()).To(Equal("STORED"))
+			Expect(memcached.call("get key\r\n", "END")).To(Equal([]string{"END"}))
+		})
+
+		Context("with credentials larger than an item can be", func() {
+			BeforeEach(func() {
+				instance.PlanID = "plan-64"
+			})
+
+			It("refuses them without buffering them", func() {
+				memcached.send(fmt.Sprintf("set auth 0 0 1048577\r\nuser secret%s\r\n", strings.Repeat(" ", 1048566)))
+				Expect(memcached.line()).To(Equal("SERVER_ERROR object too large for cache"))
+
+				memcached.send("get key\r\n")
+				Expect(memcached.line()).To(Equal("CLIENT_ERROR unauthenticated"))
+			})
+		})
+
+		It("refuses wrong credentials", func() {
+			memcached.send("set auth 0 0 10\r\nuser wrong\r\n")
+			Expect(memcached.line()).To(Equal("CLIENT_ERROR authentication failure"))
+
+			memcached.send("get key\r\n")
+			Expect(memcached.line()).To(Equal("CLIENT_ERROR unauthenticated"))
+		})
+
+		Describe("Disconnect", func() {
+			It("closes the connections of the user", func() {
+				memcached.send("set auth 0 0 11\r\nuser secret\r\n")
+				Expect(memcached.line()).To(Equal("STORED"))
+
+				other := connect("instance-1")
+				other.send("set auth 0 0 23\r\nother-user other-secret\r\n")
+				Expect(other.line()).To(Equal("STORED"))
+
+				Expect(server.Disconnect("instance-1", "user")).To(Succeed())
+
+				memcached.connection.SetReadDeadline(time.Now().Add(time.Second))
+				_, err := memcached.reader.ReadString('\n')
+				Expect(err).To(HaveOccurred())
+
+				Expect(other.call("get key\r\n", "END")).To(Equal([]string{"END"}))
+			})
+		})
+	})
+})
@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/raphael/goa"
+)
+
+// APIVersionHeader is the header platforms send the version of the broker
+// API they speak in.
+const APIVersionHeader = "X-Broker-API-Version"
+
+// LatestVersion is the newest version of the broker API the broker knows
+// of. Platforms may speak newer minor versions, they are backwards
+// compatible.
+var LatestVersion = Version{Major: 2, Minor: 14}
+
+type apiVersionKey struct{}
+
+// Version is a version of the broker API.
+type Version struct {
+	Major int
+	Minor int
+}
+
+// ParseVersion reads a `major.minor` version.
+func ParseVersion(value string) (Version, error) {
+	parts := strings.Split(strings.TrimSpace(value), ".")
+	if len(parts) != 2 {
+		return Version{}, fmt.Errorf("Malformed broker API version %q", value)
+	}
+
+	major, err := strconv.Atoi(parts[0])
+	if err != nil || major < 0 {
+		return Version{}, fmt.Errorf("Malformed broker API version %q", value)
+	}
+
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil || minor < 0 {
+		return Version{}, fmt.Errorf("Malformed broker API version %q", value)
+	}
+
+	return Version{Major: major, Minor: minor}, nil
+}
+
+// AtLeast tells whether the version is the other one, or newer.
+func (v Version) AtLeast(other Version) bool {
+	if v.Major != other.Major {
+		return v.Major > other.Major
+	}
+
+	return v.Minor >= other.Minor
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// APIVersion refuses requests without the X-Broker-API-Version header, or
+// with a major version other than the one of LatestVersion, with a 412.
+// The version of the others is kept in their context, for RequestVersion.
+func APIVersion() func(goa.Handler) goa.Handler {
+	return func(handler goa.Handler) goa.Handler {
+		return func(ctx *goa.Context) error {
+			value := ctx.Request().Header.Get(APIVersionHeader)
+			if value == "" {
+				return ctx.JSON(412, ErrorResponse{Description: "The " + APIVersionHeader + " header is required"})
+			}
+
+			version, err := ParseVersion(value)
+			if err != nil {
+				return ctx.JSON(400, ErrorResponse{Description: err.Error()})
+			}
+
+			if version.Major != LatestVersion.Major {
+				return ctx.JSON(412, ErrorResponse{
+					Description: fmt.Sprintf("Broker API version %s isn't supported, the broker speaks %d.x", version, LatestVersion.Major),
+				})
+			}
+
+			ctx.SetValue(apiVersionKey{}, version)
+			return handler(ctx)
+		}
+	}
+}
+
+// RequestVersion returns the broker API version APIVersion negotiated for
+// the request.
+func RequestVersion(ctx *goa.Context) (Version, bool) {
+	version, ok := ctx.Value(apiVersionKey{}).(Version)
+	return version, ok
+}
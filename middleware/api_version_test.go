@@ -0,0 +1,112 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/raphael/goa"
+	"github.com/tscolari/memcached-broker/middleware"
+	"golang.org/x/net/context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("APIVersion", func() {
+	var request *http.Request
+	var responseWriter *httptest.ResponseRecorder
+	var goaContext *goa.Context
+	var handled *goa.Context
+
+	BeforeEach(func() {
+		request = &http.Request{Header: http.Header{}}
+		responseWriter = httptest.NewRecorder()
+		handled = nil
+	})
+
+	JustBeforeEach(func() {
+		goaContext = goa.NewContext(context.Background(), request, responseWriter, url.Values{}, nil)
+		handler := middleware.APIVersion()(func(ctx *goa.Context) error {
+			handled = ctx
+			return ctx.Respond(200, nil)
+		})
+
+		Expect(handler(goaContext)).To(Succeed())
+	})
+
+	Context("when the version is supported", func() {
+		BeforeEach(func() {
+			request.Header.Set("X-Broker-API-Version", "2.13")
+		})
+
+		It("passes the request on with the version", func() {
+			Expect(handled).ToNot(BeNil())
+
+			version, ok := middleware.RequestVersion(handled)
+			Expect(ok).To(BeTrue())
+			Expect(version).To(Equal(middleware.Version{Major: 2, Minor: 13}))
+		})
+	})
+
+	Context("when the minor version is newer than the broker's", func() {
+		BeforeEach(func() {
+			request.Header.Set("X-Broker-API-Version", "2.99")
+		})
+
+		It("passes the request on", func() {
+			Expect(handled).ToNot(BeNil())
+		})
+	})
+
+	Context("when the major version isn't supported", func() {
+		BeforeEach(func() {
+			request.Header.Set("X-Broker-API-Version", "3.0")
+		})
+
+		It("responds with 412", func() {
+			Expect(handled).To(BeNil())
+			Expect(goaContext.ResponseStatus()).To(Equal(412))
+			Expect(responseWriter.Body.String()).To(MatchJSON(`{"description":"Broker API version 3.0 isn't supported, the broker speaks 2.x"}`))
+		})
+	})
+
+	Context("when the header is missing", func() {
+		It("responds with 412", func() {
+			Expect(handled).To(BeNil())
+			Expect(goaContext.ResponseStatus()).To(Equal(412))
+			Expect(responseWriter.Body.String()).To(MatchJSON(`{"description":"The X-Broker-API-Version header is required"}`))
+		})
+	})
+
+	Context("when the version is malformed", func() {
+		BeforeEach(func() {
+			request.Header.Set("X-Broker-API-Version", "two")
+		})
+
+		It("responds with 400", func() {
+			Expect(handled).To(BeNil())
+			Expect(goaContext.ResponseStatus()).To(Equal(400))
+		})
+	})
+})
+
+var _ = Describe("Version", func() {
+	It("parses major.minor", func() {
+		Expect(middleware.ParseVersion("2.14")).To(Equal(middleware.Version{Major: 2, Minor: 14}))
+
+		for _, value := range []string{"", "2", "2.14.1", "2.x", "-1.0"} {
+			_, err := middleware.ParseVersion(value)
+			Expect(err).To(HaveOccurred(), value)
+		}
+	})
+
+	It("compares to other versions", func() {
+		version := middleware.Version{Major: 2, Minor: 14}
+		Expect(version.AtLeast(middleware.Version{Major: 2, Minor: 13})).To(BeTrue())
+		Expect(version.AtLeast(middleware.Version{Major: 2, Minor: 14})).To(BeTrue())
+		Expect(version.AtLeast(middleware.Version{Major: 2, Minor: 15})).To(BeFalse())
+		Expect(version.AtLeast(middleware.Version{Major: 1, Minor: 99})).To(BeTrue())
+		Expect(version.String()).To(Equal("2.14"))
+	})
+})
@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+
+	"github.com/raphael/goa"
+)
+
+// Realm is what the broker calls itself when asking for credentials.
+const Realm = "memcached-broker"
+
+var (
+	errNoCredentials         = errors.New("No broker credentials configured")
+	errIncompleteCredentials = errors.New("Broker credentials need a username and a password")
+)
+
+// Credentials are a username and password the platform authenticates with.
+type Credentials struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// ErrorResponse is the body of a request refused by a middleware.
+type ErrorResponse struct {
+	Error       string `json:"error,omitempty"`
+	Description string `json:"description"`
+}
+
+// BasicAuth refuses requests that don't authenticate with one of the
+// credentials, answering 401 with a WWW-Authenticate header. Any of the
+// credentials is accepted, so they can be rotated without downtime: add the
+// new ones, move the platform over, then remove the old ones.
+//
+// Usernames and passwords are compared in constant time, and every one of
+// the credentials is compared, so the timing doesn't tell which one came
+// close.
+func BasicAuth(credentials []Credentials) (func(goa.Handler) goa.Handler, error) {
+	if len(credentials) == 0 {
+		return nil, errNoCredentials
+	}
+
+	digests := make([][sha256.Size * 2]byte, len(credentials))
+	for i, c := range credentials {
+		if c.Username == "" || c.Password == "" {
+			return nil, errIncompleteCredentials
+		}
+
+		digests[i] = digest(c.Username, c.Password)
+	}
+
+	return func(handler goa.Handler) goa.Handler {
+		return func(ctx *goa.Context) error {
+			username, password, ok := ctx.Request().BasicAuth()
+			if !ok || !authorized(digests, digest(username, password)) {
+				ctx.ResponseWriter().Header().Set("WWW-Authenticate", `Basic realm="`+Realm+`"`)
+				return ctx.JSON(401, ErrorResponse{Description: "The broker credentials are missing or wrong"})
+			}
+
+			return handler(ctx)
+		}
+	}, nil
+}
+
+// digest hashes the username and password apart, so their lengths don't
+// change how long comparing them takes.
+func digest(username, password string) [sha256.Size * 2]byte {
+	var d [sha256.Size * 2]byte
+	usernameDigest := sha256.Sum256([]byte(username))
+	passwordDigest := sha256.Sum256([]byte(password))
+	copy(d[:sha256.Size], usernameDigest[:])
+	copy(d[sha256.Size:], passwordDigest[:])
+	return d
+}
+
+func authorized(digests [][sha256.Size * 2]byte, given [sha256.Size * 2]byte) bool {
+	matches := 0
+	for _, d := range digests {
+		matches |= subtle.ConstantTimeCompare(d[:], given[:])
+	}
+
+	return matches == 1
+}
@@ -0,0 +1,115 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/raphael/goa"
+	"github.com/tscolari/memcached-broker/middleware"
+	"golang.org/x/net/context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("BasicAuth", func() {
+	var credentials []middleware.Credentials
+	var request *http.Request
+	var responseWriter *httptest.ResponseRecorder
+	var goaContext *goa.Context
+	var handled bool
+
+	BeforeEach(func() {
+		credentials = []middleware.Credentials{
+			{Username: "broker", Password: "old-secret"},
+			{Username: "broker", Password: "new-secret"},
+		}
+
+		request = &http.Request{Header: http.Header{}}
+		responseWriter = httptest.NewRecorder()
+		handled = false
+	})
+
+	JustBeforeEach(func() {
+		basicAuth, err := middleware.BasicAuth(credentials)
+		Expect(err).ToNot(HaveOccurred())
+
+		goaContext = goa.NewContext(context.Background(), request, responseWriter, url.Values{}, nil)
+		handler := basicAuth(func(ctx *goa.Context) error {
+			handled = true
+			return ctx.Respond(200, nil)
+		})
+
+		Expect(handler(goaContext)).To(Succeed())
+	})
+
+	Context("when the request has valid credentials", func() {
+		BeforeEach(func() {
+			request.SetBasicAuth("broker", "old-secret")
+		})
+
+		It("passes it on", func() {
+			Expect(handled).To(BeTrue())
+			Expect(goaContext.ResponseStatus()).To(Equal(200))
+		})
+	})
+
+	Context("when the request has the other valid credentials", func() {
+		BeforeEach(func() {
+			request.SetBasicAuth("broker", "new-secret")
+		})
+
+		It("passes it on too", func() {
+			Expect(handled).To(BeTrue())
+		})
+	})
+
+	Context("when the password is wrong", func() {
+		BeforeEach(func() {
+			request.SetBasicAuth("broker", "old-secret!")
+		})
+
+		It("responds with 401 and asks for credentials", func() {
+			Expect(handled).To(BeFalse())
+			Expect(goaContext.ResponseStatus()).To(Equal(401))
+			Expect(responseWriter.Header().Get("WWW-Authenticate")).To(Equal(`Basic realm="memcached-broker"`))
+			Expect(responseWriter.Body.String()).To(MatchJSON(`{"description":"The broker credentials are missing or wrong"}`))
+		})
+	})
+
+	Context("when the username is wrong", func() {
+		BeforeEach(func() {
+			request.SetBasicAuth("admin", "old-secret")
+		})
+
+		It("responds with 401", func() {
+			Expect(handled).To(BeFalse())
+			Expect(goaContext.ResponseStatus()).To(Equal(401))
+		})
+	})
+
+	Context("when the request has no credentials", func() {
+		It("responds with 401 and asks for credentials", func() {
+			Expect(handled).To(BeFalse())
+			Expect(goaContext.ResponseStatus()).To(Equal(401))
+			Expect(responseWriter.Header().Get("WWW-Authenticate")).To(Equal(`Basic realm="memcached-broker"`))
+		})
+	})
+})
+
+var _ = Describe("BasicAuth configuration", func() {
+	Context("when there are no credentials", func() {
+		It("fails", func() {
+			_, err := middleware.BasicAuth(nil)
+			Expect(err).To(MatchError("No broker credentials configured"))
+		})
+	})
+
+	Context("when a password is empty", func() {
+		It("fails", func() {
+			_, err := middleware.BasicAuth([]middleware.Credentials{{Username: "broker"}})
+			Expect(err).To(MatchError("Broker credentials need a username and a password"))
+		})
+	})
+})
@@ -0,0 +1,319 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/tscolari/cf-broker-api/common/repository"
+	"github.com/tscolari/memcached-broker/runner"
+	"github.com/tscolari/memcached-broker/storage"
+)
+
+var (
+	errInvalidCredentials = errors.New("Invalid proxy credentials")
+	errUsernameTaken      = errors.New("Proxy username is taken")
+)
+
+// Config is the configuration of a Proxy.
+type Config struct {
+	// Listen is the address the proxy accepts clients on.
+	Listen string `yaml:"listen"`
+
+	// Host and Port are what bound apps connect to, when they differ from
+	// the listen address.
+	Host string `yaml:"host"`
+	Port string `yaml:"port"`
+
+	// Backend is the address of the memcached the instances share.
+	Backend string `yaml:"backend"`
+
+	// Plans are served through the proxy, instead of by a memcached of
+	// their own.
+	Plans []string `yaml:"plans"`
+}
+
+//go:generate counterfeiter . Router
+
+// Router gives the instances of shared plans a keyspace in the memcached
+// behind the proxy, and their bindings the credentials to reach it.
+type Router interface {
+	Serves(planID string) bool
+	Address() (host, port string)
+	AddRoute(instance repository.Instance) error
+	RemoveRoute(instanceID string) error
+	Grant(instanceID string, credentials storage.Credentials) error
+	Revoke(instanceID, username string) error
+}
+
+// QuotaNotice is added to the description of the plans the proxy serves, as
+// their memory limit is only enforced on a best-effort basis.
+const QuotaNotice = "The memory limit is best-effort: it counts what was stored since the broker last started, and items evicted by memcached until they are read again."
+
+func New(config Config, planSizes map[string]int) *Proxy {
+	plans := map[string]bool{}
+	for _, planID := range config.Plans {
+		plans[planID] = true
+	}
+
+	return &Proxy{
+		config:    config,
+		plans:     plans,
+		planSizes: planSizes,
+		routes:    map[string]*route{},
+		users:     map[string]user{},
+	}
+}
+
+// Proxy sits in front of a single memcached shared by many instances.
+// Clients authenticate with the credentials of a binding, the way memcached
+// does with `-Y`: their first command is a `set` of "username password" for
+// any key. From then on every key they send is prefixed with a digest of the
+// ID of the instance, and the prefix is taken off the keys sent back, so the
+// instances never see each other's keys.
+//
+// Commands that reach past a single keyspace, like `flush_all` and `stats`,
+// are refused. Each instance may store as many megabytes as the size of its
+// plan, counted from what went through the proxy.
+//
+// What an instance stores is only counted in memory. After a restart of the
+// broker the count starts from zero while memcached still holds the items
+// stored before, so until those expire, get evicted or are replaced, an
+// instance may store up to its quota on top of them. An item memcached
+// evicted keeps counting until a client misses it. The catalog tells apps
+// with QuotaNotice.
+type Proxy struct {
+	config    Config
+	plans     map[string]bool
+	planSizes map[string]int
+	listener  net.Listener
+	routes    map[string]*route
+	users     map[string]user
+	lock      sync.Mutex
+}
+
+type user struct {
+	instanceID string
+	password   string
+}
+
+var _ Router = &Proxy{}
+
+// Listen starts accepting clients in the background.
+func (p *Proxy) Listen() error {
+	listener, err := net.Listen("tcp", p.config.Listen)
+	if err != nil {
+		return fmt.Errorf("Failed to start the proxy: %s", err.Error())
+	}
+
+	p.lock.Lock()
+	p.listener = listener
+	p.lock.Unlock()
+
+	go p.accept(listener)
+	return nil
+}
+
+// Close stops accepting clients and disconnects the authenticated ones.
+func (p *Proxy) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, r := range p.routes {
+		r.disconnect("")
+	}
+
+	if p.listener == nil {
+		return nil
+	}
+
+	return p.listener.Close()
+}
+
+// Serves tells whether instances of the plan are served through the proxy.
+func (p *Proxy) Serves(planID string) bool {
+	return p.plans[planID]
+}
+
+// Address is where bound apps reach the proxy.
+func (p *Proxy) Address() (string, string) {
+	host, port := p.config.Host, p.config.Port
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.listener != nil {
+		listenHost, listenPort, err := net.SplitHostPort(p.listener.Addr().String())
+		if err == nil {
+			if host == "" {
+				host = listenHost
+			}
+			if port == "" {
+				port = listenPort
+			}
+		}
+	}
+
+	return host, port
+}
+
+// AddRoute gives the instance a keyspace, with the quota of its plan. When
+// the instance has one already, only its quota changes. It fails with
+// runner.ErrOverflow when the instance stores more than the new quota.
+func (p *Proxy) AddRoute(instance repository.Instance) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	quota := p.quota(instance.PlanID)
+	if r, exists := p.routes[instance.ID]; exists {
+		if !r.resize(quota) {
+			return runner.ErrOverflow
+		}
+		return nil
+	}
+
+	p.routes[instance.ID] = newRoute(instance.ID, quota)
+	return nil
+}
+
+// RemoveRoute disconnects the clients of the instance and forgets its
+// users. Its keys stay in memcached until they expire or get evicted.
+func (p *Proxy) RemoveRoute(instanceID string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	r, exists := p.routes[instanceID]
+	if !exists {
+		return nil
+	}
+
+	delete(p.routes, instanceID)
+	for username, u := range p.users {
+		if u.instanceID == instanceID {
+			delete(p.users, username)
+		}
+	}
+
+	r.disconnect("")
+	return nil
+}
+
+// Grant lets the user in to the keyspace of the instance.
+func (p *Proxy) Grant(instanceID string, credentials storage.Credentials) error {
+	if credentials.Username == "" || credentials.Password == "" {
+		return errInvalidCredentials
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if _, exists := p.routes[instanceID]; !exists {
+		return fmt.Errorf("No proxy route for %s", instanceID)
+	}
+
+	if u, exists := p.users[credentials.Username]; exists && u.instanceID != instanceID {
+		return errUsernameTaken
+	}
+
+	p.users[credentials.Username] = user{instanceID: instanceID, password: credentials.Password}
+	return nil
+}
+
+// Revoke removes the user, disconnecting the clients it authenticated.
+func (p *Proxy) Revoke(instanceID, username string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	u, exists := p.users[username]
+	if !exists || u.instanceID != instanceID {
+		return nil
+	}
+
+	delete(p.users, username)
+	if r, exists := p.routes[instanceID]; exists {
+		r.disconnect(username)
+	}
+
+	return nil
+}
+
+// Recover adds the routes and users of the shared instances in the state,
+// which the proxy only keeps in memory. The routes count what the instances
+// store from zero.
+func (p *Proxy) Recover(state storage.Storage) error {
+	instances, err := state.Instances()
+	if err != nil {
+		return err
+	}
+
+	for _, instance := range instances {
+		if !p.Serves(instance.PlanID) {
+			continue
+		}
+
+		err = p.AddRoute(instance)
+		if err != nil {
+			return err
+		}
+
+		for _, bindingID := range instance.Bindings {
+			binding, err := state.Binding(instance.ID, bindingID)
+			if err != nil {
+				return err
+			}
+
+			// Bindings from before credentials were issued have nothing to grant.
+			if binding.Credentials.Username == "" {
+				continue
+			}
+
+			err = p.Grant(instance.ID, binding.Credentials)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *Proxy) quota(planID string) int64 {
+	size, exists := p.planSizes[planID]
+	if !exists || size <= 0 {
+		size = 1
+	}
+
+	return int64(size) * 1024 * 1024
+}
+
+// authenticate joins the session to the route of the user, and returns the
+// route. It holds the lock throughout, so a Revoke or a RemoveRoute either
+// refuses the user or finds the session to disconnect.
+func (p *Proxy) authenticate(s *session, username, password string) (*route, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	u, exists := p.users[username]
+	if !exists || !equal(u.password, password) {
+		return nil, false
+	}
+
+	r, exists := p.routes[u.instanceID]
+	if !exists || !r.join(s, username) {
+		return nil, false
+	}
+
+	return r, true
+}
+
+func (p *Proxy) accept(listener net.Listener) {
+	for {
+		connection, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go newSession(p, connection).run()
+	}
+}
@@ -0,0 +1,450 @@
+package proxy_test
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/tscolari/cf-broker-api/common/repository"
+	"github.com/tscolari/memcached-broker/memcache"
+	"github.com/tscolari/memcached-broker/proxy"
+	"github.com/tscolari/memcached-broker/runner"
+	"github.com/tscolari/memcached-broker/storage"
+	"github.com/tscolari/memcached-broker/storage/fakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type client struct {
+	connection net.Conn
+	reader     *bufio.Reader
+}
+
+func dial(address string) *client {
+	connection, err := net.Dial("tcp", address)
+	Expect(err).ToNot(HaveOccurred())
+	return &client{connection: connection, reader: bufio.NewReader(connection)}
+}
+
+func (c *client) send(command string) {
+	c.connection.SetWriteDeadline(time.Now().Add(time.Second))
+	_, err := fmt.Fprint(c.connection, command)
+	Expect(err).ToNot(HaveOccurred())
+}
+
+func (c *client) line() string {
+	c.connection.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := c.reader.ReadString('\n')
+	Expect(err).ToNot(HaveOccurred())
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+// call sends the command and reads the reply, up to its last line.
+func (c *client) call(command string, last string) []string {
+	c.send(command)
+
+	lines := []string{}
+	for {
+		line := c.line()
+		lines = append(lines, line)
+		if line == last || strings.Contains(line, "ERROR") {
+			return lines
+		}
+	}
+}
+
+func (c *client) login(username, password string) string {
+	credentials := username + " " + password
+	c.send(fmt.Sprintf("set auth 0 0 %d\r\n%s\r\n", len(credentials), credentials))
+	return c.line()
+}
+
+// prefixOf is what the keys of the instance start with in the shared
+// memcached.
+func prefixOf(instanceID string) string {
+	digest := sha256.Sum256([]byte(instanceID))
+	return hex.EncodeToString(digest[:16]) + ":"
+}
+
+func (c *client) disconnected() bool {
+	c.connection.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := c.reader.ReadString('\n')
+	return err != nil
+}
+
+var _ = Describe("Proxy", func() {
+	var backend *memcache.Server
+	var backendAddress string
+	var memcachedProxy *proxy.Proxy
+	var config proxy.Config
+
+	connect := func() *client {
+		host, port := memcachedProxy.Address()
+		return dial(net.JoinHostPort(host, port))
+	}
+
+	login := func(username, password string) *client {
+		memcached := connect()
+		Expect(memcached.login(username, password)).To(Equal("STORED"))
+		return memcached
+	}
+
+	BeforeEach(func() {
+		backend = memcache.New(nil, nil)
+		Expect(backend.Start(repository.Instance{ID: "shared", Host: "127.0.0.1", Port: "0"})).To(Succeed())
+
+		address, _ := backend.Address("shared")
+		backendAddress = address.String()
+
+		config = proxy.Config{
+			Listen:  "127.0.0.1:0",
+			Backend: backendAddress,
+			Plans:   []string{"shared-plan"},
+		}
+	})
+
+	JustBeforeEach(func() {
+		memcachedProxy = proxy.New(config, map[string]int{"shared-plan": 1, "large-shared-plan": 2})
+		Expect(memcachedProxy.Listen()).To(Succeed())
+
+		Expect(memcachedProxy.AddRoute(repository.Instance{ID: "instance-1", PlanID: "shared-plan"})).To(Succeed())
+		Expect(memcachedProxy.AddRoute(repository.Instance{ID: "instance-2", PlanID: "shared-plan"})).To(Succeed())
+		Expect(memcachedProxy.Grant("instance-1", storage.Credentials{Username: "user-1", Password: "secret-1"})).To(Succeed())
+		Expect(memcachedProxy.Grant("instance-2", storage.Credentials{Username: "user-2", Password: "secret-2"})).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(memcachedProxy.Close()).To(Succeed())
+		Expect(backend.Stop("shared")).To(Succeed())
+	})
+
+	Describe("Serves", func() {
+		It("serves the configured plans", func() {
+			Expect(memcachedProxy.Serves("shared-plan")).To(BeTrue())
+			Expect(memcachedProxy.Serves("dedicated-plan")).To(BeFalse())
+		})
+	})
+
+	Describe("Address", func() {
+		It("is the listen address", func() {
+			host, port := memcachedProxy.Address()
+			Expect(host).To(Equal("127.0.0.1"))
+			Expect(port).ToNot(Equal("0"))
+		})
+
+		Context("when the address for apps is configured", func() {
+			BeforeEach(func() {
+				config.Host = "10.0.0.9"
+				config.Port = "11211"
+			})
+
+			It("is the configured one", func() {
+				host, port := memcachedProxy.Address()
+				Expect(host).To(Equal("10.0.0.9"))
+				Expect(port).To(Equal("11211"))
+			})
+		})
+	})
+
+	Describe("authentication", func() {
+		It("refuses commands before the client authenticated", func() {
+			memcached := connect()
+			memcached.send("get key\r\n")
+			Expect(memcached.line()).To(Equal("CLIENT_ERROR unauthenticated"))
+		})
+
+		It("refuses wrong credentials", func() {
+			memcached := connect()
+			Expect(memcached.login("user-1", "secret-2")).To(Equal("CLIENT_ERROR authentication failure"))
+			Expect(memcached.login("user-3", "secret-3")).To(Equal("CLIENT_ERROR authentication failure"))
+		})
+
+		It("accepts the credentials of a binding", func() {
+			memcached := connect()
+			Expect(memcached.login("user-1", "secret-1")).To(Equal("STORED"))
+			Expect(memcached.call("get key\r\n", "END")).To(Equal([]string{"END"}))
+		})
+	})
+
+	Describe("relaying commands", func() {
+		var memcached *client
+		var direct *client
+
+		JustBeforeEach(func() {
+			memcached = login("user-1", "secret-1")
+			direct = dial(backendAddress)
+		})
+
+		It("prefixes the keys with the instance", func() {
+			Expect(memcached.call("set key 3 0 5\r\nvalue\r\n", "STORED")).To(Equal([]string{"STORED"}))
+
+			prefix := prefixOf("instance-1")
+			Expect(direct.call("get "+prefix+"key\r\n", "END")).To(Equal([]string{"VALUE " + prefix + "key 3 5", "value", "END"}))
+			Expect(memcached.call("get key\r\n", "END")).To(Equal([]string{"VALUE key 3 5", "value", "END"}))
+		})
+
+		It("relays the other commands", func() {
+			memcached.call("set counter 0 0 1\r\n1\r\n", "STORED")
+
+			reply := memcached.call("gets counter\r\n", "END")
+			var cas uint64
+			_, err := fmt.Sscanf(reply[0], "VALUE counter 0 1 %d", &cas)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(memcached.call(fmt.Sprintf("cas counter 0 0 1 %d\r\n5\r\n", cas), "STORED")).To(Equal([]string{"STORED"}))
+			Expect(memcached.call("incr counter 2\r\n", "7")).To(Equal([]string{"7"}))
+			Expect(memcached.call("touch counter 100\r\n", "TOUCHED")).To(Equal([]string{"TOUCHED"}))
+			Expect(memcached.call("append counter 0 0 1\r\n0\r\n", "STORED")).To(Equal([]string{"STORED"}))
+			Expect(memcached.call("get counter\r\n", "END")).To(Equal([]string{"VALUE counter 0 2", "70", "END"}))
+			Expect(memcached.call("delete counter\r\n", "DELETED")).To(Equal([]string{"DELETED"}))
+			Expect(memcached.call("version\r\n", "VERSION "+memcache.Version)).To(HaveLen(1))
+		})
+
+		It("doesn't reply to noreply commands", func() {
+			memcached.send("set key 0 0 5 noreply\r\nvalue\r\n")
+			Expect(memcached.call("get key\r\n", "END")).To(Equal([]string{"VALUE key 0 5", "value", "END"}))
+		})
+
+		It("keeps the instances apart", func() {
+			other := login("user-2", "secret-2")
+
+			memcached.call("set key 0 0 5\r\nfirst\r\n", "STORED")
+			Expect(other.call("get key\r\n", "END")).To(Equal([]string{"END"}))
+
+			other.call("set key 0 0 6\r\nsecond\r\n", "STORED")
+			Expect(memcached.call("get key\r\n", "END")).To(Equal([]string{"VALUE key 0 5", "first", "END"}))
+		})
+
+		It("keeps apart instances whose IDs continue with each other's keys", func() {
+			Expect(memcachedProxy.AddRoute(repository.Instance{ID: "a", PlanID: "shared-plan"})).To(Succeed())
+			Expect(memcachedProxy.AddRoute(repository.Instance{ID: "a:b", PlanID: "shared-plan"})).To(Succeed())
+			Expect(memcachedProxy.Grant("a", storage.Credentials{Username: "user-a", Password: "secret-a"})).To(Succeed())
+			Expect(memcachedProxy.Grant("a:b", storage.Credentials{Username: "user-ab", Password: "secret-ab"})).To(Succeed())
+
+			first := login("user-a", "secret-a")
+			second := login("user-ab", "secret-ab")
+
+			first.call("set b:x 0 0 5\r\nfirst\r\n", "STORED")
+			Expect(second.call("get x\r\n", "END")).To(Equal([]string{"END"}))
+		})
+
+		It("refuses the commands that reach past the instance", func() {
+			memcached.call("set key 0 0 5\r\nvalue\r\n", "STORED")
+
+			for _, command := range []string{"flush_all", "stats", "stats items", "verbosity 1", "shutdown", "mg key v"} {
+				memcached.send(command + "\r\n")
+				Expect(memcached.line()).To(Equal("CLIENT_ERROR command not allowed"), command)
+			}
+
+			Expect(direct.call("get "+prefixOf("instance-1")+"key\r\n", "END")).To(HaveLen(3))
+		})
+
+		Context("when the key is too long with the prefix", func() {
+			It("refuses it", func() {
+				memcached.send(fmt.Sprintf("get %s\r\n", strings.Repeat("k", 240)))
+				Expect(memcached.line()).To(Equal("CLIENT_ERROR bad command line format"))
+			})
+		})
+
+		Context("when the instance is over its quota", func() {
+			value := strings.Repeat("v", 1024*1024-100)
+
+			JustBeforeEach(func() {
+				command := fmt.Sprintf("set big 0 0 %d\r\n%s\r\n", len(value), value)
+				Expect(memcached.call(command, "STORED")).To(Equal([]string{"STORED"}))
+			})
+
+			It("refuses to store more", func() {
+				Expect(memcached.call("set key 0 0 100\r\n"+strings.Repeat("v", 100)+"\r\n", "STORED")).To(Equal([]string{
+					"SERVER_ERROR out of memory storing object",
+				}))
+				Expect(memcached.call("append big 0 0 100\r\n"+strings.Repeat("v", 100)+"\r\n", "STORED")).To(Equal([]string{
+					"SERVER_ERROR out of memory storing object",
+				}))
+			})
+
+			It("accepts replacing a value with a smaller one", func() {
+				Expect(memcached.call("set big 0 0 5\r\nsmall\r\n", "STORED")).To(Equal([]string{"STORED"}))
+			})
+
+			It("frees the space of deleted items", func() {
+				memcached.call("delete big\r\n", "DELETED")
+				Expect(memcached.call("set key 0 0 100\r\n"+strings.Repeat("v", 100)+"\r\n", "STORED")).To(Equal([]string{"STORED"}))
+			})
+
+			It("frees the space of items memcached no longer has", func() {
+				direct.call("delete "+prefixOf("instance-1")+"big\r\n", "DELETED")
+				memcached.call("get big\r\n", "END")
+
+				Expect(memcached.call("set key 0 0 100\r\n"+strings.Repeat("v", 100)+"\r\n", "STORED")).To(Equal([]string{"STORED"}))
+			})
+
+			It("counts what incr adds to a value", func() {
+				Expect(memcached.call("set counter 0 0 1\r\n9\r\n", "STORED")).To(Equal([]string{"STORED"}))
+				Expect(memcached.call("incr counter 1\r\n", "10")).To(Equal([]string{"10"}))
+
+				Expect(memcached.call("set pad 0 0 86\r\n"+strings.Repeat("v", 86)+"\r\n", "STORED")).To(Equal([]string{
+					"SERVER_ERROR out of memory storing object",
+				}))
+				Expect(memcached.call("set pad 0 0 85\r\n"+strings.Repeat("v", 85)+"\r\n", "STORED")).To(Equal([]string{"STORED"}))
+			})
+
+			Context("and the broker restarts", func() {
+				JustBeforeEach(func() {
+					Expect(memcachedProxy.Close()).To(Succeed())
+
+					state := new(fakes.FakeStorage)
+					state.InstancesReturns([]repository.Instance{
+						{ID: "instance-1", PlanID: "shared-plan", Bindings: []string{"binding-1"}},
+					}, nil)
+					state.BindingReturns(&storage.Binding{
+						ID:          "binding-1",
+						InstanceID:  "instance-1",
+						Credentials: storage.Credentials{Username: "user-1", Password: "secret-1"},
+					}, nil)
+
+					memcachedProxy = proxy.New(config, map[string]int{"shared-plan": 1})
+					Expect(memcachedProxy.Listen()).To(Succeed())
+					Expect(memcachedProxy.Recover(state)).To(Succeed())
+				})
+
+				It("counts what the instance stores from zero, on top of what memcached still has", func() {
+					memcached = login("user-1", "secret-1")
+
+					command := fmt.Sprintf("set other 0 0 %d\r\n%s\r\n", len(value), value)
+					Expect(memcached.call(command, "STORED")).To(Equal([]string{"STORED"}))
+					Expect(memcached.call("get big\r\n", "END")).To(HaveLen(3))
+				})
+			})
+
+			It("doesn't count against the other instances", func() {
+				other := login("user-2", "secret-2")
+				Expect(other.call("set key 0 0 100\r\n"+strings.Repeat("v", 100)+"\r\n", "STORED")).To(Equal([]string{"STORED"}))
+			})
+
+			Context("and moves to a larger plan", func() {
+				JustBeforeEach(func() {
+					Expect(memcachedProxy.AddRoute(repository.Instance{ID: "instance-1", PlanID: "large-shared-plan"})).To(Succeed())
+				})
+
+				It("stores more", func() {
+					Expect(memcached.call("set key 0 0 100\r\n"+strings.Repeat("v", 100)+"\r\n", "STORED")).To(Equal([]string{"STORED"}))
+				})
+
+				It("can't move back once the smaller plan is too small", func() {
+					memcached.call("set key 0 0 100\r\n"+strings.Repeat("v", 100)+"\r\n", "STORED")
+
+					err := memcachedProxy.AddRoute(repository.Instance{ID: "instance-1", PlanID: "shared-plan"})
+					Expect(err).To(Equal(runner.ErrOverflow))
+					Expect(memcached.call("set other 0 0 100\r\n"+strings.Repeat("v", 100)+"\r\n", "STORED")).To(Equal([]string{"STORED"}))
+				})
+			})
+		})
+
+		Context("when memcached goes away", func() {
+			It("tells the client", func() {
+				Expect(backend.Stop("shared")).To(Succeed())
+
+				memcached.send("get key\r\n")
+				Expect(memcached.line()).To(Equal("SERVER_ERROR backend unavailable"))
+				Expect(memcached.disconnected()).To(BeTrue())
+			})
+		})
+	})
+
+	Describe("Grant", func() {
+		Context("when the instance has no route", func() {
+			It("fails", func() {
+				err := memcachedProxy.Grant("instance-3", storage.Credentials{Username: "user-3", Password: "secret-3"})
+				Expect(err).To(MatchError("No proxy route for instance-3"))
+			})
+		})
+
+		Context("when another instance has a user with the same name", func() {
+			It("fails", func() {
+				err := memcachedProxy.Grant("instance-2", storage.Credentials{Username: "user-1", Password: "secret"})
+				Expect(err).To(MatchError("Proxy username is taken"))
+			})
+		})
+	})
+
+	Describe("Revoke", func() {
+		It("disconnects the clients of the user and refuses new ones", func() {
+			memcached := login("user-1", "secret-1")
+			other := login("user-2", "secret-2")
+
+			Expect(memcachedProxy.Revoke("instance-1", "user-1")).To(Succeed())
+			Expect(memcached.disconnected()).To(BeTrue())
+			Expect(connect().login("user-1", "secret-1")).To(Equal("CLIENT_ERROR authentication failure"))
+
+			Expect(other.call("get key\r\n", "END")).To(Equal([]string{"END"}))
+		})
+
+		Context("while the user logs in", func() {
+			It("either refuses or disconnects the client", func() {
+				for i := 0; i < 20; i++ {
+					username := fmt.Sprintf("racing-user-%d", i)
+					Expect(memcachedProxy.Grant("instance-1", storage.Credentials{Username: username, Password: "secret"})).To(Succeed())
+
+					memcached := connect()
+					revoked := make(chan error)
+					go func() {
+						revoked <- memcachedProxy.Revoke("instance-1", username)
+					}()
+
+					credentials := username + " secret"
+					memcached.send(fmt.Sprintf("set auth 0 0 %d\r\n%s\r\n", len(credentials), credentials))
+					memcached.connection.SetReadDeadline(time.Now().Add(time.Second))
+					reply, err := memcached.reader.ReadString('\n')
+					Expect(<-revoked).To(Succeed())
+
+					if err == nil && reply == "STORED\r\n" {
+						Expect(memcached.disconnected()).To(BeTrue())
+					}
+				}
+			})
+		})
+	})
+
+	Describe("RemoveRoute", func() {
+		It("disconnects the clients of the instance and forgets its users", func() {
+			memcached := login("user-1", "secret-1")
+
+			Expect(memcachedProxy.RemoveRoute("instance-1")).To(Succeed())
+			Expect(memcached.disconnected()).To(BeTrue())
+			Expect(connect().login("user-1", "secret-1")).To(Equal("CLIENT_ERROR authentication failure"))
+		})
+
+		Context("when the instance has no route", func() {
+			It("succeeds", func() {
+				Expect(memcachedProxy.RemoveRoute("instance-3")).To(Succeed())
+			})
+		})
+	})
+
+	Describe("Recover", func() {
+		It("adds the routes and users of the shared instances", func() {
+			state := new(fakes.FakeStorage)
+			state.InstancesReturns([]repository.Instance{
+				{ID: "instance-3", PlanID: "shared-plan", Bindings: []string{"binding-1"}},
+				{ID: "instance-4", PlanID: "dedicated-plan", Bindings: []string{"binding-2"}},
+			}, nil)
+			state.BindingReturns(&storage.Binding{
+				ID:          "binding-1",
+				InstanceID:  "instance-3",
+				Credentials: storage.Credentials{Username: "user-3", Password: "secret-3"},
+			}, nil)
+
+			Expect(memcachedProxy.Recover(state)).To(Succeed())
+			Expect(state.BindingCallCount()).To(Equal(1))
+
+			memcached := connect()
+			Expect(memcached.login("user-3", "secret-3")).To(Equal("STORED"))
+		})
+	})
+})
@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// route is the keyspace of an instance in the shared memcached.
+type route struct {
+	instanceID string
+	prefix     string
+	now        func() time.Time
+
+	// quota is how many bytes of keys and values the instance may store,
+	// used is how many the proxy saw stored and not removed since.
+	quota int64
+	used  int64
+	items map[string]usage
+
+	// sessions are the clients of the instance, and the users they
+	// authenticated as. No client joins once the route is closed.
+	sessions map[*session]string
+	closed   bool
+	lock     sync.Mutex
+}
+
+type usage struct {
+	size    int64
+	expires time.Time
+}
+
+func newRoute(instanceID string, quota int64) *route {
+	return &route{
+		instanceID: instanceID,
+		prefix:     keyPrefix(instanceID),
+		now:        time.Now,
+		quota:      quota,
+		items:      map[string]usage{},
+		sessions:   map[*session]string{},
+	}
+}
+
+// keyPrefix is what the keys of the instance start with in the shared
+// memcached: a digest of its ID, so the prefix has the same length for every
+// instance and no ID ends up a prefix of another with part of a key.
+func keyPrefix(instanceID string) string {
+	digest := sha256.Sum256([]byte(instanceID))
+	return hex.EncodeToString(digest[:16]) + ":"
+}
+
+// resize changes the quota, unless what the instance stores doesn't fit in
+// it.
+func (r *route) resize(quota int64) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.used > quota {
+		r.dropExpired()
+		if r.used > quota {
+			return false
+		}
+	}
+
+	r.quota = quota
+	return true
+}
+
+// reserve counts the item against the quota before it's stored, and tells
+// whether it fits. The returned function undoes it, when memcached doesn't
+// store the item after all. Appended data adds to the item and keeps its
+// expiration.
+func (r *route) reserve(key string, size int64, expires time.Time, appended bool) (func(), bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	previous, existed := r.items[key]
+	item := usage{size: size, expires: expires}
+	if appended {
+		item = usage{size: previous.size + size, expires: previous.expires}
+	}
+
+	if r.used-previous.size+item.size > r.quota {
+		r.dropExpired()
+		previous, existed = r.items[key]
+		if r.used-previous.size+item.size > r.quota {
+			return nil, false
+		}
+	}
+
+	r.set(key, item)
+
+	return func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+
+		if existed {
+			r.set(key, previous)
+		} else {
+			r.remove(key)
+		}
+	}, true
+}
+
+// expire changes when the item expires, after a touch.
+func (r *route) expire(key string, expires time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if item, exists := r.items[key]; exists {
+		item.expires = expires
+		r.items[key] = item
+	}
+}
+
+// recount changes the size of the item, after memcached changed its value
+// in place on an incr or a decr. memcached doesn't refuse those for memory,
+// and they change the value by a few bytes at most, so it's counted even
+// past the quota.
+func (r *route) recount(key string, size int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	item := r.items[key]
+	item.size = size
+	r.set(key, item)
+}
+
+// forget stops counting the item, once it's gone from memcached.
+func (r *route) forget(key string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.remove(key)
+}
+
+func (r *route) join(s *session, username string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return false
+	}
+
+	r.sessions[s] = username
+	return true
+}
+
+func (r *route) leave(s *session) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.sessions, s)
+}
+
+// disconnect closes the sessions of the user, or closes the route with all
+// of its sessions when username is empty.
+func (r *route) disconnect(username string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if username == "" {
+		r.closed = true
+	}
+
+	for s, sessionUsername := range r.sessions {
+		if username == "" || sessionUsername == username {
+			s.close()
+		}
+	}
+}
+
+func (r *route) set(key string, item usage) {
+	r.used += item.size - r.items[key].size
+	r.items[key] = item
+}
+
+func (r *route) remove(key string) {
+	r.used -= r.items[key].size
+	delete(r.items, key)
+}
+
+func (r *route) dropExpired() {
+	now := r.now()
+	for key, item := range r.items {
+		if !item.expires.IsZero() && !now.Before(item.expires) {
+			r.remove(key)
+		}
+	}
+}
+
+func equal(expected, actual string) bool {
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) == 1
+}
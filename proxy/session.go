@@ -0,0 +1,531 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tscolari/memcached-broker/memcache"
+)
+
+const (
+	// maxItemSize is the largest value memcached stores by default.
+	maxItemSize = 1024 * 1024
+
+	backendTimeout = 5 * time.Second
+)
+
+var (
+	errBadFormat       = errors.New("CLIENT_ERROR bad command line format")
+	errBadDataChunk    = errors.New("CLIENT_ERROR bad data chunk")
+	errLineTooLong     = errors.New("CLIENT_ERROR line too long")
+	errUnauthenticated = errors.New("CLIENT_ERROR unauthenticated")
+	errAuthentication  = errors.New("CLIENT_ERROR authentication failure")
+	errNotAllowed      = errors.New("CLIENT_ERROR command not allowed")
+	errTooLarge        = errors.New("SERVER_ERROR object too large for cache")
+	errOutOfMemory     = errors.New("SERVER_ERROR out of memory storing object")
+	errBackend         = errors.New("SERVER_ERROR backend unavailable")
+	errUnknownCommand  = errors.New("ERROR")
+)
+
+// session relays the commands of a single client to the shared memcached,
+// over a connection of its own.
+type session struct {
+	proxy  *Proxy
+	client net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+
+	backend       net.Conn
+	backendReader *bufio.Reader
+	backendWriter *bufio.Writer
+
+	// route is nil until the client authenticated.
+	route *route
+
+	// err stops the session, once talking to the client or to memcached
+	// failed.
+	err error
+
+	closed bool
+	lock   sync.Mutex
+}
+
+// storageCommand is a parsed storage command, with its data block.
+type storageCommand struct {
+	key     string
+	flags   uint32
+	exptime int64
+	cas     uint64
+	value   []byte
+	noreply bool
+}
+
+func newSession(proxy *Proxy, client net.Conn) *session {
+	return &session{
+		proxy:  proxy,
+		client: client,
+		reader: bufio.NewReader(client),
+		writer: bufio.NewWriter(client),
+	}
+}
+
+func (s *session) run() {
+	defer s.close()
+
+	for s.err == nil {
+		line, err := s.reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			s.reply(false, errLineTooLong.Error())
+			break
+		}
+		if err != nil {
+			break
+		}
+
+		quit := s.handle(strings.Fields(string(line)))
+		if quit {
+			break
+		}
+
+		// Pipelined commands get their replies in one write.
+		if s.reader.Buffered() == 0 {
+			if err := s.writer.Flush(); err != nil {
+				break
+			}
+		}
+	}
+
+	s.writer.Flush()
+	if s.route != nil {
+		s.route.leave(s)
+	}
+}
+
+func (s *session) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+	s.client.Close()
+	if s.backend != nil {
+		s.backend.Close()
+	}
+}
+
+// handle relays a command, and tells whether the client asked to quit.
+func (s *session) handle(fields []string) bool {
+	if len(fields) == 0 {
+		s.reply(false, errUnknownCommand.Error())
+		return false
+	}
+
+	command, arguments := fields[0], fields[1:]
+
+	if s.route == nil {
+		if command != "set" {
+			s.reply(false, errUnauthenticated.Error())
+			return false
+		}
+
+		s.login(arguments)
+		return false
+	}
+
+	switch command {
+	case "get", "gets":
+		s.retrieve(command, arguments)
+	case "set", "add", "replace", "append", "prepend", "cas":
+		s.store(command, arguments)
+	case "delete":
+		s.delete(arguments)
+	case "incr", "decr":
+		s.count(command, arguments)
+	case "touch":
+		s.touch(arguments)
+	case "version":
+		s.relay("version")
+	case "quit":
+		return true
+	case "flush_all", "stats", "verbosity", "slabs", "lru", "lru_crawler", "watch",
+		"shutdown", "cache_memlimit", "misbehave", "debugtime", "mg", "ms", "md", "ma", "mn", "me":
+		// These reach past the keyspace of the instance.
+		s.reply(false, errNotAllowed.Error())
+	default:
+		s.reply(false, errUnknownCommand.Error())
+	}
+
+	return false
+}
+
+// login reads the credentials of the client from the data of a `set`, and
+// connects it to memcached.
+func (s *session) login(arguments []string) {
+	command, err := s.readStorage(arguments, false)
+	if err != nil {
+		s.reply(false, err.Error())
+		return
+	}
+
+	credentials := strings.SplitN(string(command.value), " ", 2)
+	if len(credentials) != 2 {
+		s.reply(false, errAuthentication.Error())
+		return
+	}
+
+	r, authenticated := s.proxy.authenticate(s, credentials[0], credentials[1])
+	if !authenticated {
+		s.reply(false, errAuthentication.Error())
+		return
+	}
+
+	s.route = r
+
+	backend, err := net.DialTimeout("tcp", s.proxy.config.Backend, backendTimeout)
+	if err != nil {
+		s.fail(err)
+		return
+	}
+
+	s.lock.Lock()
+	closed := s.closed
+	s.backend = backend
+	s.lock.Unlock()
+
+	if closed {
+		backend.Close()
+		s.err = errors.New("Session closed")
+		return
+	}
+
+	s.backendReader = bufio.NewReader(backend)
+	s.backendWriter = bufio.NewWriter(backend)
+	s.reply(false, "STORED")
+}
+
+func (s *session) retrieve(command string, keys []string) {
+	if len(keys) == 0 {
+		s.reply(false, errUnknownCommand.Error())
+		return
+	}
+
+	missing := map[string]bool{}
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		if !s.validKey(key) {
+			s.reply(false, errBadFormat.Error())
+			return
+		}
+
+		missing[key] = true
+		prefixed[i] = s.route.prefix + key
+	}
+
+	line, err := s.call(command+" "+strings.Join(prefixed, " "), nil)
+	if err != nil {
+		return
+	}
+
+	for strings.HasPrefix(line, "VALUE ") {
+		// VALUE <key> <flags> <bytes> [<cas unique>]
+		fields := strings.Fields(line)
+		if len(fields) < 4 || !strings.HasPrefix(fields[1], s.route.prefix) {
+			s.fail(fmt.Errorf("Unexpected reply from memcached: %s", line))
+			return
+		}
+
+		length, err := strconv.Atoi(fields[3])
+		if err != nil || length < 0 {
+			s.fail(fmt.Errorf("Unexpected reply from memcached: %s", line))
+			return
+		}
+
+		data := make([]byte, length+2)
+		_, err = io.ReadFull(s.backendReader, data)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+
+		fields[1] = strings.TrimPrefix(fields[1], s.route.prefix)
+		delete(missing, fields[1])
+
+		s.writer.WriteString(strings.Join(fields, " ") + "\r\n")
+		s.writer.Write(data)
+
+		line, err = s.readBackend()
+		if err != nil {
+			return
+		}
+	}
+
+	if line == "END" {
+		// Gone from memcached, expired or evicted.
+		for key := range missing {
+			s.route.forget(key)
+		}
+	}
+
+	s.reply(false, line)
+}
+
+func (s *session) store(name string, arguments []string) {
+	command, err := s.readStorage(arguments, name == "cas")
+	if err != nil {
+		s.reply(command.noreply, err.Error())
+		return
+	}
+
+	if !s.validKey(command.key) {
+		s.reply(command.noreply, errBadFormat.Error())
+		return
+	}
+
+	appended := name == "append" || name == "prepend"
+	size := int64(len(command.value))
+	if !appended {
+		size += int64(len(command.key))
+	}
+
+	expires := memcache.Expiry(command.exptime, s.route.now())
+	undo, fits := s.route.reserve(command.key, size, expires, appended)
+	if !fits {
+		s.reply(command.noreply, errOutOfMemory.Error())
+		return
+	}
+
+	header := fmt.Sprintf("%s %s%s %d %d %d", name, s.route.prefix, command.key, command.flags, command.exptime, len(command.value))
+	if name == "cas" {
+		header += fmt.Sprintf(" %d", command.cas)
+	}
+
+	line, err := s.call(header, command.value)
+	if err != nil || line != "STORED" {
+		undo()
+	}
+	if err != nil {
+		return
+	}
+
+	s.reply(command.noreply, line)
+}
+
+func (s *session) delete(arguments []string) {
+	arguments, noreply := stripNoreply(arguments)
+
+	// Old clients send a hold time, memcached only accepts zero.
+	if len(arguments) == 2 && arguments[1] == "0" {
+		arguments = arguments[:1]
+	}
+
+	if len(arguments) != 1 || !s.validKey(arguments[0]) {
+		s.reply(noreply, errBadFormat.Error())
+		return
+	}
+
+	line, err := s.call("delete "+s.route.prefix+arguments[0], nil)
+	if err != nil {
+		return
+	}
+
+	if line == "DELETED" || line == "NOT_FOUND" {
+		s.route.forget(arguments[0])
+	}
+
+	s.reply(noreply, line)
+}
+
+func (s *session) count(command string, arguments []string) {
+	arguments, noreply := stripNoreply(arguments)
+	if len(arguments) != 2 || !s.validKey(arguments[0]) {
+		s.reply(noreply, errBadFormat.Error())
+		return
+	}
+
+	line, err := s.call(command+" "+s.route.prefix+arguments[0]+" "+arguments[1], nil)
+	if err != nil {
+		return
+	}
+
+	if line == "NOT_FOUND" {
+		s.route.forget(arguments[0])
+	} else if _, err := strconv.ParseUint(line, 10, 64); err == nil {
+		// The reply is the new value.
+		s.route.recount(arguments[0], int64(len(arguments[0])+len(line)))
+	}
+
+	s.reply(noreply, line)
+}
+
+func (s *session) touch(arguments []string) {
+	arguments, noreply := stripNoreply(arguments)
+	if len(arguments) != 2 || !s.validKey(arguments[0]) {
+		s.reply(noreply, errBadFormat.Error())
+		return
+	}
+
+	exptime, err := strconv.ParseInt(arguments[1], 10, 64)
+	if err != nil {
+		s.reply(noreply, errBadFormat.Error())
+		return
+	}
+
+	line, err := s.call("touch "+s.route.prefix+arguments[0]+" "+arguments[1], nil)
+	if err != nil {
+		return
+	}
+
+	switch line {
+	case "TOUCHED":
+		s.route.expire(arguments[0], memcache.Expiry(exptime, s.route.now()))
+	case "NOT_FOUND":
+		s.route.forget(arguments[0])
+	}
+
+	s.reply(noreply, line)
+}
+
+// relay sends the command as it is, and its reply back.
+func (s *session) relay(command string) {
+	line, err := s.call(command, nil)
+	if err != nil {
+		return
+	}
+
+	s.reply(false, line)
+}
+
+// call sends a command to memcached, with its data block if it has one, and
+// reads the first line of the reply. The replies of the client always get
+// asked for, so the proxy knows what happened to the keyspace.
+func (s *session) call(command string, data []byte) (string, error) {
+	s.backend.SetDeadline(time.Now().Add(backendTimeout))
+
+	s.backendWriter.WriteString(command + "\r\n")
+	if data != nil {
+		s.backendWriter.Write(data)
+		s.backendWriter.WriteString("\r\n")
+	}
+
+	err := s.backendWriter.Flush()
+	if err != nil {
+		s.fail(err)
+		return "", err
+	}
+
+	return s.readBackend()
+}
+
+func (s *session) readBackend() (string, error) {
+	line, err := s.backendReader.ReadString('\n')
+	if err != nil {
+		s.fail(err)
+		return "", err
+	}
+
+	return strings.TrimSuffix(line, "\r\n"), nil
+}
+
+// readStorage parses a storage command and reads its data block. When the
+// data doesn't fit the command, it's skipped so the next command can be
+// read.
+func (s *session) readStorage(arguments []string, withCAS bool) (storageCommand, error) {
+	var command storageCommand
+	arguments, command.noreply = stripNoreply(arguments)
+
+	expected := 4
+	if withCAS {
+		expected = 5
+	}
+
+	if len(arguments) != expected {
+		return command, errBadFormat
+	}
+
+	length, err := strconv.Atoi(arguments[3])
+	if err != nil || length < 0 {
+		return command, errBadFormat
+	}
+
+	command.key = arguments[0]
+	flags, flagsErr := strconv.ParseUint(arguments[1], 10, 32)
+	exptime, exptimeErr := strconv.ParseInt(arguments[2], 10, 64)
+
+	var casErr error
+	if withCAS {
+		command.cas, casErr = strconv.ParseUint(arguments[4], 10, 64)
+	}
+
+	if len(command.key) > memcache.MaxKeyLength || flagsErr != nil || exptimeErr != nil || casErr != nil {
+		s.skip(length + 2)
+		return command, errBadFormat
+	}
+
+	if length > maxItemSize {
+		s.skip(length + 2)
+		return command, errTooLarge
+	}
+
+	command.flags = uint32(flags)
+	command.exptime = exptime
+
+	data := make([]byte, length+2)
+	_, err = io.ReadFull(s.reader, data)
+	if err != nil {
+		s.err = err
+		return command, err
+	}
+
+	if !bytes.HasSuffix(data, []byte("\r\n")) {
+		return command, errBadDataChunk
+	}
+
+	command.value = data[:length]
+	return command, nil
+}
+
+func (s *session) skip(length int) {
+	_, err := io.CopyN(ioutil.Discard, s.reader, int64(length))
+	if err != nil {
+		s.err = err
+	}
+}
+
+// validKey tells whether the key is still valid with the prefix of the
+// instance.
+func (s *session) validKey(key string) bool {
+	return len(key) > 0 && len(s.route.prefix)+len(key) <= memcache.MaxKeyLength
+}
+
+// fail tells the client memcached can't be reached, and ends the session.
+func (s *session) fail(err error) {
+	s.reply(false, errBackend.Error())
+	s.err = err
+}
+
+func (s *session) reply(noreply bool, line string) {
+	if noreply || s.err != nil {
+		return
+	}
+
+	_, err := s.writer.WriteString(line + "\r\n")
+	if err != nil {
+		s.err = err
+	}
+}
+
+func stripNoreply(arguments []string) ([]string, bool) {
+	if last := len(arguments) - 1; last >= 0 && arguments[last] == "noreply" {
+		return arguments[:last], true
+	}
+
+	return arguments, false
+}
@@ -0,0 +1,466 @@
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tscolari/cf-broker-api/common/repository"
+)
+
+const (
+	DefaultBinary       = "memcached"
+	DefaultMemory       = 64
+	DefaultRestartDelay = time.Second
+	DefaultPollInterval = time.Second
+	DefaultStopTimeout  = 10 * time.Second
+)
+
+// ErrOverflow is returned by Resize when the instance stores more than the
+// memory of its new plan.
+var ErrOverflow = errors.New("The instance stores more than its new plan allows")
+
+//go:generate counterfeiter . Runner
+
+// Runner keeps a memcached running for each instance.
+type Runner interface {
+	Start(instance repository.Instance) error
+	Stop(instanceID string) error
+
+	// Resize serves the instance with the memory of its plan. On failure
+	// the instance keeps being served as before.
+	Resize(instance repository.Instance) error
+}
+
+// Config is the configuration of a Supervisor.
+type Config struct {
+	// Binary is the memcached executable.
+	Binary string `yaml:"binary"`
+
+	// Directory holds a pid file per instance, used to find the processes
+	// again after a restart of the broker.
+	Directory string `yaml:"directory"`
+
+	// User is the user memcached drops privileges to, when started as root.
+	User string `yaml:"user"`
+
+	// RestartOnRevoke restarts the memcached of an instance when a user is
+	// revoked, to drop the connections it authenticated before. memcached
+	// can't drop those of a single user, so the restart flushes every item
+	// of the instance and disconnects the other bindings too. Without it, a
+	// revoked user can't authenticate again, but stays connected.
+	RestartOnRevoke bool `yaml:"restart_on_revoke"`
+}
+
+func NewSupervisor(config Config, memory map[string]int, authFile func(instanceID string) string) (*Supervisor, error) {
+	if config.Binary == "" {
+		config.Binary = DefaultBinary
+	}
+
+	err := os.MkdirAll(config.Directory, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Supervisor{
+		RestartDelay: DefaultRestartDelay,
+		PollInterval: DefaultPollInterval,
+		StopTimeout:  DefaultStopTimeout,
+
+		config:    config,
+		memory:    memory,
+		authFile:  authFile,
+		processes: map[string]*process{},
+	}, nil
+}
+
+// Supervisor runs a memcached process per instance, listening on the host
+// and port of the instance, with as many megabytes of memory as the size of
+// its plan. A process that exits is started again after RestartDelay.
+//
+// With authFile, memcached authenticates text protocol clients against the
+// users in the auth file of the instance (`-Y`), which it reads again on
+// Reload.
+//
+// The processes run in their own process group, so they keep serving while
+// the broker restarts. Recover picks them up again from their pid files.
+type Supervisor struct {
+	RestartDelay time.Duration
+	PollInterval time.Duration
+	StopTimeout  time.Duration
+
+	config    Config
+	memory    map[string]int
+	authFile  func(instanceID string) string
+	processes map[string]*process
+	lock      sync.Mutex
+}
+
+type process struct {
+	instance repository.Instance
+	pid      int
+	wait     func()
+	stopping bool
+	stopped  chan struct{}
+	done     chan struct{}
+	lock     sync.Mutex
+}
+
+// Start launches the memcached of the instance, unless it's running
+// already.
+func (s *Supervisor) Start(instance repository.Instance) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, running := s.processes[instance.ID]; running {
+		return nil
+	}
+
+	return s.launch(instance)
+}
+
+// Resize restarts the memcached of the instance with the memory of its
+// plan, or starts it when it isn't running. memcached keeps its items in
+// memory only, so they are gone after the restart and never overflow the
+// new limit. There is no restart when the memory stays the same. When the
+// new memcached can't be started, the one with the memory of the previous
+// plan is started again.
+func (s *Supervisor) Resize(instance repository.Instance) error {
+	s.lock.Lock()
+	p, running := s.processes[instance.ID]
+	s.lock.Unlock()
+
+	var previous repository.Instance
+	if running {
+		p.lock.Lock()
+		previous = p.instance
+		unchanged := s.memoryOf(p.instance.PlanID) == s.memoryOf(instance.PlanID)
+		if unchanged {
+			p.instance = instance
+		}
+		p.lock.Unlock()
+
+		if unchanged {
+			return nil
+		}
+	}
+
+	err := s.Stop(instance.ID)
+	if err != nil {
+		return err
+	}
+
+	err = s.Start(instance)
+	if err != nil && running {
+		s.Start(previous)
+	}
+
+	return err
+}
+
+// Reload has the memcached of the instance read its auth file again, with
+// a SIGHUP.
+func (s *Supervisor) Reload(instanceID string) error {
+	pid, running := s.Pid(instanceID)
+	if !running {
+		return nil
+	}
+
+	err := syscall.Kill(pid, syscall.SIGHUP)
+	if err != nil && err != syscall.ESRCH {
+		return err
+	}
+
+	return nil
+}
+
+// Disconnect restarts the memcached of the instance with RestartOnRevoke,
+// as it can't drop the connections of a single user. Like on Resize, its
+// items are gone after the restart. Otherwise it does nothing, Reload
+// already keeps the user from authenticating again.
+func (s *Supervisor) Disconnect(instanceID, username string) error {
+	if !s.config.RestartOnRevoke {
+		return nil
+	}
+
+	s.lock.Lock()
+	p, running := s.processes[instanceID]
+	s.lock.Unlock()
+
+	if !running {
+		return nil
+	}
+
+	p.lock.Lock()
+	instance := p.instance
+	p.lock.Unlock()
+
+	err := s.Stop(instanceID)
+	if err != nil {
+		return err
+	}
+
+	return s.Start(instance)
+}
+
+// Recover supervises the memcached of each instance again, reattaching to
+// the processes that are still running and launching the others.
+func (s *Supervisor) Recover(instances []repository.Instance) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, instance := range instances {
+		if _, running := s.processes[instance.ID]; running {
+			continue
+		}
+
+		pid, alive := s.runningPid(instance.ID)
+		if !alive {
+			if err := s.launch(instance); err != nil {
+				return err
+			}
+			continue
+		}
+
+		p := &process{
+			instance: instance,
+			pid:      pid,
+			wait:     s.poll(pid),
+			stopped:  make(chan struct{}),
+			done:     make(chan struct{}),
+		}
+
+		s.processes[instance.ID] = p
+		go s.supervise(p)
+	}
+
+	return nil
+}
+
+// Stop terminates the memcached of the instance and stops supervising it.
+func (s *Supervisor) Stop(instanceID string) error {
+	s.lock.Lock()
+	p, running := s.processes[instanceID]
+	delete(s.processes, instanceID)
+	s.lock.Unlock()
+
+	if !running {
+		// Left behind by an earlier run of the broker.
+		if pid, alive := s.runningPid(instanceID); alive {
+			syscall.Kill(pid, syscall.SIGTERM)
+		}
+
+		return s.removePidFile(instanceID)
+	}
+
+	p.lock.Lock()
+	p.stopping = true
+	close(p.stopped)
+	pid := p.pid
+	p.lock.Unlock()
+
+	if pid != 0 {
+		err := syscall.Kill(pid, syscall.SIGTERM)
+		if err != nil && err != syscall.ESRCH {
+			return err
+		}
+	}
+
+	select {
+	case <-p.done:
+	case <-time.After(s.StopTimeout):
+		p.lock.Lock()
+		pid = p.pid
+		p.lock.Unlock()
+
+		syscall.Kill(pid, syscall.SIGKILL)
+		<-p.done
+	}
+
+	return s.removePidFile(instanceID)
+}
+
+// Pid returns the process id of the memcached of the instance.
+func (s *Supervisor) Pid(instanceID string) (int, bool) {
+	s.lock.Lock()
+	p, running := s.processes[instanceID]
+	s.lock.Unlock()
+
+	if !running {
+		return 0, false
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.pid, p.pid != 0
+}
+
+// launch must be called with the lock held.
+func (s *Supervisor) launch(instance repository.Instance) error {
+	p := &process{
+		instance: instance,
+		stopped:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	err := s.run(p)
+	if err != nil {
+		return err
+	}
+
+	s.processes[instance.ID] = p
+	go s.supervise(p)
+	return nil
+}
+
+// supervise waits for the process to exit and starts it again, until the
+// instance is stopped.
+func (s *Supervisor) supervise(p *process) {
+	defer close(p.done)
+
+	for {
+		p.wait()
+
+		select {
+		case <-p.stopped:
+			return
+		case <-time.After(s.RestartDelay):
+		}
+
+		p.lock.Lock()
+		if p.stopping {
+			p.lock.Unlock()
+			return
+		}
+
+		err := s.run(p)
+		if err != nil {
+			// Try again after the next delay.
+			p.pid = 0
+			p.wait = func() {}
+		}
+		p.lock.Unlock()
+	}
+}
+
+// run starts the memcached process of p.
+func (s *Supervisor) run(p *process) error {
+	if s.authFile != nil {
+		// memcached doesn't start without its auth file, which an instance
+		// without bindings doesn't have yet.
+		file, err := os.OpenFile(s.authFile(p.instance.ID), os.O_RDONLY|os.O_CREATE, 0600)
+		if err != nil {
+			return fmt.Errorf("Failed to create the auth file of %s: %s", p.instance.ID, err.Error())
+		}
+		file.Close()
+	}
+
+	cmd := exec.Command(s.config.Binary, s.arguments(p.instance)...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	err := cmd.Start()
+	if err != nil {
+		return fmt.Errorf("Failed to start memcached for %s: %s", p.instance.ID, err.Error())
+	}
+
+	err = ioutil.WriteFile(s.pidFile(p.instance.ID), []byte(strconv.Itoa(cmd.Process.Pid)), 0600)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+
+	p.pid = cmd.Process.Pid
+	p.wait = func() { cmd.Wait() }
+	return nil
+}
+
+func (s *Supervisor) arguments(instance repository.Instance) []string {
+	arguments := []string{
+		"-p", instance.Port,
+		"-U", "0",
+		"-m", strconv.Itoa(s.memoryOf(instance.PlanID)),
+	}
+
+	if instance.Host != "" {
+		arguments = append(arguments, "-l", instance.Host)
+	}
+
+	if s.authFile != nil {
+		arguments = append(arguments, "-Y", s.authFile(instance.ID))
+	}
+
+	if s.config.User != "" {
+		arguments = append(arguments, "-u", s.config.User)
+	}
+
+	return arguments
+}
+
+// memoryOf returns the megabytes of memory of the plan.
+func (s *Supervisor) memoryOf(planID string) int {
+	memory, exists := s.memory[planID]
+	if !exists || memory <= 0 {
+		return DefaultMemory
+	}
+
+	return memory
+}
+
+// poll waits for a process the broker didn't start, and so can't wait for.
+func (s *Supervisor) poll(pid int) func() {
+	return func() {
+		for processAlive(pid) {
+			time.Sleep(s.PollInterval)
+		}
+	}
+}
+
+// runningPid reads the pid file of the instance, and tells whether that
+// process still is the memcached of the instance.
+func (s *Supervisor) runningPid(instanceID string) (int, bool) {
+	rawData, err := ioutil.ReadFile(s.pidFile(instanceID))
+	if err != nil {
+		return 0, false
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(rawData)))
+	if err != nil || pid <= 0 || !processAlive(pid) {
+		return 0, false
+	}
+
+	// The pid might have been reused by an unrelated process since.
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err == nil && !strings.Contains(string(cmdline), filepath.Base(s.config.Binary)) {
+		return 0, false
+	}
+
+	return pid, true
+}
+
+func (s *Supervisor) pidFile(instanceID string) string {
+	return filepath.Join(s.config.Directory, instanceID+".pid")
+}
+
+func (s *Supervisor) removePidFile(instanceID string) error {
+	err := os.Remove(s.pidFile(instanceID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,414 @@
+package runner_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/tscolari/cf-broker-api/common/repository"
+	"github.com/tscolari/memcached-broker/runner"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Supervisor", func() {
+	var directory string
+	var outputDirectory string
+	var config runner.Config
+	var supervisor *runner.Supervisor
+	var instance repository.Instance
+	var failingLaunches int
+
+	newSupervisor := func() *runner.Supervisor {
+		newSupervisor, err := runner.NewSupervisor(config, map[string]int{"plan-1": 128}, func(instanceID string) string {
+			if failingLaunches > 0 {
+				// The auth file can't be created, so the launch fails.
+				failingLaunches--
+				return filepath.Join(directory, "not-here", instanceID+".pwdb")
+			}
+
+			return filepath.Join(directory, instanceID+".pwdb")
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		newSupervisor.RestartDelay = 10 * time.Millisecond
+		newSupervisor.PollInterval = 10 * time.Millisecond
+		newSupervisor.StopTimeout = time.Second
+		return newSupervisor
+	}
+
+	pidOf := func(instanceID string) int {
+		pid, running := supervisor.Pid(instanceID)
+		Expect(running).To(BeTrue())
+		return pid
+	}
+
+	argumentsOf := func(pid int) string {
+		var rawData []byte
+		Eventually(func() error {
+			var err error
+			rawData, err = ioutil.ReadFile(filepath.Join(outputDirectory, fmt.Sprintf("%d.args", pid)))
+			return err
+		}).Should(Succeed())
+
+		return strings.TrimSpace(string(rawData))
+	}
+
+	alive := func(pid int) func() bool {
+		return func() bool {
+			return syscall.Kill(pid, 0) == nil
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		directory, err = ioutil.TempDir("/tmp/", "runner")
+		Expect(err).ToNot(HaveOccurred())
+
+		outputDirectory = filepath.Join(directory, "output")
+		Expect(os.Mkdir(outputDirectory, 0700)).To(Succeed())
+		os.Setenv("FAKE_MEMCACHED_OUTPUT", outputDirectory)
+
+		binary, err := filepath.Abs("./assets/fake_memcached")
+		Expect(err).ToNot(HaveOccurred())
+
+		config = runner.Config{
+			Binary:    binary,
+			Directory: filepath.Join(directory, "pids"),
+		}
+
+		failingLaunches = 0
+		instance = repository.Instance{
+			ID:     "instance-1",
+			PlanID: "plan-1",
+			Host:   "127.0.0.1",
+			Port:   "11311",
+		}
+
+		supervisor = newSupervisor()
+	})
+
+	AfterEach(func() {
+		supervisor.Stop("instance-1")
+		os.RemoveAll(directory)
+	})
+
+	Describe("Start", func() {
+		BeforeEach(func() {
+			Expect(supervisor.Start(instance)).To(Succeed())
+		})
+
+		It("starts memcached on the address of the instance", func() {
+			authFile := filepath.Join(directory, "instance-1.pwdb")
+			Expect(argumentsOf(pidOf("instance-1"))).To(Equal("-p 11311 -U 0 -m 128 -l 127.0.0.1 -Y " + authFile))
+		})
+
+		It("creates an empty auth file for the instance", func() {
+			rawData, err := ioutil.ReadFile(filepath.Join(directory, "instance-1.pwdb"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rawData).To(BeEmpty())
+		})
+
+		It("keeps the auth file of the instance", func() {
+			Expect(supervisor.Stop("instance-1")).To(Succeed())
+
+			authFile := filepath.Join(directory, "instance-1.pwdb")
+			Expect(ioutil.WriteFile(authFile, []byte("user:secret\n"), 0600)).To(Succeed())
+			Expect(supervisor.Start(instance)).To(Succeed())
+			argumentsOf(pidOf("instance-1"))
+
+			rawData, err := ioutil.ReadFile(authFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(rawData)).To(Equal("user:secret\n"))
+		})
+
+		It("writes a pid file", func() {
+			rawData, err := ioutil.ReadFile(filepath.Join(config.Directory, "instance-1.pid"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(rawData)).To(Equal(strconv.Itoa(pidOf("instance-1"))))
+		})
+
+		It("doesn't start a second process for the same instance", func() {
+			pid := pidOf("instance-1")
+			Expect(supervisor.Start(instance)).To(Succeed())
+			Expect(pidOf("instance-1")).To(Equal(pid))
+		})
+
+		It("starts the process again when it exits", func() {
+			pid := pidOf("instance-1")
+			Expect(syscall.Kill(pid, syscall.SIGKILL)).To(Succeed())
+
+			Eventually(func() int {
+				newPid, _ := supervisor.Pid("instance-1")
+				return newPid
+			}).ShouldNot(Or(Equal(pid), Equal(0)))
+
+			Eventually(alive(pidOf("instance-1"))).Should(BeTrue())
+		})
+	})
+
+	Context("when the plan has no size", func() {
+		It("uses the default memory limit", func() {
+			instance.PlanID = "other-plan"
+			Expect(supervisor.Start(instance)).To(Succeed())
+
+			Expect(argumentsOf(pidOf("instance-1"))).To(ContainSubstring("-m 64"))
+		})
+	})
+
+	Context("when a user is configured", func() {
+		It("tells memcached to run as that user", func() {
+			config.User = "vcap"
+			supervisor = newSupervisor()
+			Expect(supervisor.Start(instance)).To(Succeed())
+
+			Expect(argumentsOf(pidOf("instance-1"))).To(HaveSuffix("-u vcap"))
+		})
+	})
+
+	Context("when the binary can't be started", func() {
+		It("fails", func() {
+			config.Binary = filepath.Join(directory, "not-here")
+			supervisor = newSupervisor()
+
+			err := supervisor.Start(instance)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Failed to start memcached for instance-1"))
+
+			_, running := supervisor.Pid("instance-1")
+			Expect(running).To(BeFalse())
+		})
+	})
+
+	Describe("Stop", func() {
+		var pid int
+
+		BeforeEach(func() {
+			Expect(supervisor.Start(instance)).To(Succeed())
+			pid = pidOf("instance-1")
+			argumentsOf(pid)
+		})
+
+		It("terminates the process", func() {
+			Expect(supervisor.Stop("instance-1")).To(Succeed())
+			Eventually(alive(pid)).Should(BeFalse())
+		})
+
+		It("doesn't start it again", func() {
+			Expect(supervisor.Stop("instance-1")).To(Succeed())
+
+			Consistently(func() bool {
+				_, running := supervisor.Pid("instance-1")
+				return running
+			}, 100*time.Millisecond).Should(BeFalse())
+
+			files, err := ioutil.ReadDir(outputDirectory)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).To(HaveLen(1))
+		})
+
+		It("removes the pid file", func() {
+			Expect(supervisor.Stop("instance-1")).To(Succeed())
+
+			_, err := os.Stat(filepath.Join(config.Directory, "instance-1.pid"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		Context("when the instance isn't running", func() {
+			It("succeeds", func() {
+				Expect(supervisor.Stop("instance-2")).To(Succeed())
+			})
+		})
+	})
+
+	Describe("Resize", func() {
+		var pid int
+
+		BeforeEach(func() {
+			Expect(supervisor.Start(instance)).To(Succeed())
+			pid = pidOf("instance-1")
+			argumentsOf(pid)
+		})
+
+		It("restarts memcached with the memory of the new plan", func() {
+			instance.PlanID = "other-plan"
+			Expect(supervisor.Resize(instance)).To(Succeed())
+
+			Eventually(alive(pid)).Should(BeFalse())
+			Expect(pidOf("instance-1")).ToNot(Equal(pid))
+			Expect(argumentsOf(pidOf("instance-1"))).To(ContainSubstring("-m 64"))
+		})
+
+		Context("when memcached can't be started with the new plan", func() {
+			It("fails and starts it again with the previous plan", func() {
+				instance.PlanID = "other-plan"
+				failingLaunches = 1
+
+				err := supervisor.Resize(instance)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("Failed to create the auth file of instance-1"))
+
+				Eventually(alive(pid)).Should(BeFalse())
+				Expect(pidOf("instance-1")).ToNot(Equal(pid))
+				Expect(argumentsOf(pidOf("instance-1"))).To(ContainSubstring("-m 128"))
+			})
+		})
+
+		Context("when the memory stays the same", func() {
+			It("doesn't restart memcached", func() {
+				Expect(supervisor.Resize(instance)).To(Succeed())
+				Expect(pidOf("instance-1")).To(Equal(pid))
+			})
+		})
+
+		Context("when the instance isn't running", func() {
+			It("starts it", func() {
+				instance.ID = "instance-2"
+				instance.Port = "11312"
+				Expect(supervisor.Resize(instance)).To(Succeed())
+				defer supervisor.Stop("instance-2")
+
+				Expect(argumentsOf(pidOf("instance-2"))).To(ContainSubstring("-m 128"))
+			})
+		})
+	})
+
+	Describe("Reload", func() {
+		It("tells memcached to read its auth file again", func() {
+			Expect(supervisor.Start(instance)).To(Succeed())
+			pid := pidOf("instance-1")
+			argumentsOf(pid)
+
+			Expect(supervisor.Reload("instance-1")).To(Succeed())
+
+			Eventually(func() error {
+				_, err := os.Stat(filepath.Join(outputDirectory, fmt.Sprintf("%d.reloaded", pid)))
+				return err
+			}).Should(Succeed())
+			Expect(pidOf("instance-1")).To(Equal(pid))
+		})
+
+		Context("when the instance isn't running", func() {
+			It("succeeds", func() {
+				Expect(supervisor.Reload("instance-2")).To(Succeed())
+			})
+		})
+	})
+
+	Describe("Disconnect", func() {
+		var pid int
+
+		BeforeEach(func() {
+			Expect(supervisor.Start(instance)).To(Succeed())
+			pid = pidOf("instance-1")
+			argumentsOf(pid)
+		})
+
+		It("doesn't restart memcached", func() {
+			Expect(supervisor.Disconnect("instance-1", "user")).To(Succeed())
+
+			Consistently(alive(pid), 100*time.Millisecond).Should(BeTrue())
+			Expect(pidOf("instance-1")).To(Equal(pid))
+		})
+
+		Context("when restarting on revoke", func() {
+			BeforeEach(func() {
+				Expect(supervisor.Stop("instance-1")).To(Succeed())
+
+				config.RestartOnRevoke = true
+				supervisor = newSupervisor()
+				Expect(supervisor.Start(instance)).To(Succeed())
+				pid = pidOf("instance-1")
+				argumentsOf(pid)
+			})
+
+			It("restarts memcached, dropping every connection", func() {
+				Expect(supervisor.Disconnect("instance-1", "user")).To(Succeed())
+
+				Eventually(alive(pid)).Should(BeFalse())
+				Expect(pidOf("instance-1")).ToNot(Equal(pid))
+				Expect(argumentsOf(pidOf("instance-1"))).To(ContainSubstring("-p 11311"))
+			})
+		})
+
+		Context("when the instance isn't running", func() {
+			It("succeeds without starting it", func() {
+				Expect(supervisor.Disconnect("instance-2", "user")).To(Succeed())
+
+				_, running := supervisor.Pid("instance-2")
+				Expect(running).To(BeFalse())
+			})
+		})
+	})
+
+	Describe("Recover", func() {
+		var orphan *exec.Cmd
+
+		// startOrphan starts memcached the way an earlier run of the broker
+		// left it behind.
+		startOrphan := func() int {
+			orphan = exec.Command(config.Binary, "-p", instance.Port)
+			Expect(orphan.Start()).To(Succeed())
+			go orphan.Wait()
+
+			pidFile := filepath.Join(config.Directory, "instance-1.pid")
+			Expect(ioutil.WriteFile(pidFile, []byte(strconv.Itoa(orphan.Process.Pid)), 0600)).To(Succeed())
+			argumentsOf(orphan.Process.Pid)
+			return orphan.Process.Pid
+		}
+
+		Context("when the process is still running", func() {
+			var pid int
+
+			BeforeEach(func() {
+				pid = startOrphan()
+				Expect(supervisor.Recover([]repository.Instance{instance})).To(Succeed())
+			})
+
+			It("reattaches to it", func() {
+				Expect(pidOf("instance-1")).To(Equal(pid))
+			})
+
+			It("starts it again when it exits", func() {
+				Expect(syscall.Kill(pid, syscall.SIGKILL)).To(Succeed())
+
+				Eventually(func() int {
+					newPid, _ := supervisor.Pid("instance-1")
+					return newPid
+				}).ShouldNot(Or(Equal(pid), Equal(0)))
+			})
+
+			It("can stop it", func() {
+				Expect(supervisor.Stop("instance-1")).To(Succeed())
+				Eventually(alive(pid)).Should(BeFalse())
+			})
+		})
+
+		Context("when the process is gone", func() {
+			BeforeEach(func() {
+				pid := startOrphan()
+				Expect(orphan.Process.Kill()).To(Succeed())
+				Eventually(alive(pid)).Should(BeFalse())
+			})
+
+			It("launches it from the state", func() {
+				Expect(supervisor.Recover([]repository.Instance{instance})).To(Succeed())
+				Expect(argumentsOf(pidOf("instance-1"))).To(HavePrefix("-p 11311"))
+			})
+		})
+
+		Context("when there is no pid file", func() {
+			It("launches the process", func() {
+				Expect(supervisor.Recover([]repository.Instance{instance})).To(Succeed())
+				Eventually(alive(pidOf("instance-1"))).Should(BeTrue())
+			})
+		})
+	})
+})
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic replaces the file at location with data in a way that
+// survives crashes: the data is written and synced to a temporary file in the
+// same directory, which is then renamed over the original. Before the rename
+// the current file is hard linked to backupLocation (when given), so the
+// last good generation is kept around.
+func writeFileAtomic(location, backupLocation string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(location)
+
+	tempFile, err := ioutil.TempFile(dir, filepath.Base(location)+".tmp")
+	if err != nil {
+		return err
+	}
+	tempName := tempFile.Name()
+
+	if err := writeAndSync(tempFile, data, perm); err != nil {
+		os.Remove(tempName)
+		return err
+	}
+
+	if backupLocation != "" {
+		if err := linkBackup(location, backupLocation); err != nil {
+			os.Remove(tempName)
+			return err
+		}
+	}
+
+	if err := os.Rename(tempName, location); err != nil {
+		os.Remove(tempName)
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+func writeAndSync(file *os.File, data []byte, perm os.FileMode) error {
+	defer file.Close()
+
+	if err := file.Chmod(perm); err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+func linkBackup(location, backupLocation string) error {
+	if _, err := os.Stat(location); os.IsNotExist(err) {
+		return nil
+	}
+
+	if err := os.Remove(backupLocation); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.Link(location, backupLocation)
+}
+
+func syncDir(dir string) error {
+	directory, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer directory.Close()
+
+	return directory.Sync()
+}
@@ -0,0 +1,22 @@
+package storage
+
+// Binding is what the broker keeps about a binding, next to its ID in the
+// instance.
+type Binding struct {
+	ID          string      `yaml:"id" json:"id"`
+	InstanceID  string      `yaml:"instance_id" json:"instance_id"`
+	Credentials Credentials `yaml:"credentials" json:"credentials"`
+
+	// The attributes the binding was requested with. Parameters are encoded
+	// as JSON.
+	ServiceID  string `yaml:"service_id,omitempty" json:"service_id,omitempty"`
+	PlanID     string `yaml:"plan_id,omitempty" json:"plan_id,omitempty"`
+	AppGUID    string `yaml:"app_guid,omitempty" json:"app_guid,omitempty"`
+	Parameters string `yaml:"parameters,omitempty" json:"parameters,omitempty"`
+}
+
+// Credentials are issued to a binding for the instance it is bound to.
+type Credentials struct {
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"password"`
+}
@@ -0,0 +1,675 @@
+package storage
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+
+	"github.com/tscolari/cf-broker-api/common/repository"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	instancesBucket         = []byte("instances")
+	chargesBucket           = []byte("charges")
+	bindingsBucket          = []byte("bindings")
+	parametersBucket        = []byte("parameters")
+	operationsBucket        = []byte("operations")
+	bindingOperationsBucket = []byte("binding_operations")
+	metaBucket              = []byte("meta")
+	capacityKey             = []byte("capacity")
+)
+
+func init() {
+	Register("bolt", func(config Config) (Storage, error) {
+		return NewBolt(config.Path, config.Capacity, config.options()...)
+	})
+}
+
+func NewBolt(location string, capacity int, opts ...Option) (*Bolt, error) {
+	db, err := openBoltDB(location)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, bucket := range [][]byte{instancesBucket, chargesBucket, bindingsBucket, parametersBucket, operationsBucket, bindingOperationsBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		closeBoltDB(location)
+		return nil, err
+	}
+
+	return &Bolt{
+		location: location,
+		capacity: capacity,
+		options:  newOptions(opts),
+		db:       db,
+	}, nil
+}
+
+// Bolt keeps the instances in an embedded B+tree database. Every method runs
+// in its own transaction, so changes are durable once they return and
+// concurrent callers never see a half applied change.
+//
+// The capacity given to NewBolt is only used until the first change is
+// written, from then on the stored one is used.
+type Bolt struct {
+	location string
+	capacity int
+	options  options
+	db       *bbolt.DB
+}
+
+func (b *Bolt) AvailableInstances() int {
+	var capacity int
+	b.db.View(func(tx *bbolt.Tx) error {
+		capacity = b.readCapacity(tx)
+		return nil
+	})
+
+	return capacity
+}
+
+// AvailablePlanInstances returns how many more instances of the plan fit in
+// the remaining capacity.
+func (b *Bolt) AvailablePlanInstances(planID string) int {
+	return b.options.availablePlanInstances(b.AvailableInstances(), planID)
+}
+
+// PlanChangeFits tells whether the remaining capacity, with what the
+// instance was charged, covers moving the instance to the plan.
+func (b *Bolt) PlanChangeFits(instanceID, planID string) bool {
+	fits := false
+	b.db.View(func(tx *bbolt.Tx) error {
+		if _, err := readInstance(tx, instanceID); err != nil {
+			return err
+		}
+
+		difference := b.options.planSize(planID) - readCharge(tx, instanceID)
+		fits = difference <= b.readCapacity(tx)
+		return nil
+	})
+
+	return fits
+}
+
+func (b *Bolt) InstanceExists(instanceID string) bool {
+	_, err := b.Instance(instanceID)
+	return err == nil
+}
+
+func (b *Bolt) Instance(instanceID string) (*repository.Instance, error) {
+	var instance *repository.Instance
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		instance, err = readInstance(tx, instanceID)
+		return err
+	})
+
+	return instance, err
+}
+
+func (b *Bolt) Instances() ([]repository.Instance, error) {
+	var instances []repository.Instance
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		instances, err = readInstances(tx)
+		return err
+	})
+
+	return instances, err
+}
+
+func (b *Bolt) AddInstance(instance repository.Instance) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		size := b.options.planSize(instance.PlanID)
+		capacity := b.readCapacity(tx)
+		if capacity < size || capacity <= 0 {
+			return ErrNoCapacity
+		}
+
+		if _, err := readInstance(tx, instance.ID); err == nil {
+			return errInstanceIDTaken
+		}
+
+		if err := checkBoltAddress(tx, instance); err != nil {
+			return err
+		}
+
+		err := writeCapacity(tx, capacity-size)
+		if err != nil {
+			return err
+		}
+
+		err = writeCharge(tx, instance.ID, size)
+		if err != nil {
+			return err
+		}
+
+		return writeInstance(tx, instance)
+	})
+}
+
+func (b *Bolt) UpdateInstance(instance repository.Instance) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		if _, err := readInstance(tx, instance.ID); err != nil {
+			return err
+		}
+
+		if err := checkBoltAddress(tx, instance); err != nil {
+			return err
+		}
+
+		size := b.options.planSize(instance.PlanID)
+		capacity := b.readCapacity(tx)
+		difference := size - readCharge(tx, instance.ID)
+		if difference > capacity {
+			return ErrNoCapacity
+		}
+
+		err := writeCapacity(tx, capacity-difference)
+		if err != nil {
+			return err
+		}
+
+		err = writeCharge(tx, instance.ID, size)
+		if err != nil {
+			return err
+		}
+
+		err = pruneBindings(tx, instance)
+		if err != nil {
+			return err
+		}
+
+		return writeInstance(tx, instance)
+	})
+}
+
+func (b *Bolt) DeleteInstance(instanceID string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		if _, err := readInstance(tx, instanceID); err != nil {
+			return err
+		}
+
+		err := writeCapacity(tx, b.readCapacity(tx)+readCharge(tx, instanceID))
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(chargesBucket).Delete([]byte(instanceID))
+		if err != nil {
+			return err
+		}
+
+		for _, bucket := range [][]byte{bindingsBucket, bindingOperationsBucket} {
+			err = tx.Bucket(bucket).DeleteBucket([]byte(instanceID))
+			if err != nil && err != bbolt.ErrBucketNotFound {
+				return err
+			}
+		}
+
+		for _, bucket := range [][]byte{parametersBucket, operationsBucket} {
+			err = tx.Bucket(bucket).Delete([]byte(instanceID))
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket(instancesBucket).Delete([]byte(instanceID))
+	})
+}
+
+func (b *Bolt) InstanceParameters(instanceID string) (string, error) {
+	var parameters string
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		if _, err := readInstance(tx, instanceID); err != nil {
+			return err
+		}
+
+		parameters = string(tx.Bucket(parametersBucket).Get([]byte(instanceID)))
+		return nil
+	})
+
+	return parameters, err
+}
+
+func (b *Bolt) SaveInstanceParameters(instanceID, parameters string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		if _, err := readInstance(tx, instanceID); err != nil {
+			return err
+		}
+
+		if parameters == "" {
+			return tx.Bucket(parametersBucket).Delete([]byte(instanceID))
+		}
+
+		return tx.Bucket(parametersBucket).Put([]byte(instanceID), []byte(parameters))
+	})
+}
+
+func (b *Bolt) InstanceBindingExists(instanceID, bindingID string) bool {
+	instance, err := b.Instance(instanceID)
+	if err != nil {
+		return false
+	}
+
+	for _, binding := range instance.Bindings {
+		if binding == bindingID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (b *Bolt) AddInstanceBinding(instanceID, bindingID string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return addBoltInstanceBinding(tx, instanceID, bindingID)
+	})
+}
+
+func (b *Bolt) Binding(instanceID, bindingID string) (*Binding, error) {
+	var binding *Binding
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		err := checkBoltBinding(tx, instanceID, bindingID)
+		if err != nil {
+			return err
+		}
+
+		binding, err = readBinding(tx, instanceID, bindingID)
+		return err
+	})
+
+	return binding, err
+}
+
+func (b *Bolt) AddBinding(binding Binding) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		err := addBoltInstanceBinding(tx, binding.InstanceID, binding.ID)
+		if err != nil {
+			return err
+		}
+
+		return writeBinding(tx, binding)
+	})
+}
+
+func (b *Bolt) DeleteInstanceBinding(instanceID, bindingID string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		instance, err := readInstance(tx, instanceID)
+		if err != nil {
+			return err
+		}
+
+		for i, binding := range instance.Bindings {
+			if binding == bindingID {
+				instance.Bindings = append(instance.Bindings[:i], instance.Bindings[i+1:]...)
+				if err := deleteBinding(tx, instanceID, bindingID); err != nil {
+					return err
+				}
+
+				return writeInstance(tx, *instance)
+			}
+		}
+
+		return errBindingNotFound
+	})
+}
+
+func (b *Bolt) Operation(instanceID string) (*Operation, error) {
+	var operation Operation
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		if _, err := readInstance(tx, instanceID); err != nil {
+			return err
+		}
+
+		rawData := tx.Bucket(operationsBucket).Get([]byte(instanceID))
+		if rawData == nil {
+			return errOperationNotFound
+		}
+
+		return json.Unmarshal(rawData, &operation)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &operation, nil
+}
+
+func (b *Bolt) BindingOperation(instanceID, bindingID string) (*Operation, error) {
+	var operation Operation
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		if err := checkBoltBinding(tx, instanceID, bindingID); err != nil {
+			return err
+		}
+
+		instanceOperations := tx.Bucket(bindingOperationsBucket).Bucket([]byte(instanceID))
+		if instanceOperations == nil {
+			return errOperationNotFound
+		}
+
+		rawData := instanceOperations.Get([]byte(bindingID))
+		if rawData == nil {
+			return errOperationNotFound
+		}
+
+		return json.Unmarshal(rawData, &operation)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &operation, nil
+}
+
+// SaveOperation keeps the operations of bindings in a bucket per instance,
+// inside the binding operations bucket.
+func (b *Bolt) SaveOperation(operation Operation) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		if _, err := readInstance(tx, operation.InstanceID); err != nil {
+			return err
+		}
+
+		rawData, err := json.Marshal(operation)
+		if err != nil {
+			return err
+		}
+
+		if operation.BindingID == "" {
+			return tx.Bucket(operationsBucket).Put([]byte(operation.InstanceID), rawData)
+		}
+
+		if err := checkBoltBinding(tx, operation.InstanceID, operation.BindingID); err != nil {
+			return err
+		}
+
+		instanceOperations, err := tx.Bucket(bindingOperationsBucket).CreateBucketIfNotExists([]byte(operation.InstanceID))
+		if err != nil {
+			return err
+		}
+
+		return instanceOperations.Put([]byte(operation.BindingID), rawData)
+	})
+}
+
+// Close releases the database file once every Bolt using it is closed.
+func (b *Bolt) Close() error {
+	return closeBoltDB(b.location)
+}
+
+func (b *Bolt) readCapacity(tx *bbolt.Tx) int {
+	rawData := tx.Bucket(metaBucket).Get(capacityKey)
+	if rawData == nil {
+		return b.capacity
+	}
+
+	capacity, err := strconv.Atoi(string(rawData))
+	if err != nil {
+		return 0
+	}
+
+	return capacity
+}
+
+func writeCapacity(tx *bbolt.Tx, capacity int) error {
+	return tx.Bucket(metaBucket).Put(capacityKey, []byte(strconv.Itoa(capacity)))
+}
+
+// readCharge returns what the instance was charged. Instances stored before
+// charges were recorded took a single unit.
+func readCharge(tx *bbolt.Tx, instanceID string) int {
+	rawData := tx.Bucket(chargesBucket).Get([]byte(instanceID))
+	if rawData == nil {
+		return 1
+	}
+
+	charge, err := strconv.Atoi(string(rawData))
+	if err != nil {
+		return 1
+	}
+
+	return charge
+}
+
+func writeCharge(tx *bbolt.Tx, instanceID string, charge int) error {
+	return tx.Bucket(chargesBucket).Put([]byte(instanceID), []byte(strconv.Itoa(charge)))
+}
+
+func readInstance(tx *bbolt.Tx, instanceID string) (*repository.Instance, error) {
+	rawData := tx.Bucket(instancesBucket).Get([]byte(instanceID))
+	if rawData == nil {
+		return nil, errInstanceNotFound
+	}
+
+	var instance repository.Instance
+	err := json.Unmarshal(rawData, &instance)
+	if err != nil {
+		return nil, err
+	}
+
+	return &instance, nil
+}
+
+// readInstances returns every instance, the bucket keeps them sorted by ID.
+func readInstances(tx *bbolt.Tx) ([]repository.Instance, error) {
+	instances := []repository.Instance{}
+	err := tx.Bucket(instancesBucket).ForEach(func(_, rawData []byte) error {
+		var instance repository.Instance
+		err := json.Unmarshal(rawData, &instance)
+		if err != nil {
+			return err
+		}
+
+		instances = append(instances, instance)
+		return nil
+	})
+
+	return instances, err
+}
+
+// checkBoltAddress fails if another instance points at the same host and
+// port.
+func checkBoltAddress(tx *bbolt.Tx, instance repository.Instance) error {
+	if instance.Host == "" && instance.Port == "" {
+		return nil
+	}
+
+	instances, err := readInstances(tx)
+	if err != nil {
+		return err
+	}
+
+	for _, other := range instances {
+		if other.ID != instance.ID && other.Host == instance.Host && other.Port == instance.Port {
+			return errAddressTaken
+		}
+	}
+
+	return nil
+}
+
+func writeInstance(tx *bbolt.Tx, instance repository.Instance) error {
+	rawData, err := json.Marshal(instance)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(instancesBucket).Put([]byte(instance.ID), rawData)
+}
+
+// checkBoltBinding fails unless the instance has the binding.
+func checkBoltBinding(tx *bbolt.Tx, instanceID, bindingID string) error {
+	instance, err := readInstance(tx, instanceID)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range instance.Bindings {
+		if id == bindingID {
+			return nil
+		}
+	}
+
+	return errBindingNotFound
+}
+
+func addBoltInstanceBinding(tx *bbolt.Tx, instanceID, bindingID string) error {
+	instance, err := readInstance(tx, instanceID)
+	if err != nil {
+		return err
+	}
+
+	for _, binding := range instance.Bindings {
+		if binding == bindingID {
+			return errBindingIDTaken
+		}
+	}
+
+	instance.Bindings = append(instance.Bindings, bindingID)
+	return writeInstance(tx, *instance)
+}
+
+// The binding records are kept in a bucket per instance, inside the
+// bindings bucket. Bindings added before records were kept get one without
+// credentials.
+func readBinding(tx *bbolt.Tx, instanceID, bindingID string) (*Binding, error) {
+	binding := Binding{ID: bindingID, InstanceID: instanceID}
+
+	instanceBindings := tx.Bucket(bindingsBucket).Bucket([]byte(instanceID))
+	if instanceBindings == nil {
+		return &binding, nil
+	}
+
+	rawData := instanceBindings.Get([]byte(bindingID))
+	if rawData == nil {
+		return &binding, nil
+	}
+
+	err := json.Unmarshal(rawData, &binding)
+	if err != nil {
+		return nil, err
+	}
+
+	return &binding, nil
+}
+
+func writeBinding(tx *bbolt.Tx, binding Binding) error {
+	instanceBindings, err := tx.Bucket(bindingsBucket).CreateBucketIfNotExists([]byte(binding.InstanceID))
+	if err != nil {
+		return err
+	}
+
+	rawData, err := json.Marshal(binding)
+	if err != nil {
+		return err
+	}
+
+	return instanceBindings.Put([]byte(binding.ID), rawData)
+}
+
+// pruneBindings drops the records, and the operations, of bindings the
+// instance no longer has.
+func pruneBindings(tx *bbolt.Tx, instance repository.Instance) error {
+	kept := map[string]bool{}
+	for _, bindingID := range instance.Bindings {
+		kept[bindingID] = true
+	}
+
+	for _, bucket := range [][]byte{bindingsBucket, bindingOperationsBucket} {
+		instanceBindings := tx.Bucket(bucket).Bucket([]byte(instance.ID))
+		if instanceBindings == nil {
+			continue
+		}
+
+		stale := [][]byte{}
+		err := instanceBindings.ForEach(func(bindingID, _ []byte) error {
+			if !kept[string(bindingID)] {
+				stale = append(stale, bindingID)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, bindingID := range stale {
+			if err := instanceBindings.Delete(bindingID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func deleteBinding(tx *bbolt.Tx, instanceID, bindingID string) error {
+	for _, bucket := range [][]byte{bindingsBucket, bindingOperationsBucket} {
+		instanceBindings := tx.Bucket(bucket).Bucket([]byte(instanceID))
+		if instanceBindings == nil {
+			continue
+		}
+
+		if err := instanceBindings.Delete([]byte(bindingID)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// A bolt database can only be opened once per process, as it holds an
+// exclusive lock on the file, so every Bolt on the same file shares it.
+var (
+	boltDBs     = map[string]*sharedBoltDB{}
+	boltDBsLock sync.Mutex
+)
+
+type sharedBoltDB struct {
+	db         *bbolt.DB
+	references int
+}
+
+func openBoltDB(location string) (*bbolt.DB, error) {
+	boltDBsLock.Lock()
+	defer boltDBsLock.Unlock()
+
+	if shared, ok := boltDBs[location]; ok {
+		shared.references++
+		return shared.db, nil
+	}
+
+	db, err := bbolt.Open(location, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	boltDBs[location] = &sharedBoltDB{db: db, references: 1}
+	return db, nil
+}
+
+func closeBoltDB(location string) error {
+	boltDBsLock.Lock()
+	defer boltDBsLock.Unlock()
+
+	shared, ok := boltDBs[location]
+	if !ok {
+		return nil
+	}
+
+	shared.references--
+	if shared.references > 0 {
+		return nil
+	}
+
+	delete(boltDBs, location)
+	return shared.db.Close()
+}
@@ -0,0 +1,53 @@
+package storage_test
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tscolari/cf-broker-api/common/repository"
+	"github.com/tscolari/memcached-broker/storage"
+)
+
+var _ = Describe("Bolt", func() {
+	var bolt *storage.Bolt
+	var tempFileName string
+
+	BeforeEach(func() {
+		dir, err := ioutil.TempDir("/tmp/", "bolt")
+		Expect(err).ToNot(HaveOccurred())
+
+		tempFileName = fmt.Sprintf("%s/state.db", dir)
+		bolt, err = storage.NewBolt(tempFileName, 5)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	itBehavesLikeAState(func(location string, capacity int, opts ...storage.Option) (storage.Storage, error) {
+		return storage.NewBolt(location, capacity, opts...)
+	})
+
+	Describe("Close", func() {
+		It("keeps the database open for other users of the file", func() {
+			otherBolt, err := storage.NewBolt(tempFileName, 5)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(otherBolt.Close()).To(Succeed())
+
+			err = bolt.AddInstance(repository.Instance{ID: "instance-id"})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("releases the file", func() {
+			err := bolt.AddInstance(repository.Instance{ID: "instance-id"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bolt.Close()).To(Succeed())
+
+			reopenedBolt, err := storage.NewBolt(tempFileName, -10)
+			Expect(err).ToNot(HaveOccurred())
+			defer reopenedBolt.Close()
+
+			Expect(reopenedBolt.InstanceExists("instance-id")).To(BeTrue())
+			Expect(reopenedBolt.AvailableInstances()).To(Equal(4))
+		})
+	})
+})
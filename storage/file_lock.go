@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileLock is an advisory, exclusive lock on a file shared between
+// processes.
+type fileLock struct {
+	file *os.File
+}
+
+func newFileLock(location string) (*fileLock, error) {
+	file, err := os.OpenFile(location, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileLock{file: file}, nil
+}
+
+func (l *fileLock) Lock() error {
+	return syscall.Flock(int(l.file.Fd()), syscall.LOCK_EX)
+}
+
+func (l *fileLock) Unlock() error {
+	return syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+}
+
+func (l *fileLock) Close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,550 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/tscolari/cf-broker-api/common/repository"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	addInstanceOperation    = "add-instance"
+	updateInstanceOperation = "update-instance"
+	deleteInstanceOperation = "delete-instance"
+	addBindingOperation     = "add-binding"
+	deleteBindingOperation  = "delete-binding"
+	saveOperationOperation  = "save-operation"
+	saveParametersOperation = "save-parameters"
+
+	// DefaultCompactionThreshold is the number of journal entries after
+	// which the journal is compacted into a new snapshot.
+	DefaultCompactionThreshold = 1000
+)
+
+func init() {
+	Register("journal", func(config Config) (Storage, error) {
+		return NewJournal(config.Path, config.Capacity, config.options()...)
+	})
+}
+
+func NewJournal(location string, capacity int, opts ...Option) (*Journal, error) {
+	journal := &Journal{
+		location:            location,
+		state:               newState(capacity),
+		options:             newOptions(opts),
+		CompactionThreshold: DefaultCompactionThreshold,
+	}
+
+	err := journal.replay()
+	if err != nil {
+		return nil, err
+	}
+
+	journal.file, err = os.OpenFile(journal.journalLocation(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return journal, nil
+}
+
+// Journal keeps the state in memory and appends every mutation to a journal
+// file next to a snapshot of the state, so a change costs one small write no
+// matter how many instances there are. On startup the snapshot is loaded and
+// the journal replayed on top of it.
+//
+// Once CompactionThreshold entries were written the journal is rotated and a
+// new snapshot is written in the background. Entries carry a sequence number
+// and the snapshot records the last one it includes, so a crash at any point
+// of a compaction never replays an entry twice.
+//
+// Journal is safe for concurrent use by goroutines, but unlike LocalFile it
+// must not be shared between processes.
+type Journal struct {
+	CompactionThreshold int
+
+	location   string
+	state      State
+	options    options
+	sequence   uint64
+	entries    int
+	file       *os.File
+	compacting bool
+	lock       sync.RWMutex
+	compaction sync.WaitGroup
+
+	snapshotSequence uint64
+	snapshotWritten  bool
+	snapshotLock     sync.Mutex
+}
+
+type journalEntry struct {
+	Sequence       uint64               `json:"sequence"`
+	Operation      string               `json:"operation"`
+	Instance       *repository.Instance `json:"instance,omitempty"`
+	InstanceID     string               `json:"instance_id,omitempty"`
+	BindingID      string               `json:"binding_id,omitempty"`
+	Size           int                  `json:"size,omitempty"`
+	Binding        *Binding             `json:"binding,omitempty"`
+	AsyncOperation *Operation           `json:"async_operation,omitempty"`
+	Parameters     string               `json:"parameters,omitempty"`
+}
+
+type snapshot struct {
+	Sequence uint64 `yaml:"sequence"`
+	State    `yaml:",inline"`
+}
+
+func (j *Journal) AvailableInstances() int {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	return j.state.Capacity
+}
+
+// AvailablePlanInstances returns how many more instances of the plan fit in
+// the remaining capacity.
+func (j *Journal) AvailablePlanInstances(planID string) int {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	return j.options.availablePlanInstances(j.state.Capacity, planID)
+}
+
+// PlanChangeFits tells whether the remaining capacity, with what the
+// instance was charged, covers moving the instance to the plan.
+func (j *Journal) PlanChangeFits(instanceID, planID string) bool {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	return j.state.planChangeFits(instanceID, j.options.planSize(planID))
+}
+
+func (j *Journal) InstanceExists(instanceID string) bool {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	_, exists := j.state.Instances[instanceID]
+	return exists
+}
+
+func (j *Journal) Instance(instanceID string) (*repository.Instance, error) {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	return j.state.instance(instanceID)
+}
+
+func (j *Journal) Instances() ([]repository.Instance, error) {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	return j.state.instances(), nil
+}
+
+func (j *Journal) AddInstance(instance repository.Instance) error {
+	return j.append(journalEntry{Operation: addInstanceOperation, Instance: &instance, Size: j.options.planSize(instance.PlanID)})
+}
+
+func (j *Journal) UpdateInstance(instance repository.Instance) error {
+	return j.append(journalEntry{Operation: updateInstanceOperation, Instance: &instance, Size: j.options.planSize(instance.PlanID)})
+}
+
+func (j *Journal) DeleteInstance(instanceID string) error {
+	return j.append(journalEntry{Operation: deleteInstanceOperation, InstanceID: instanceID})
+}
+
+func (j *Journal) InstanceParameters(instanceID string) (string, error) {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	return j.state.instanceParameters(instanceID)
+}
+
+func (j *Journal) SaveInstanceParameters(instanceID, parameters string) error {
+	return j.append(journalEntry{Operation: saveParametersOperation, InstanceID: instanceID, Parameters: parameters})
+}
+
+func (j *Journal) InstanceBindingExists(instanceID, bindingID string) bool {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	return j.state.instanceBindingExists(instanceID, bindingID)
+}
+
+func (j *Journal) AddInstanceBinding(instanceID, bindingID string) error {
+	return j.append(journalEntry{Operation: addBindingOperation, InstanceID: instanceID, BindingID: bindingID})
+}
+
+func (j *Journal) Binding(instanceID, bindingID string) (*Binding, error) {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	return j.state.binding(instanceID, bindingID)
+}
+
+func (j *Journal) AddBinding(binding Binding) error {
+	return j.append(journalEntry{Operation: addBindingOperation, InstanceID: binding.InstanceID, BindingID: binding.ID, Binding: &binding})
+}
+
+func (j *Journal) DeleteInstanceBinding(instanceID, bindingID string) error {
+	return j.append(journalEntry{Operation: deleteBindingOperation, InstanceID: instanceID, BindingID: bindingID})
+}
+
+func (j *Journal) Operation(instanceID string) (*Operation, error) {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	return j.state.operation(instanceID)
+}
+
+func (j *Journal) BindingOperation(instanceID, bindingID string) (*Operation, error) {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	return j.state.bindingOperation(instanceID, bindingID)
+}
+
+func (j *Journal) SaveOperation(operation Operation) error {
+	return j.append(journalEntry{Operation: saveOperationOperation, InstanceID: operation.InstanceID, BindingID: operation.BindingID, AsyncOperation: &operation})
+}
+
+// Compact synchronously writes a snapshot of the current state and drops
+// the journal entries it includes.
+func (j *Journal) Compact() error {
+	j.compaction.Wait()
+
+	j.lock.Lock()
+	state, sequence, err := j.rotate()
+	j.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return j.writeSnapshot(state, sequence)
+}
+
+// Close waits for a running compaction and closes the journal file.
+func (j *Journal) Close() error {
+	j.compaction.Wait()
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return j.file.Close()
+}
+
+// append checks the entry against the state, writes it to the journal and
+// only then applies it, so the state never gets ahead of the journal and a
+// change costs no more than the entry it writes.
+func (j *Journal) append(entry journalEntry) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	err := entry.check(j.state)
+	if err != nil {
+		return err
+	}
+
+	// Like LocalFile, the capacity is fixed by the first change.
+	if !j.snapshotWritten {
+		err = j.writeSnapshot(j.state, j.sequence)
+		if err != nil {
+			return err
+		}
+		j.snapshotWritten = true
+	}
+
+	entry.Sequence = j.sequence + 1
+	err = j.write(entry)
+	if err != nil {
+		return err
+	}
+
+	err = entry.apply(&j.state)
+	if err != nil {
+		return err
+	}
+
+	j.sequence = entry.Sequence
+	j.entries++
+
+	if j.entries >= j.CompactionThreshold && !j.compacting {
+		j.compactInBackground()
+	}
+
+	return nil
+}
+
+func (j *Journal) write(entry journalEntry) error {
+	rawData, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	offset, err := j.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	_, err = j.file.Write(append(rawData, '\n'))
+	if err == nil {
+		err = j.file.Sync()
+	}
+
+	if err != nil {
+		// Don't leave a torn entry behind for the next append to follow.
+		j.file.Truncate(offset)
+		return err
+	}
+
+	return nil
+}
+
+// compactInBackground must be called with the lock held.
+func (j *Journal) compactInBackground() {
+	state, sequence, err := j.rotate()
+	if err != nil {
+		return
+	}
+
+	j.compacting = true
+	j.compaction.Add(1)
+
+	go func() {
+		defer j.compaction.Done()
+
+		j.writeSnapshot(state, sequence)
+
+		j.lock.Lock()
+		j.compacting = false
+		j.lock.Unlock()
+	}()
+}
+
+// rotate moves the current journal aside and starts a new one, returning
+// the state the next snapshot has to contain. It must be called with the
+// lock held. If an earlier compaction didn't finish, the rotated journal is
+// still around and the current one is kept: the snapshot covers both.
+func (j *Journal) rotate() (State, uint64, error) {
+	if _, err := os.Stat(j.rotatedLocation()); os.IsNotExist(err) {
+		err = os.Rename(j.journalLocation(), j.rotatedLocation())
+		if err != nil {
+			return State{}, 0, err
+		}
+
+		file, err := os.OpenFile(j.journalLocation(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			os.Rename(j.rotatedLocation(), j.journalLocation())
+			return State{}, 0, err
+		}
+
+		j.file.Close()
+		j.file = file
+	}
+
+	j.entries = 0
+	return j.state.clone(), j.sequence, nil
+}
+
+func (j *Journal) writeSnapshot(state State, sequence uint64) error {
+	j.snapshotLock.Lock()
+	defer j.snapshotLock.Unlock()
+
+	// A newer snapshot already made it to disk.
+	if sequence < j.snapshotSequence {
+		return nil
+	}
+
+	rawData, err := yaml.Marshal(snapshot{Sequence: sequence, State: state})
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(j.location, "", rawData, 0600)
+	if err != nil {
+		return err
+	}
+	j.snapshotSequence = sequence
+
+	err = os.Remove(j.rotatedLocation())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (j *Journal) replay() error {
+	rawData, err := ioutil.ReadFile(j.location)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err == nil {
+		var loaded snapshot
+		err = decodeStateFile(j.location, rawData, &loaded, j.options)
+		if err != nil {
+			return fmt.Errorf("Corrupt snapshot %s: %s", j.location, err.Error())
+		}
+
+		if loaded.Instances == nil {
+			return fmt.Errorf("Incomplete snapshot %s", j.location)
+		}
+
+		j.state = loaded.State
+		j.state.initializeMaps()
+		j.sequence = loaded.Sequence
+		j.snapshotSequence = loaded.Sequence
+		j.snapshotWritten = true
+	}
+
+	_, err = j.replayFile(j.rotatedLocation())
+	if err != nil {
+		return err
+	}
+
+	validLength, err := j.replayFile(j.journalLocation())
+	if err != nil {
+		return err
+	}
+
+	// Cut a torn last entry off, so new entries don't get appended to it.
+	err = os.Truncate(j.journalLocation(), validLength)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// replayFile applies the entries of a journal file newer than the current
+// sequence and returns the length of the file up to the last complete entry.
+func (j *Journal) replayFile(location string) (int64, error) {
+	file, err := os.Open(location)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var validLength int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A last line without a newline is an entry torn by a crash, it
+			// was never acknowledged.
+			return validLength, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		var entry journalEntry
+		err = json.Unmarshal(line, &entry)
+		if err != nil {
+			return 0, fmt.Errorf("Corrupt journal entry in %s: %s", location, err.Error())
+		}
+		validLength += int64(len(line))
+
+		if entry.Sequence <= j.sequence {
+			continue
+		}
+
+		err = entry.apply(&j.state)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to replay journal entry %d from %s: %s", entry.Sequence, location, err.Error())
+		}
+
+		j.sequence = entry.Sequence
+		j.entries++
+	}
+}
+
+func (j *Journal) journalLocation() string {
+	return j.location + ".journal"
+}
+
+func (j *Journal) rotatedLocation() string {
+	return j.location + ".journal.old"
+}
+
+// check tells why the entry can't be applied on state, without changing it.
+func (e journalEntry) check(state State) error {
+	switch e.Operation {
+	case addInstanceOperation, updateInstanceOperation:
+		if e.Instance == nil {
+			return fmt.Errorf("Journal entry %d has no instance", e.Sequence)
+		}
+	case saveOperationOperation:
+		if e.AsyncOperation == nil {
+			return fmt.Errorf("Journal entry %d has no operation", e.Sequence)
+		}
+	}
+
+	switch e.Operation {
+	case addInstanceOperation:
+		return state.checkAddInstance(*e.Instance, e.size())
+	case updateInstanceOperation:
+		return state.checkUpdateInstance(*e.Instance, e.size())
+	case deleteInstanceOperation, saveParametersOperation:
+		return state.checkInstance(e.InstanceID)
+	case addBindingOperation:
+		return state.checkAddInstanceBinding(e.InstanceID, e.BindingID)
+	case deleteBindingOperation:
+		return state.checkDeleteInstanceBinding(e.InstanceID, e.BindingID)
+	case saveOperationOperation:
+		return state.checkSaveOperation(*e.AsyncOperation)
+	}
+
+	return fmt.Errorf("Unknown journal operation: %s", e.Operation)
+}
+
+// apply replays the entry on state. The size is recorded in the entry, so
+// replaying gives the same result even if the plan sizes changed since.
+func (e journalEntry) apply(state *State) error {
+	err := e.check(*state)
+	if err != nil {
+		return err
+	}
+
+	switch e.Operation {
+	case addInstanceOperation:
+		return state.addInstance(*e.Instance, e.size())
+	case updateInstanceOperation:
+		return state.updateInstance(*e.Instance, e.size())
+	case deleteInstanceOperation:
+		return state.deleteInstance(e.InstanceID)
+	case addBindingOperation:
+		if e.Binding != nil {
+			return state.addBinding(*e.Binding)
+		}
+		return state.addInstanceBinding(e.InstanceID, e.BindingID)
+	case deleteBindingOperation:
+		return state.deleteInstanceBinding(e.InstanceID, e.BindingID)
+	case saveParametersOperation:
+		return state.saveInstanceParameters(e.InstanceID, e.Parameters)
+	case saveOperationOperation:
+		return state.saveOperation(*e.AsyncOperation)
+	}
+
+	return fmt.Errorf("Unknown journal operation: %s", e.Operation)
+}
+
+func (e journalEntry) size() int {
+	if e.Size <= 0 {
+		return 1
+	}
+
+	return e.Size
+}
@@ -0,0 +1,201 @@
+package storage_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tscolari/cf-broker-api/common/repository"
+	"github.com/tscolari/memcached-broker/storage"
+)
+
+var _ = Describe("Journal", func() {
+	var journal *storage.Journal
+	var tempFileName string
+
+	BeforeEach(func() {
+		dir, err := ioutil.TempDir("/tmp/", "journal")
+		Expect(err).ToNot(HaveOccurred())
+
+		tempFileName = fmt.Sprintf("%s/state.yml", dir)
+		journal, err = storage.NewJournal(tempFileName, 5)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	itBehavesLikeAState(func(location string, capacity int, opts ...storage.Option) (storage.Storage, error) {
+		return storage.NewJournal(location, capacity, opts...)
+	})
+
+	Describe("NewJournal", func() {
+		BeforeEach(func() {
+			err := journal.AddInstance(repository.Instance{ID: "instance-id"})
+			Expect(err).ToNot(HaveOccurred())
+			err = journal.AddInstanceBinding("instance-id", "binding-1")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("replays the journal", func() {
+			newJournal, err := storage.NewJournal(tempFileName, -10)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(newJournal.AvailableInstances()).To(Equal(4))
+			Expect(newJournal.InstanceBindingExists("instance-id", "binding-1")).To(BeTrue())
+		})
+
+		It("replays the journal on top of the snapshot", func() {
+			Expect(journal.Compact()).To(Succeed())
+
+			err := journal.AddInstanceBinding("instance-id", "binding-2")
+			Expect(err).ToNot(HaveOccurred())
+
+			newJournal, err := storage.NewJournal(tempFileName, -10)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(newJournal.AvailableInstances()).To(Equal(4))
+			Expect(newJournal.InstanceBindingExists("instance-id", "binding-1")).To(BeTrue())
+			Expect(newJournal.InstanceBindingExists("instance-id", "binding-2")).To(BeTrue())
+		})
+
+		Context("when the last entry was torn by a crash", func() {
+			BeforeEach(func() {
+				file, err := os.OpenFile(tempFileName+".journal", os.O_WRONLY|os.O_APPEND, 0600)
+				Expect(err).ToNot(HaveOccurred())
+				_, err = file.WriteString(`{"sequence":3,"operation":"add-bin`)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(file.Close()).To(Succeed())
+			})
+
+			It("ignores it", func() {
+				newJournal, err := storage.NewJournal(tempFileName, -10)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(newJournal.InstanceBindingExists("instance-id", "binding-1")).To(BeTrue())
+			})
+
+			It("keeps appending after the last complete entry", func() {
+				newJournal, err := storage.NewJournal(tempFileName, -10)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(newJournal.AddInstanceBinding("instance-id", "binding-2")).To(Succeed())
+
+				reopenedJournal, err := storage.NewJournal(tempFileName, -10)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(reopenedJournal.InstanceBindingExists("instance-id", "binding-2")).To(BeTrue())
+			})
+		})
+
+		Context("when an entry in the middle is corrupt", func() {
+			BeforeEach(func() {
+				err := ioutil.WriteFile(tempFileName+".journal", []byte("not-json\n{}\n"), 0600)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("returns an error", func() {
+				_, err := storage.NewJournal(tempFileName, -10)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("Corrupt journal entry"))
+			})
+		})
+	})
+
+	Describe("appending", func() {
+		BeforeEach(func() {
+			Expect(journal.AddInstance(repository.Instance{ID: "instance-id"})).To(Succeed())
+		})
+
+		Context("when the change is refused", func() {
+			It("doesn't write an entry", func() {
+				before, err := ioutil.ReadFile(tempFileName + ".journal")
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(journal.AddInstance(repository.Instance{ID: "instance-id"})).ToNot(Succeed())
+				Expect(journal.DeleteInstanceBinding("instance-id", "binding-1")).ToNot(Succeed())
+
+				after, err := ioutil.ReadFile(tempFileName + ".journal")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(after).To(Equal(before))
+			})
+		})
+
+		Context("when the entry can't be written", func() {
+			It("leaves the state as it was", func() {
+				Expect(journal.Close()).To(Succeed())
+
+				Expect(journal.AddInstanceBinding("instance-id", "binding-1")).ToNot(Succeed())
+				Expect(journal.InstanceBindingExists("instance-id", "binding-1")).To(BeFalse())
+				Expect(journal.AvailableInstances()).To(Equal(4))
+			})
+		})
+	})
+
+	Describe("Compact", func() {
+		BeforeEach(func() {
+			err := journal.AddInstance(repository.Instance{ID: "instance-id"})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("empties the journal", func() {
+			Expect(journal.Compact()).To(Succeed())
+
+			rawData, err := ioutil.ReadFile(tempFileName + ".journal")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rawData).To(BeEmpty())
+
+			_, err = os.Stat(tempFileName + ".journal.old")
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("writes the state to the snapshot", func() {
+			Expect(journal.Compact()).To(Succeed())
+
+			rawData, err := ioutil.ReadFile(tempFileName)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(rawData)).To(ContainSubstring("instance-id"))
+		})
+
+		Context("when it crashed before dropping the rotated journal", func() {
+			BeforeEach(func() {
+				Expect(journal.Compact()).To(Succeed())
+
+				err := ioutil.WriteFile(tempFileName+".journal.old", []byte(`{"sequence":1,"operation":"add-instance","instance":{"ID":"instance-id"}}`+"\n"), 0600)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("doesn't replay entries the snapshot already has", func() {
+				newJournal, err := storage.NewJournal(tempFileName, -10)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(newJournal.AvailableInstances()).To(Equal(4))
+			})
+		})
+	})
+
+	Context("when the compaction threshold is reached", func() {
+		BeforeEach(func() {
+			journal.CompactionThreshold = 2
+
+			err := journal.AddInstance(repository.Instance{ID: "instance-id"})
+			Expect(err).ToNot(HaveOccurred())
+			err = journal.AddInstanceBinding("instance-id", "binding-1")
+			Expect(err).ToNot(HaveOccurred())
+			err = journal.AddInstanceBinding("instance-id", "binding-2")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(journal.Close()).To(Succeed())
+		})
+
+		It("compacts in the background", func() {
+			rawData, err := ioutil.ReadFile(tempFileName)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(rawData)).To(ContainSubstring("binding-1"))
+			Expect(string(rawData)).ToNot(ContainSubstring("binding-2"))
+		})
+
+		It("doesn't lose any entry", func() {
+			newJournal, err := storage.NewJournal(tempFileName, -10)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(newJournal.AvailableInstances()).To(Equal(4))
+			Expect(newJournal.InstanceBindingExists("instance-id", "binding-1")).To(BeTrue())
+			Expect(newJournal.InstanceBindingExists("instance-id", "binding-2")).To(BeTrue())
+		})
+	})
+})
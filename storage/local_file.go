@@ -1,53 +1,91 @@
 package storage
 
 import (
-	"errors"
+	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"sync"
 
 	"github.com/tscolari/cf-broker-api/common/repository"
 	"gopkg.in/yaml.v2"
 )
 
-func NewLocalFile(location string, capacity int) (*LocalFile, error) {
-	var err error
-	state := State{
-		Capacity:  capacity,
-		Instances: map[string]repository.Instance{},
-	}
+func init() {
+	Register("local_file", func(config Config) (Storage, error) {
+		return NewLocalFile(config.Path, config.Capacity, config.options()...)
+	})
+}
 
-	if _, err = os.Stat(location); os.IsNotExist(err) {
-		_, err = os.Create(location)
-		if err != nil {
-			return nil, err
-		}
+func NewLocalFile(location string, capacity int, opts ...Option) (*LocalFile, error) {
+	fileLock, err := newFileLock(location + ".lock")
+	if err != nil {
+		return nil, err
 	}
 
 	localFile := &LocalFile{
 		location: location,
-		state:    state,
+		state:    newState(capacity),
+		options:  newOptions(opts),
+		fileLock: fileLock,
 	}
 
-	localFile.Reload()
+	err = localFile.initialize()
+	if err != nil {
+		fileLock.Close()
+		return nil, err
+	}
 
 	return localFile, nil
 }
 
+// LocalFile is safe for concurrent use, both by goroutines and by several
+// processes sharing the same file. Every method takes the locks itself, so
+// check-then-act sequences inside a single call are atomic.
+//
+// Writers hold an exclusive lock on a sidecar `.lock` file for the whole
+// read-modify-write cycle and re-read the state file under it. The sidecar
+// is needed because Save replaces the state file instead of rewriting it.
+// Readers don't take the file lock, as the state file is always complete, but
+// they pick up changes made by other processes.
 type LocalFile struct {
 	location string
 	state    State
-}
-
-type State struct {
-	Capacity  int                            `yaml:"capacity"`
-	Instances map[string]repository.Instance `yaml:"instances"`
+	options  options
+	loaded   os.FileInfo
+	lock     sync.RWMutex
+	fileLock *fileLock
 }
 
 func (s *LocalFile) AvailableInstances() int {
+	s.readLock()
+	defer s.lock.RUnlock()
+
 	return s.state.Capacity
 }
 
+// AvailablePlanInstances returns how many more instances of the plan fit in
+// the remaining capacity.
+func (s *LocalFile) AvailablePlanInstances(planID string) int {
+	s.readLock()
+	defer s.lock.RUnlock()
+
+	return s.options.availablePlanInstances(s.state.Capacity, planID)
+}
+
+// PlanChangeFits tells whether the remaining capacity, with what the
+// instance was charged, covers moving the instance to the plan.
+func (s *LocalFile) PlanChangeFits(instanceID, planID string) bool {
+	s.readLock()
+	defer s.lock.RUnlock()
+
+	return s.state.planChangeFits(instanceID, s.options.planSize(planID))
+}
+
 func (s *LocalFile) InstanceExists(instanceID string) bool {
+	s.readLock()
+	defer s.lock.RUnlock()
+
 	if _, exists := s.state.Instances[instanceID]; exists {
 		return true
 	}
@@ -56,110 +94,307 @@ func (s *LocalFile) InstanceExists(instanceID string) bool {
 }
 
 func (s *LocalFile) Instance(instanceID string) (*repository.Instance, error) {
-	if instance, exists := s.state.Instances[instanceID]; exists {
-		return &instance, nil
-	}
+	s.readLock()
+	defer s.lock.RUnlock()
 
-	return nil, errors.New("Instance not found")
+	return s.state.instance(instanceID)
+}
+
+func (s *LocalFile) Instances() ([]repository.Instance, error) {
+	s.readLock()
+	defer s.lock.RUnlock()
+
+	return s.state.instances(), nil
 }
 
 func (s *LocalFile) AddInstance(instance repository.Instance) error {
-	if s.state.Capacity == 0 {
-		return errors.New("Can't allocate instance, no capacity")
+	return s.mutate(func(state *State) error {
+		return state.addInstance(instance, s.options.planSize(instance.PlanID))
+	})
+}
+
+func (s *LocalFile) UpdateInstance(instance repository.Instance) error {
+	return s.mutate(func(state *State) error {
+		return state.updateInstance(instance, s.options.planSize(instance.PlanID))
+	})
+}
+
+func (s *LocalFile) DeleteInstance(instanceID string) error {
+	return s.mutate(func(state *State) error {
+		return state.deleteInstance(instanceID)
+	})
+}
+
+func (s *LocalFile) InstanceParameters(instanceID string) (string, error) {
+	s.readLock()
+	defer s.lock.RUnlock()
+
+	return s.state.instanceParameters(instanceID)
+}
+
+func (s *LocalFile) SaveInstanceParameters(instanceID, parameters string) error {
+	return s.mutate(func(state *State) error {
+		return state.saveInstanceParameters(instanceID, parameters)
+	})
+}
+
+func (s *LocalFile) InstanceBindingExists(instanceID, bindingID string) bool {
+	s.readLock()
+	defer s.lock.RUnlock()
+
+	return s.state.instanceBindingExists(instanceID, bindingID)
+}
+
+func (s *LocalFile) AddInstanceBinding(instanceID, bindingID string) error {
+	return s.mutate(func(state *State) error {
+		return state.addInstanceBinding(instanceID, bindingID)
+	})
+}
+
+func (s *LocalFile) Binding(instanceID, bindingID string) (*Binding, error) {
+	s.readLock()
+	defer s.lock.RUnlock()
+
+	return s.state.binding(instanceID, bindingID)
+}
+
+func (s *LocalFile) AddBinding(binding Binding) error {
+	return s.mutate(func(state *State) error {
+		return state.addBinding(binding)
+	})
+}
+
+func (s *LocalFile) DeleteInstanceBinding(instanceID, bindingID string) error {
+	return s.mutate(func(state *State) error {
+		return state.deleteInstanceBinding(instanceID, bindingID)
+	})
+}
+
+func (s *LocalFile) Operation(instanceID string) (*Operation, error) {
+	s.readLock()
+	defer s.lock.RUnlock()
+
+	return s.state.operation(instanceID)
+}
+
+func (s *LocalFile) BindingOperation(instanceID, bindingID string) (*Operation, error) {
+	s.readLock()
+	defer s.lock.RUnlock()
+
+	return s.state.bindingOperation(instanceID, bindingID)
+}
+
+func (s *LocalFile) SaveOperation(operation Operation) error {
+	return s.mutate(func(state *State) error {
+		return state.saveOperation(operation)
+	})
+}
+
+// Close releases the sidecar lock file.
+func (s *LocalFile) Close() error {
+	return s.fileLock.Close()
+}
+
+// mutate applies change to a copy of the state, which only becomes current
+// once it is on disk. A failed change or write leaves no trace in memory.
+func (s *LocalFile) mutate(change func(state *State) error) error {
+	if err := s.writeLock(); err != nil {
+		return err
 	}
+	defer s.writeUnlock()
 
-	if _, exists := s.state.Instances[instance.ID]; exists {
-		return errors.New("Instance ID is taken")
+	previous := s.state
+	s.state = previous.clone()
+
+	if err := change(&s.state); err != nil {
+		s.state = previous
+		return err
+	}
+
+	if err := s.save(); err != nil {
+		s.state = previous
+		return err
 	}
 
-	s.state.Capacity--
-	s.state.Instances[instance.ID] = instance
-	s.Save()
 	return nil
 }
 
-func (s *LocalFile) UpdateInstance(instance repository.Instance) error {
-	if _, exists := s.state.Instances[instance.ID]; !exists {
-		return errors.New("Instance not found")
+// Save atomically replaces the state file with the in-memory state. The
+// previous generation is kept next to it with a `.bak` suffix.
+func (s *LocalFile) Save() error {
+	if err := s.writeLock(); err != nil {
+		return err
 	}
+	defer s.writeUnlock()
 
-	s.state.Instances[instance.ID] = instance
-	s.Save()
-	return nil
+	return s.save()
 }
 
-func (s *LocalFile) DeleteInstance(instanceID string) error {
-	if _, exists := s.state.Instances[instanceID]; !exists {
-		return errors.New("Instance not found")
+func (s *LocalFile) save() error {
+	rawData, err := yaml.Marshal(s.state)
+	if err != nil {
+		return err
 	}
 
-	s.state.Capacity++
-	delete(s.state.Instances, instanceID)
-	s.Save()
-	return nil
+	err = writeFileAtomic(s.location, s.backupLocation(), rawData, 0600)
+	if err != nil {
+		return err
+	}
+
+	s.loaded, err = os.Stat(s.location)
+	return err
 }
 
-func (s *LocalFile) InstanceBindingExists(instanceID, bindingID string) bool {
-	instance, err := s.Instance(instanceID)
+// Reload replaces the in-memory state with the contents of the state file.
+// It fails, leaving the in-memory state untouched, if the file is corrupt.
+func (s *LocalFile) Reload() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.reload()
+}
+
+func (s *LocalFile) reload() error {
+	info, err := os.Stat(s.location)
 	if err != nil {
-		return false
+		return err
 	}
 
-	for _, binding := range instance.Bindings {
-		if binding == bindingID {
-			return true
-		}
+	state, err := s.readState(s.location)
+	if err != nil {
+		return err
 	}
 
-	return false
+	s.state = state
+	s.loaded = info
+	return nil
 }
 
-func (s *LocalFile) AddInstanceBinding(instanceID, bindingID string) error {
-	instance, err := s.Instance(instanceID)
+func (s *LocalFile) initialize() error {
+	if err := s.fileLock.Lock(); err != nil {
+		return err
+	}
+	defer s.fileLock.Unlock()
+
+	file, err := os.OpenFile(s.location, os.O_RDONLY|os.O_CREATE, 0600)
 	if err != nil {
 		return err
 	}
+	file.Close()
 
-	for _, binding := range instance.Bindings {
-		if binding == bindingID {
-			return errors.New("Binding ID is taken")
+	if err := s.reload(); err != nil {
+		if recoverErr := s.recoverFromBackup(); recoverErr != nil {
+			return fmt.Errorf("State file is unusable (%s) and could not be recovered: %s", err.Error(), recoverErr.Error())
 		}
 	}
 
-	instance.Bindings = append(instance.Bindings, bindingID)
-	return s.UpdateInstance(*instance)
+	return nil
 }
 
-func (s *LocalFile) DeleteInstanceBinding(instanceID, bindingID string) error {
-	instance, err := s.Instance(instanceID)
-	if err != nil {
+// readLock takes the in-process read lock, after catching up with changes
+// other processes made to the state file.
+func (s *LocalFile) readLock() {
+	s.lock.RLock()
+	if !s.changedOnDisk() {
+		return
+	}
+	s.lock.RUnlock()
+
+	s.lock.Lock()
+	if s.changedOnDisk() {
+		s.reload()
+	}
+	s.lock.Unlock()
+
+	s.lock.RLock()
+}
+
+// writeLock takes the in-process and the cross-process locks, and re-reads
+// the state file if another process changed it.
+func (s *LocalFile) writeLock() error {
+	s.lock.Lock()
+
+	if err := s.fileLock.Lock(); err != nil {
+		s.lock.Unlock()
 		return err
 	}
 
-	for i, binding := range instance.Bindings {
-		if binding == bindingID {
-			instance.Bindings = append(instance.Bindings[:i], instance.Bindings[i+1:]...)
-			return s.UpdateInstance(*instance)
+	if s.changedOnDisk() {
+		if err := s.reload(); err != nil {
+			s.writeUnlock()
+			return err
 		}
 	}
 
-	return errors.New("Binding not found")
+	return nil
 }
 
-func (s *LocalFile) Save() error {
-	rawData, err := yaml.Marshal(s.state)
+func (s *LocalFile) writeUnlock() {
+	s.fileLock.Unlock()
+	s.lock.Unlock()
+}
+
+func (s *LocalFile) changedOnDisk() bool {
+	info, err := os.Stat(s.location)
 	if err != nil {
-		return err
+		return false
+	}
+
+	if s.loaded == nil {
+		return true
 	}
 
-	return ioutil.WriteFile(s.location, rawData, 0600)
+	return !os.SameFile(info, s.loaded) ||
+		!info.ModTime().Equal(s.loaded.ModTime()) ||
+		info.Size() != s.loaded.Size()
 }
 
-func (s *LocalFile) Reload() error {
-	rawData, err := ioutil.ReadFile(s.location)
+func (s *LocalFile) readState(location string) (State, error) {
+	rawData, err := ioutil.ReadFile(location)
+	if err != nil {
+		return State{}, err
+	}
+
+	// Older versions created an empty file before the first save.
+	if len(bytes.TrimSpace(rawData)) == 0 {
+		return s.state, nil
+	}
+
+	var state State
+	err = decodeStateFile(location, rawData, &state, s.options)
+	if err != nil {
+		return State{}, fmt.Errorf("Corrupt state file %s: %s", location, err.Error())
+	}
+
+	// Save always writes the instances key, so a document without it was
+	// cut short.
+	if state.Instances == nil {
+		return State{}, fmt.Errorf("Incomplete state file %s", location)
+	}
+
+	state.initializeMaps()
+
+	return state, nil
+}
+
+// recoverFromBackup falls back to the last good generation of the state
+// file. The unusable file is moved aside with a `.corrupt` suffix for
+// inspection.
+func (s *LocalFile) recoverFromBackup() error {
+	state, err := s.readState(s.backupLocation())
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(s.location, s.location+".corrupt")
 	if err != nil {
 		return err
 	}
 
-	return yaml.Unmarshal(rawData, &s.state)
+	s.state = state
+	return s.save()
+}
+
+func (s *LocalFile) backupLocation() string {
+	return s.location + ".bak"
 }
@@ -3,6 +3,9 @@ package storage_test
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -23,319 +26,204 @@ var _ = Describe("LocalFile", func() {
 		Expect(err).ToNot(HaveOccurred())
 	})
 
-	Describe("InstanceExists", func() {
-		Context("when the instance exists", func() {
-			BeforeEach(func() {
-				localFile.AddInstance(repository.Instance{ID: "instance-id"})
-			})
-
-			It("returns true", func() {
-				Expect(localFile.InstanceExists("instance-id")).To(BeTrue())
-			})
-		})
-
-		Context("when the instance doesn't exist", func() {
-			It("returns false", func() {
-				Expect(localFile.InstanceExists("not-here-id")).To(BeFalse())
-			})
-		})
+	itBehavesLikeAState(func(location string, capacity int, opts ...storage.Option) (storage.Storage, error) {
+		return storage.NewLocalFile(location, capacity, opts...)
 	})
 
-	Describe("Instance", func() {
-		It("returns a pointer to the instance", func() {
-			instance := repository.Instance{
-				ID:   "instance-id",
-				Host: "127.0.0.1",
-				Port: "11111",
-			}
-			localFile.AddInstance(instance)
-
-			fetchedInstance, err := localFile.Instance("instance-id")
-			Expect(err).ToNot(HaveOccurred())
-			Expect(fetchedInstance).To(Equal(&instance))
-		})
-
-		Context("when the instance doesn't exist", func() {
-			It("returns an error", func() {
-				_, err := localFile.Instance("instance-id")
-				Expect(err).To(MatchError("Instance not found"))
+	Describe("NewLocalFile", func() {
+		Context("when the file is empty", func() {
+			It("starts with the given capacity", func() {
+				newLocalFile, err := storage.NewLocalFile(tempFileName, 3)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(newLocalFile.AvailableInstances()).To(Equal(3))
 			})
 		})
-	})
-
-	Describe("AddInstance", func() {
-		It("adds the instance to the object", func() {
-			instance := repository.Instance{
-				ID:   "instance-id",
-				Host: "127.0.0.1",
-				Port: "11111",
-			}
-
-			err := localFile.AddInstance(instance)
-			Expect(err).ToNot(HaveOccurred())
-
-			fetchedInstance, err := localFile.Instance("instance-id")
-			Expect(err).ToNot(HaveOccurred())
-
-			Expect(fetchedInstance).To(Equal(&instance))
-		})
-
-		It("updates the capacity", func() {
-			capacityBefore := localFile.AvailableInstances()
-			err := localFile.AddInstance(repository.Instance{ID: "instance-id"})
-			Expect(err).ToNot(HaveOccurred())
-
-			capacityNow := localFile.AvailableInstances()
-			Expect(capacityNow).To(Equal(capacityBefore - 1))
-		})
 
-		It("persists the change on disk", func() {
-			instance := repository.Instance{
-				ID:       "instance-id",
-				Host:     "127.0.0.1",
-				Port:     "11111",
-				Bindings: []string{},
-			}
+		Context("when the file is corrupt", func() {
+			BeforeEach(func() {
+				err := localFile.AddInstance(repository.Instance{ID: "instance-id"})
+				Expect(err).ToNot(HaveOccurred())
+				err = localFile.DeleteInstance("instance-id")
+				Expect(err).ToNot(HaveOccurred())
 
-			err := localFile.AddInstance(instance)
-			Expect(err).ToNot(HaveOccurred())
+				err = ioutil.WriteFile(tempFileName, []byte("capacity: 0\ninstances: {instance-id: [[["), 0600)
+				Expect(err).ToNot(HaveOccurred())
+			})
 
-			newLocalFile, err := storage.NewLocalFile(tempFileName, -10)
-			Expect(err).ToNot(HaveOccurred())
+			Context("and there's no previous generation", func() {
+				BeforeEach(func() {
+					err := os.Remove(tempFileName + ".bak")
+					Expect(err).ToNot(HaveOccurred())
+				})
 
-			Expect(newLocalFile.AvailableInstances()).To(Equal(localFile.AvailableInstances()))
+				It("returns an error", func() {
+					_, err := storage.NewLocalFile(tempFileName, 1)
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("Corrupt state file"))
+				})
+			})
 
-			fetchedInstance, err := newLocalFile.Instance("instance-id")
-			Expect(err).ToNot(HaveOccurred())
-			Expect(fetchedInstance).To(Equal(&instance))
-		})
+			Context("and there's a previous generation", func() {
+				It("falls back to it", func() {
+					newLocalFile, err := storage.NewLocalFile(tempFileName, -10)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(newLocalFile.AvailableInstances()).To(Equal(0))
+					Expect(newLocalFile.InstanceExists("instance-id")).To(BeTrue())
+				})
 
-		Context("when there's no capacity left", func() {
-			BeforeEach(func() {
-				var err error
-				localFile, err = storage.NewLocalFile(tempFileName, 0)
-				Expect(err).ToNot(HaveOccurred())
-			})
+				It("moves the corrupt file aside", func() {
+					_, err := storage.NewLocalFile(tempFileName, -10)
+					Expect(err).ToNot(HaveOccurred())
 
-			It("returns an error", func() {
-				err := localFile.AddInstance(repository.Instance{ID: "instance-id"})
-				Expect(err).To(MatchError("Can't allocate instance, no capacity"))
+					rawData, err := ioutil.ReadFile(tempFileName + ".corrupt")
+					Expect(err).ToNot(HaveOccurred())
+					Expect(string(rawData)).To(ContainSubstring("[[["))
+				})
 			})
 		})
 
-		Context("when the instance id is taken", func() {
+		Context("when the file was cut short", func() {
 			BeforeEach(func() {
-				var err error
-				localFile, err = storage.NewLocalFile(tempFileName, 5)
-				Expect(err).ToNot(HaveOccurred())
-				err = localFile.AddInstance(repository.Instance{ID: "instance-id"})
+				err := ioutil.WriteFile(tempFileName, []byte("capacity: 1\n"), 0600)
 				Expect(err).ToNot(HaveOccurred())
+				os.Remove(tempFileName + ".bak")
 			})
 
 			It("returns an error", func() {
-				err := localFile.AddInstance(repository.Instance{ID: "instance-id"})
-				Expect(err).To(MatchError("Instance ID is taken"))
+				_, err := storage.NewLocalFile(tempFileName, 1)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("Incomplete state file"))
 			})
 		})
 	})
 
-	Describe("UpdateInstance", func() {
-		BeforeEach(func() {
-			instance := repository.Instance{
-				ID:   "instance-id",
-				Host: "127.0.0.1",
-				Port: "11111",
-			}
-
-			err := localFile.AddInstance(instance)
-			Expect(err).ToNot(HaveOccurred())
-		})
-
-		It("updates the instance", func() {
-			newInstance := repository.Instance{
-				ID:   "instance-id",
-				Host: "0.0.0.0",
-				Port: "2222",
-			}
-
-			err := localFile.UpdateInstance(newInstance)
+	Describe("Save", func() {
+		It("doesn't leave temporary files behind", func() {
+			err := localFile.AddInstance(repository.Instance{ID: "instance-id"})
 			Expect(err).ToNot(HaveOccurred())
 
-			fetchedInstance, err := localFile.Instance("instance-id")
+			files, err := filepath.Glob(tempFileName + ".tmp*")
 			Expect(err).ToNot(HaveOccurred())
-			Expect(fetchedInstance).To(Equal(&newInstance))
+			Expect(files).To(BeEmpty())
 		})
 
-		It("persists the change on disk", func() {
-			newInstance := repository.Instance{
-				ID:       "instance-id",
-				Host:     "0.0.0.0",
-				Port:     "2222",
-				Bindings: []string{},
-			}
-
-			err := localFile.UpdateInstance(newInstance)
+		It("keeps the previous generation", func() {
+			err := localFile.AddInstance(repository.Instance{ID: "instance-id", Host: "127.0.0.1"})
 			Expect(err).ToNot(HaveOccurred())
-
-			newLocalFile, err := storage.NewLocalFile(tempFileName, -10)
+			err = localFile.UpdateInstance(repository.Instance{ID: "instance-id", Host: "0.0.0.0"})
 			Expect(err).ToNot(HaveOccurred())
 
-			fetchedInstance, err := newLocalFile.Instance("instance-id")
+			previousLocalFile, err := storage.NewLocalFile(tempFileName+".bak", -10)
 			Expect(err).ToNot(HaveOccurred())
-			Expect(fetchedInstance).To(Equal(&newInstance))
-		})
 
-		Context("when the instance is not found", func() {
-			It("returns an error", func() {
-				err := localFile.UpdateInstance(repository.Instance{ID: "instance-id-2"})
-				Expect(err).To(MatchError("Instance not found"))
-			})
+			previousInstance, err := previousLocalFile.Instance("instance-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(previousInstance.Host).To(Equal("127.0.0.1"))
 		})
 	})
 
-	Describe("DeleteInstance", func() {
+	Describe("when the state can't be persisted", func() {
 		BeforeEach(func() {
-			localFile.AddInstance(repository.Instance{ID: "instance-id"})
-		})
-
-		It("removes the instance", func() {
-			err := localFile.DeleteInstance("instance-id")
+			var err error
+			localFile, err = storage.NewLocalFile(tempFileName, 5)
 			Expect(err).ToNot(HaveOccurred())
 
-			_, err = localFile.Instance("instance-id")
-			Expect(err).To(MatchError("Instance not found"))
-		})
-
-		It("updates the capacity", func() {
-			capacityBefore := localFile.AvailableInstances()
-			err := localFile.DeleteInstance("instance-id")
+			err = localFile.AddInstance(repository.Instance{ID: "instance-id", Bindings: []string{"binding-1"}})
 			Expect(err).ToNot(HaveOccurred())
 
-			capacityNow := localFile.AvailableInstances()
-			Expect(capacityNow).To(Equal(capacityBefore + 1))
+			// A non-empty directory in place of the previous generation makes
+			// every write fail, even when running as root.
+			backupLocation := tempFileName + ".bak"
+			Expect(os.Remove(backupLocation)).To(Succeed())
+			Expect(os.MkdirAll(filepath.Join(backupLocation, "blocker"), 0700)).To(Succeed())
 		})
 
-		It("persists the change on disk", func() {
-			capacityBefore := localFile.AvailableInstances()
-			err := localFile.DeleteInstance("instance-id")
-			Expect(err).ToNot(HaveOccurred())
+		It("rolls back AddInstance", func() {
+			err := localFile.AddInstance(repository.Instance{ID: "instance-id-2"})
+			Expect(err).To(HaveOccurred())
 
-			newLocalFile, err := storage.NewLocalFile(tempFileName, -10)
-			Expect(err).ToNot(HaveOccurred())
-
-			fetchedCapacity := newLocalFile.AvailableInstances()
-			Expect(fetchedCapacity).To(Equal(capacityBefore + 1))
-
-			Expect(newLocalFile.InstanceExists("instance-id")).To(BeFalse())
+			Expect(localFile.InstanceExists("instance-id-2")).To(BeFalse())
+			Expect(localFile.AvailableInstances()).To(Equal(4))
 		})
 
-		Context("when there's no instance with the given id", func() {
-			It("returns an error", func() {
-				err := localFile.DeleteInstance("instance-id-2")
-				Expect(err).To(MatchError("Instance not found"))
-			})
-		})
-	})
-
-	Describe("InstanceBindingExists", func() {
-		Context("when the binding exists for the given instance", func() {
-			BeforeEach(func() {
-				instance := repository.Instance{
-					ID:       "instance-id",
-					Bindings: []string{"binding-1"},
-				}
-				localFile.AddInstance(instance)
-			})
+		It("rolls back UpdateInstance", func() {
+			err := localFile.UpdateInstance(repository.Instance{ID: "instance-id", Host: "0.0.0.0"})
+			Expect(err).To(HaveOccurred())
 
-			It("returns true", func() {
-				Expect(localFile.InstanceBindingExists("instance-id", "binding-1")).To(BeTrue())
-			})
-		})
-
-		Context("when the instance doesn't exist", func() {
-			It("returns false", func() {
-				Expect(localFile.InstanceBindingExists("instance-id", "binding-1")).To(BeFalse())
-			})
+			instance, err := localFile.Instance("instance-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(instance.Host).To(BeEmpty())
 		})
 
-		Context("when the instance binding doesn't exist", func() {
-			BeforeEach(func() {
-				localFile.AddInstance(repository.Instance{ID: "instance-id"})
-			})
+		It("rolls back DeleteInstance", func() {
+			err := localFile.DeleteInstance("instance-id")
+			Expect(err).To(HaveOccurred())
 
-			It("returns false", func() {
-				Expect(localFile.InstanceBindingExists("instance-id", "binding-1")).To(BeFalse())
-			})
+			Expect(localFile.InstanceExists("instance-id")).To(BeTrue())
+			Expect(localFile.AvailableInstances()).To(Equal(4))
 		})
-	})
 
-	Describe("AddInstanceBinding", func() {
-		BeforeEach(func() {
-			instance := repository.Instance{
-				ID:       "instance-id",
-				Host:     "127.0.0.1",
-				Port:     "11111",
-				Bindings: []string{"existing-binding"},
-			}
+		It("rolls back AddInstanceBinding", func() {
+			err := localFile.AddInstanceBinding("instance-id", "binding-2")
+			Expect(err).To(HaveOccurred())
 
-			err := localFile.AddInstance(instance)
-			Expect(err).ToNot(HaveOccurred())
+			Expect(localFile.InstanceBindingExists("instance-id", "binding-2")).To(BeFalse())
 		})
 
-		It("adds the binding to the instance", func() {
-			err := localFile.AddInstanceBinding("instance-id", "binding-1")
-			Expect(err).ToNot(HaveOccurred())
+		It("rolls back DeleteInstanceBinding", func() {
+			err := localFile.DeleteInstanceBinding("instance-id", "binding-1")
+			Expect(err).To(HaveOccurred())
 
 			Expect(localFile.InstanceBindingExists("instance-id", "binding-1")).To(BeTrue())
 		})
+	})
 
-		Context("when the instance doesn't exist", func() {
-			It("returns an error", func() {
-				err := localFile.AddInstanceBinding("instance-id-2", "binding-1")
-				Expect(err).To(MatchError("Instance not found"))
-			})
-		})
+	Describe("use from several processes", func() {
+		const bindings = 25
+
+		startWriter := func(name string) *exec.Cmd {
+			cmd := exec.Command(os.Args[0], "-test.run=TestStorage")
+			cmd.Env = append(os.Environ(),
+				"STORAGE_TEST_WRITER_FILE="+tempFileName,
+				"STORAGE_TEST_WRITER_NAME="+name,
+				fmt.Sprintf("STORAGE_TEST_WRITER_BINDINGS=%d", bindings),
+			)
+			cmd.Stdout = GinkgoWriter
+			cmd.Stderr = GinkgoWriter
+			Expect(cmd.Start()).To(Succeed())
+			return cmd
+		}
 
-		Context("when the binding id is already taken", func() {
-			It("returns an error", func() {
-				err := localFile.AddInstanceBinding("instance-id", "existing-binding")
-				Expect(err).To(MatchError("Binding ID is taken"))
-			})
+		BeforeEach(func() {
+			err := localFile.AddInstance(repository.Instance{ID: "instance-id"})
+			Expect(err).ToNot(HaveOccurred())
 		})
-	})
 
-	Describe("DeleteInstanceBinding", func() {
-		BeforeEach(func() {
-			instance := repository.Instance{
-				ID:       "instance-id",
-				Host:     "127.0.0.1",
-				Port:     "11111",
-				Bindings: []string{"existing-binding"},
+		It("doesn't lose updates", func() {
+			writers := []*exec.Cmd{startWriter("first"), startWriter("second")}
+			for _, writer := range writers {
+				Expect(writer.Wait()).To(Succeed())
 			}
 
-			err := localFile.AddInstance(instance)
+			instance, err := localFile.Instance("instance-id")
 			Expect(err).ToNot(HaveOccurred())
+			Expect(instance.Bindings).To(HaveLen(2 * bindings))
 		})
 
-		It("deletes the binding from the instance", func() {
-			err := localFile.DeleteInstanceBinding("instance-id", "existing-binding")
+		It("sees the changes of other processes before mutating", func() {
+			otherLocalFile, err := storage.NewLocalFile(tempFileName, 1)
 			Expect(err).ToNot(HaveOccurred())
+			defer otherLocalFile.Close()
 
-			Expect(localFile.InstanceBindingExists("instance-id", "existing-binding")).To(BeFalse())
-		})
+			err = otherLocalFile.AddInstanceBinding("instance-id", "binding-1")
+			Expect(err).ToNot(HaveOccurred())
 
-		Context("when the instance doesn't exist", func() {
-			It("returns an error", func() {
-				err := localFile.DeleteInstanceBinding("instance-id-2", "binding-1")
-				Expect(err).To(MatchError("Instance not found"))
-			})
-		})
+			err = localFile.AddInstanceBinding("instance-id", "binding-1")
+			Expect(err).To(MatchError("Binding ID is taken"))
 
-		Context("when the binding id doesn't exist", func() {
-			It("returns an error", func() {
-				err := localFile.DeleteInstanceBinding("instance-id", "binding-1")
-				Expect(err).To(MatchError("Binding not found"))
-			})
+			err = localFile.AddInstanceBinding("instance-id", "binding-2")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(otherLocalFile.InstanceBindingExists("instance-id", "binding-2")).To(BeTrue())
 		})
 	})
 })
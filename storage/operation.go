@@ -0,0 +1,37 @@
+package storage
+
+// The states of an Operation, as reported by the last_operation endpoints.
+const (
+	OperationInProgress = "in progress"
+	OperationSucceeded  = "succeeded"
+	OperationFailed     = "failed"
+)
+
+// The kinds of Operation on an instance, and on a binding.
+const (
+	ProvisionOperation   = "provision"
+	UpdateOperation      = "update"
+	DeprovisionOperation = "deprovision"
+	BindOperation        = "bind"
+	UnbindOperation      = "unbind"
+)
+
+// Operation is the last asynchronous operation on an instance, or on one of
+// its bindings when BindingID is set. It is kept until the next one starts,
+// or until what it operates on is deleted.
+type Operation struct {
+	ID          string `yaml:"id" json:"id"`
+	InstanceID  string `yaml:"instance_id" json:"instance_id"`
+	BindingID   string `yaml:"binding_id,omitempty" json:"binding_id,omitempty"`
+	Type        string `yaml:"type" json:"type"`
+	State       string `yaml:"state" json:"state"`
+	Description string `yaml:"description,omitempty" json:"description,omitempty"`
+
+	// PlanID is the plan an update moves the instance to.
+	PlanID string `yaml:"plan_id,omitempty" json:"plan_id,omitempty"`
+}
+
+// InProgress tells whether the operation is still running.
+func (o Operation) InProgress() bool {
+	return o.State == OperationInProgress
+}
@@ -0,0 +1,55 @@
+package storage
+
+// Option customizes a backend.
+type Option func(*options)
+
+type options struct {
+	migrationBackup bool
+	planSizes       map[string]int
+}
+
+// WithMigrationBackup keeps a copy of a state file written by an older
+// version, suffixed with that version, before it gets upgraded.
+func WithMigrationBackup() Option {
+	return func(o *options) {
+		o.migrationBackup = true
+	}
+}
+
+// WithPlanSizes makes each instance draw the size of its plan from the
+// capacity, which then is a budget, e.g. in megabytes, instead of a number
+// of instances. Plans without a size take a single unit.
+func WithPlanSizes(sizes map[string]int) Option {
+	return func(o *options) {
+		o.planSizes = map[string]int{}
+		for planID, size := range sizes {
+			o.planSizes[planID] = size
+		}
+	}
+}
+
+func (o options) planSize(planID string) int {
+	if size, exists := o.planSizes[planID]; exists && size > 0 {
+		return size
+	}
+
+	return 1
+}
+
+// availablePlanInstances is how many instances of the plan fit in capacity.
+func (o options) availablePlanInstances(capacity int, planID string) int {
+	if capacity <= 0 {
+		return 0
+	}
+
+	return capacity / o.planSize(planID)
+}
+
+func newOptions(opts []Option) options {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/tscolari/cf-broker-api/common/repository"
+)
+
+// Config names a backend and holds its options. Each backend only looks at
+// the options it needs.
+type Config struct {
+	Backend         string `yaml:"backend"`
+	Path            string `yaml:"path"`
+	Capacity        int    `yaml:"capacity"`
+	Driver          string `yaml:"driver"`
+	DataSource      string `yaml:"data_source"`
+	BackupOnMigrate bool   `yaml:"backup_on_migrate"`
+
+	// MaxOpenConnections caps the connections of the sql backend, zero
+	// leaves them unlimited. It's always 1 with sqlite3, which allows a
+	// single writer.
+	MaxOpenConnections int `yaml:"max_open_connections"`
+
+	// PlanSizes maps plan IDs to what an instance of the plan draws from
+	// Capacity, e.g. its memory in megabytes.
+	PlanSizes map[string]int `yaml:"plan_sizes"`
+}
+
+func (c Config) options() []Option {
+	opts := []Option{}
+	if c.BackupOnMigrate {
+		opts = append(opts, WithMigrationBackup())
+	}
+
+	if len(c.PlanSizes) > 0 {
+		opts = append(opts, WithPlanSizes(c.PlanSizes))
+	}
+
+	return opts
+}
+
+// Storage is the repository.State the broker works with, every backend in
+// this package implements it.
+type Storage interface {
+	repository.State
+
+	// Instances returns every instance, sorted by ID.
+	Instances() ([]repository.Instance, error)
+
+	// InstanceParameters returns the parameters the instance was
+	// provisioned with, encoded as JSON.
+	InstanceParameters(instanceID string) (string, error)
+
+	// SaveInstanceParameters records the parameters of the instance.
+	SaveInstanceParameters(instanceID, parameters string) error
+
+	// Binding returns the record of a binding of the instance.
+	Binding(instanceID, bindingID string) (*Binding, error)
+
+	// AddBinding adds the binding to its instance, and stores its record.
+	AddBinding(binding Binding) error
+
+	// Operation returns the last asynchronous operation on the instance.
+	Operation(instanceID string) (*Operation, error)
+
+	// BindingOperation returns the last asynchronous operation on a binding
+	// of the instance.
+	BindingOperation(instanceID, bindingID string) (*Operation, error)
+
+	// SaveOperation records the operation as the last one of its instance,
+	// or of its binding.
+	SaveOperation(operation Operation) error
+
+	// AvailablePlanInstances returns how many more instances of the plan
+	// fit in the remaining capacity.
+	AvailablePlanInstances(planID string) int
+
+	// PlanChangeFits tells whether the remaining capacity, with what the
+	// instance was charged, covers moving the instance to the plan.
+	PlanChangeFits(instanceID, planID string) bool
+}
+
+// Backend builds a Storage from its configuration.
+type Backend func(config Config) (Storage, error)
+
+var (
+	backends     = map[string]Backend{}
+	backendsLock sync.RWMutex
+)
+
+// Register makes a backend available to New under the given name. It panics
+// if the name is taken, as that is a programming error.
+func Register(name string, backend Backend) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+
+	if _, exists := backends[name]; exists {
+		panic(fmt.Sprintf("storage: backend %s registered twice", name))
+	}
+
+	backends[name] = backend
+}
+
+// Backends returns the names of the registered backends, sorted.
+func Backends() []string {
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+
+	names := []string{}
+	for name := range backends {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// New builds the Storage of the backend named in the configuration.
+func New(config Config) (Storage, error) {
+	backendsLock.RLock()
+	backend, exists := backends[config.Backend]
+	backendsLock.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("Unknown storage backend: %s (available: %v)", config.Backend, Backends())
+	}
+
+	return backend(config)
+}
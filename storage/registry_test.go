@@ -0,0 +1,107 @@
+package storage_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tscolari/cf-broker-api/common/repository"
+	"github.com/tscolari/memcached-broker/storage"
+)
+
+// The registry is global and has no way to take a backend back, so the
+// fake one is registered once per process, however often the suite runs.
+func init() {
+	storage.Register("registry-test-failing", func(config storage.Config) (storage.Storage, error) {
+		return nil, errors.New("failing backend")
+	})
+}
+
+var _ = Describe("Registry", func() {
+	var location string
+
+	BeforeEach(func() {
+		dir, err := ioutil.TempDir("/tmp/", "registry")
+		Expect(err).ToNot(HaveOccurred())
+		location = fmt.Sprintf("%s/state", dir)
+	})
+
+	Describe("Backends", func() {
+		It("lists the built-in backends", func() {
+			Expect(storage.Backends()).To(ContainElement("local_file"))
+			Expect(storage.Backends()).To(ContainElement("journal"))
+			Expect(storage.Backends()).To(ContainElement("bolt"))
+			Expect(storage.Backends()).To(ContainElement("sql"))
+		})
+	})
+
+	Describe("New", func() {
+		It("builds the named backend", func() {
+			state, err := storage.New(storage.Config{Backend: "local_file", Path: location, Capacity: 3})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(state).To(BeAssignableToTypeOf(&storage.LocalFile{}))
+			Expect(state.AvailableInstances()).To(Equal(3))
+		})
+
+		It("passes the plan sizes to the backend", func() {
+			state, err := storage.New(storage.Config{
+				Backend:   "local_file",
+				Path:      location,
+				Capacity:  1024,
+				PlanSizes: map[string]int{"plan-id": 256},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(state.AvailablePlanInstances("plan-id")).To(Equal(4))
+		})
+
+		It("builds the sql backend with the configured driver", func() {
+			state, err := storage.New(storage.Config{Backend: "sql", Driver: "sqlite3", DataSource: location, Capacity: 3})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(state).To(BeAssignableToTypeOf(&storage.SQL{}))
+		})
+
+		It("lets concurrent writers of the sqlite3 backend wait for each other", func() {
+			state, err := storage.New(storage.Config{Backend: "sql", Driver: "sqlite3", DataSource: location, Capacity: 1})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(state.AddInstance(repository.Instance{ID: "instance-id"})).To(Succeed())
+
+			errs := make(chan error, 50)
+			for i := 0; i < 50; i++ {
+				go func(i int) {
+					errs <- state.AddInstanceBinding("instance-id", fmt.Sprintf("binding-%d", i))
+				}(i)
+			}
+
+			for i := 0; i < 50; i++ {
+				Expect(<-errs).ToNot(HaveOccurred())
+			}
+
+			instance, err := state.Instance("instance-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(instance.Bindings).To(HaveLen(50))
+		})
+
+		It("builds registered backends", func() {
+			_, err := storage.New(storage.Config{Backend: "registry-test-failing"})
+			Expect(err).To(MatchError("failing backend"))
+		})
+
+		Context("when the backend is unknown", func() {
+			It("returns an error", func() {
+				_, err := storage.New(storage.Config{Backend: "tape"})
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("Unknown storage backend: tape"))
+			})
+		})
+	})
+
+	Describe("Register", func() {
+		It("refuses to register a name twice", func() {
+			Expect(func() {
+				storage.Register("local_file", nil)
+			}).To(Panic())
+		})
+	})
+})
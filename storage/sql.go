@@ -0,0 +1,803 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/tscolari/cf-broker-api/common/repository"
+)
+
+type sqlMigration struct {
+	version    int
+	statements []string
+}
+
+// sqlMigrations are applied in order on startup, each one in its own
+// transaction. Never change a released migration, add a new one instead.
+var sqlMigrations = []sqlMigration{
+	{
+		version: 1,
+		statements: []string{
+			`CREATE TABLE instances (
+				id VARCHAR(255) NOT NULL PRIMARY KEY,
+				service_id VARCHAR(255) NOT NULL,
+				plan_id VARCHAR(255) NOT NULL,
+				organization_id VARCHAR(255) NOT NULL,
+				space_id VARCHAR(255) NOT NULL,
+				host VARCHAR(255) NOT NULL,
+				port VARCHAR(255) NOT NULL
+			)`,
+			`CREATE TABLE bindings (
+				instance_id VARCHAR(255) NOT NULL REFERENCES instances (id),
+				id VARCHAR(255) NOT NULL,
+				position INTEGER NOT NULL,
+				PRIMARY KEY (instance_id, id)
+			)`,
+			`CREATE TABLE capacity (
+				id INTEGER NOT NULL PRIMARY KEY CHECK (id = 1),
+				available INTEGER NOT NULL CHECK (available >= 0)
+			)`,
+		},
+	},
+	{
+		version: 2,
+		statements: []string{
+			`ALTER TABLE instances ADD COLUMN charge INTEGER NOT NULL DEFAULT 1`,
+		},
+	},
+	{
+		version: 3,
+		statements: []string{
+			`ALTER TABLE bindings ADD COLUMN username VARCHAR(255) NOT NULL DEFAULT ''`,
+			`ALTER TABLE bindings ADD COLUMN password VARCHAR(255) NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version: 4,
+		statements: []string{
+			`CREATE TABLE operations (
+				instance_id VARCHAR(255) NOT NULL PRIMARY KEY REFERENCES instances (id),
+				id VARCHAR(255) NOT NULL,
+				type VARCHAR(255) NOT NULL,
+				state VARCHAR(255) NOT NULL,
+				description TEXT NOT NULL,
+				plan_id VARCHAR(255) NOT NULL
+			)`,
+		},
+	},
+	{
+		version: 5,
+		statements: []string{
+			`CREATE TABLE binding_operations (
+				instance_id VARCHAR(255) NOT NULL REFERENCES instances (id),
+				binding_id VARCHAR(255) NOT NULL,
+				id VARCHAR(255) NOT NULL,
+				type VARCHAR(255) NOT NULL,
+				state VARCHAR(255) NOT NULL,
+				description TEXT NOT NULL,
+				PRIMARY KEY (instance_id, binding_id)
+			)`,
+		},
+	},
+	{
+		version: 6,
+		statements: []string{
+			`ALTER TABLE instances ADD COLUMN parameters TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE bindings ADD COLUMN service_id VARCHAR(255) NOT NULL DEFAULT ''`,
+			`ALTER TABLE bindings ADD COLUMN plan_id VARCHAR(255) NOT NULL DEFAULT ''`,
+			`ALTER TABLE bindings ADD COLUMN app_guid VARCHAR(255) NOT NULL DEFAULT ''`,
+			`ALTER TABLE bindings ADD COLUMN parameters TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version: 7,
+		statements: []string{
+			`ALTER TABLE instances ADD COLUMN bindings_listed INTEGER NOT NULL DEFAULT 1`,
+		},
+	},
+}
+
+// sqliteBusyTimeout is how long, in milliseconds, a SQLite connection
+// waits for the lock of another writer before failing with "database is
+// locked".
+const sqliteBusyTimeout = 5000
+
+// The database driver named in the configuration has to be linked into the
+// binary.
+func init() {
+	Register("sql", func(config Config) (Storage, error) {
+		db, err := openSQL(config)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewSQL(db, config.Capacity, config.options()...)
+	})
+}
+
+// openSQL opens the configured database. SQLite allows a single writer, so
+// its callers queue for one connection, which waits for the locks of other
+// processes instead of failing right away.
+func openSQL(config Config) (*sql.DB, error) {
+	dataSource := config.DataSource
+	maxOpenConnections := config.MaxOpenConnections
+
+	if config.Driver == "sqlite3" {
+		if !strings.Contains(dataSource, "_busy_timeout=") {
+			separator := "?"
+			if strings.Contains(dataSource, "?") {
+				separator = "&"
+			}
+			dataSource += fmt.Sprintf("%s_busy_timeout=%d", separator, sqliteBusyTimeout)
+		}
+
+		maxOpenConnections = 1
+	}
+
+	db, err := sql.Open(config.Driver, dataSource)
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(maxOpenConnections)
+	return db, nil
+}
+
+func NewSQL(db *sql.DB, capacity int, opts ...Option) (*SQL, error) {
+	sqlState := &SQL{
+		db:       db,
+		capacity: capacity,
+		options:  newOptions(opts),
+	}
+
+	err := sqlState.migrate()
+	if err != nil {
+		return nil, err
+	}
+
+	return sqlState, nil
+}
+
+// SQL keeps the instances in a relational database through database/sql.
+// Every method runs in its own transaction, and the capacity is enforced by
+// the database: a single `capacity` row that can't go below zero.
+//
+// Queries use `?` placeholders, as understood by the SQLite and MySQL
+// drivers.
+//
+// The capacity given to NewSQL is only used until the first change is
+// written, from then on the stored one is used.
+type SQL struct {
+	db       *sql.DB
+	capacity int
+	options  options
+}
+
+func (s *SQL) AvailableInstances() int {
+	var available int
+	err := s.db.QueryRow(`SELECT available FROM capacity WHERE id = 1`).Scan(&available)
+	if err == sql.ErrNoRows {
+		return s.capacity
+	}
+
+	if err != nil {
+		return 0
+	}
+
+	return available
+}
+
+// AvailablePlanInstances returns how many more instances of the plan fit in
+// the remaining capacity.
+func (s *SQL) AvailablePlanInstances(planID string) int {
+	return s.options.availablePlanInstances(s.AvailableInstances(), planID)
+}
+
+// PlanChangeFits tells whether the remaining capacity, with what the
+// instance was charged, covers moving the instance to the plan.
+func (s *SQL) PlanChangeFits(instanceID, planID string) bool {
+	var charge int
+	err := s.db.QueryRow(`SELECT charge FROM instances WHERE id = ?`, instanceID).Scan(&charge)
+	if err != nil {
+		return false
+	}
+
+	return s.options.planSize(planID)-charge <= s.AvailableInstances()
+}
+
+func (s *SQL) InstanceExists(instanceID string) bool {
+	_, err := s.Instance(instanceID)
+	return err == nil
+}
+
+func (s *SQL) Instance(instanceID string) (*repository.Instance, error) {
+	var instance *repository.Instance
+	err := s.transaction(func(tx *sql.Tx) error {
+		var err error
+		instance, err = readSQLInstance(tx, instanceID)
+		return err
+	})
+
+	return instance, err
+}
+
+func (s *SQL) Instances() ([]repository.Instance, error) {
+	instances := []repository.Instance{}
+	err := s.transaction(func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT id FROM instances ORDER BY id`)
+		if err != nil {
+			return err
+		}
+
+		instanceIDs := []string{}
+		for rows.Next() {
+			var instanceID string
+			if err := rows.Scan(&instanceID); err != nil {
+				rows.Close()
+				return err
+			}
+			instanceIDs = append(instanceIDs, instanceID)
+		}
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, instanceID := range instanceIDs {
+			instance, err := readSQLInstance(tx, instanceID)
+			if err != nil {
+				return err
+			}
+			instances = append(instances, *instance)
+		}
+
+		return nil
+	})
+
+	return instances, err
+}
+
+func (s *SQL) AddInstance(instance repository.Instance) error {
+	return s.transaction(func(tx *sql.Tx) error {
+		err := s.initializeCapacity(tx)
+		if err != nil {
+			return err
+		}
+
+		if _, err := readSQLInstance(tx, instance.ID); err == nil {
+			return errInstanceIDTaken
+		}
+
+		if err := checkSQLAddress(tx, instance); err != nil {
+			return err
+		}
+
+		size := s.options.planSize(instance.PlanID)
+		err = chargeSQLCapacity(tx, size)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			`INSERT INTO instances (id, service_id, plan_id, organization_id, space_id, host, port, charge) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			instance.ID, instance.ServiceID, instance.PlanID, instance.OrganizationID, instance.SpaceID, instance.Host, instance.Port, size,
+		)
+		if err != nil {
+			return err
+		}
+
+		return writeSQLBindings(tx, instance.ID, instance.Bindings)
+	})
+}
+
+func (s *SQL) UpdateInstance(instance repository.Instance) error {
+	return s.transaction(func(tx *sql.Tx) error {
+		var charge int
+		err := tx.QueryRow(`SELECT charge FROM instances WHERE id = ?`, instance.ID).Scan(&charge)
+		if err == sql.ErrNoRows {
+			return errInstanceNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := checkSQLAddress(tx, instance); err != nil {
+			return err
+		}
+
+		size := s.options.planSize(instance.PlanID)
+		if size != charge {
+			err = s.initializeCapacity(tx)
+			if err != nil {
+				return err
+			}
+
+			err = chargeSQLCapacity(tx, size-charge)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.Exec(
+			`UPDATE instances SET service_id = ?, plan_id = ?, organization_id = ?, space_id = ?, host = ?, port = ?, charge = ? WHERE id = ?`,
+			instance.ServiceID, instance.PlanID, instance.OrganizationID, instance.SpaceID, instance.Host, instance.Port, size, instance.ID,
+		)
+		if err != nil {
+			return err
+		}
+
+		return writeSQLBindings(tx, instance.ID, instance.Bindings)
+	})
+}
+
+func (s *SQL) DeleteInstance(instanceID string) error {
+	return s.transaction(func(tx *sql.Tx) error {
+		err := s.initializeCapacity(tx)
+		if err != nil {
+			return err
+		}
+
+		var charge int
+		err = tx.QueryRow(`SELECT charge FROM instances WHERE id = ?`, instanceID).Scan(&charge)
+		if err == sql.ErrNoRows {
+			return errInstanceNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`DELETE FROM bindings WHERE instance_id = ?`, instanceID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`DELETE FROM operations WHERE instance_id = ?`, instanceID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`DELETE FROM binding_operations WHERE instance_id = ?`, instanceID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`DELETE FROM instances WHERE id = ?`, instanceID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`UPDATE capacity SET available = available + ? WHERE id = 1`, charge)
+		return err
+	})
+}
+
+func (s *SQL) InstanceParameters(instanceID string) (string, error) {
+	var parameters string
+	err := s.db.QueryRow(`SELECT parameters FROM instances WHERE id = ?`, instanceID).Scan(&parameters)
+	if err == sql.ErrNoRows {
+		return "", errInstanceNotFound
+	}
+
+	return parameters, err
+}
+
+func (s *SQL) SaveInstanceParameters(instanceID, parameters string) error {
+	return s.transaction(func(tx *sql.Tx) error {
+		result, err := tx.Exec(`UPDATE instances SET parameters = ? WHERE id = ?`, parameters, instanceID)
+		if err != nil {
+			return err
+		}
+
+		if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+			return errInstanceNotFound
+		}
+
+		return nil
+	})
+}
+
+func (s *SQL) InstanceBindingExists(instanceID, bindingID string) bool {
+	var count int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM bindings WHERE instance_id = ? AND id = ?`, instanceID, bindingID).Scan(&count)
+	return err == nil && count > 0
+}
+
+func (s *SQL) AddInstanceBinding(instanceID, bindingID string) error {
+	return s.AddBinding(Binding{ID: bindingID, InstanceID: instanceID})
+}
+
+func (s *SQL) Binding(instanceID, bindingID string) (*Binding, error) {
+	binding := &Binding{ID: bindingID, InstanceID: instanceID}
+	err := s.transaction(func(tx *sql.Tx) error {
+		if _, err := readSQLInstance(tx, instanceID); err != nil {
+			return err
+		}
+
+		err := tx.QueryRow(
+			`SELECT username, password, service_id, plan_id, app_guid, parameters FROM bindings WHERE instance_id = ? AND id = ?`,
+			instanceID, bindingID,
+		).Scan(
+			&binding.Credentials.Username, &binding.Credentials.Password,
+			&binding.ServiceID, &binding.PlanID, &binding.AppGUID, &binding.Parameters,
+		)
+		if err == sql.ErrNoRows {
+			return errBindingNotFound
+		}
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return binding, nil
+}
+
+func (s *SQL) AddBinding(binding Binding) error {
+	return s.transaction(func(tx *sql.Tx) error {
+		instance, err := readSQLInstance(tx, binding.InstanceID)
+		if err != nil {
+			return err
+		}
+
+		for _, bindingID := range instance.Bindings {
+			if bindingID == binding.ID {
+				return errBindingIDTaken
+			}
+		}
+
+		_, err = tx.Exec(`UPDATE instances SET bindings_listed = 1 WHERE id = ?`, binding.InstanceID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			`INSERT INTO bindings (instance_id, id, position, username, password, service_id, plan_id, app_guid, parameters) SELECT ?, ?, COALESCE(MAX(position), -1) + 1, ?, ?, ?, ?, ?, ? FROM bindings WHERE instance_id = ?`,
+			binding.InstanceID, binding.ID, binding.Credentials.Username, binding.Credentials.Password,
+			binding.ServiceID, binding.PlanID, binding.AppGUID, binding.Parameters, binding.InstanceID,
+		)
+		return err
+	})
+}
+
+func (s *SQL) DeleteInstanceBinding(instanceID, bindingID string) error {
+	return s.transaction(func(tx *sql.Tx) error {
+		if _, err := readSQLInstance(tx, instanceID); err != nil {
+			return err
+		}
+
+		result, err := tx.Exec(`DELETE FROM bindings WHERE instance_id = ? AND id = ?`, instanceID, bindingID)
+		if err != nil {
+			return err
+		}
+
+		if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+			return errBindingNotFound
+		}
+
+		_, err = tx.Exec(`DELETE FROM binding_operations WHERE instance_id = ? AND binding_id = ?`, instanceID, bindingID)
+		return err
+	})
+}
+
+func (s *SQL) Operation(instanceID string) (*Operation, error) {
+	operation := &Operation{InstanceID: instanceID}
+	err := s.transaction(func(tx *sql.Tx) error {
+		if _, err := readSQLInstance(tx, instanceID); err != nil {
+			return err
+		}
+
+		err := tx.QueryRow(
+			`SELECT id, type, state, description, plan_id FROM operations WHERE instance_id = ?`,
+			instanceID,
+		).Scan(&operation.ID, &operation.Type, &operation.State, &operation.Description, &operation.PlanID)
+		if err == sql.ErrNoRows {
+			return errOperationNotFound
+		}
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return operation, nil
+}
+
+func (s *SQL) BindingOperation(instanceID, bindingID string) (*Operation, error) {
+	operation := &Operation{InstanceID: instanceID, BindingID: bindingID}
+	err := s.transaction(func(tx *sql.Tx) error {
+		if err := checkSQLBinding(tx, instanceID, bindingID); err != nil {
+			return err
+		}
+
+		err := tx.QueryRow(
+			`SELECT id, type, state, description FROM binding_operations WHERE instance_id = ? AND binding_id = ?`,
+			instanceID, bindingID,
+		).Scan(&operation.ID, &operation.Type, &operation.State, &operation.Description)
+		if err == sql.ErrNoRows {
+			return errOperationNotFound
+		}
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return operation, nil
+}
+
+func (s *SQL) SaveOperation(operation Operation) error {
+	if operation.BindingID != "" {
+		return s.saveBindingOperation(operation)
+	}
+
+	return s.transaction(func(tx *sql.Tx) error {
+		if _, err := readSQLInstance(tx, operation.InstanceID); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(`DELETE FROM operations WHERE instance_id = ?`, operation.InstanceID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			`INSERT INTO operations (instance_id, id, type, state, description, plan_id) VALUES (?, ?, ?, ?, ?, ?)`,
+			operation.InstanceID, operation.ID, operation.Type, operation.State, operation.Description, operation.PlanID,
+		)
+		return err
+	})
+}
+
+func (s *SQL) saveBindingOperation(operation Operation) error {
+	return s.transaction(func(tx *sql.Tx) error {
+		if err := checkSQLBinding(tx, operation.InstanceID, operation.BindingID); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(
+			`DELETE FROM binding_operations WHERE instance_id = ? AND binding_id = ?`,
+			operation.InstanceID, operation.BindingID,
+		)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			`INSERT INTO binding_operations (instance_id, binding_id, id, type, state, description) VALUES (?, ?, ?, ?, ?, ?)`,
+			operation.InstanceID, operation.BindingID, operation.ID, operation.Type, operation.State, operation.Description,
+		)
+		return err
+	})
+}
+
+func (s *SQL) transaction(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// initializeCapacity stores the capacity given to NewSQL, unless one is
+// stored already.
+func (s *SQL) initializeCapacity(tx *sql.Tx) error {
+	_, err := tx.Exec(
+		`INSERT INTO capacity (id, available) SELECT 1, ? WHERE NOT EXISTS (SELECT id FROM capacity WHERE id = 1)`,
+		s.capacity,
+	)
+	return err
+}
+
+// chargeSQLCapacity takes size from the available capacity, a negative size
+// refunds it. It fails without changes if there isn't enough left.
+func chargeSQLCapacity(tx *sql.Tx, size int) error {
+	result, err := tx.Exec(
+		`UPDATE capacity SET available = available - ? WHERE id = 1 AND available >= ?`,
+		size, size,
+	)
+	if err != nil {
+		return err
+	}
+
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return ErrNoCapacity
+	}
+
+	return nil
+}
+
+func (s *SQL) migrate() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL PRIMARY KEY)`)
+	if err != nil {
+		return err
+	}
+
+	var current int
+	err = s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range sqlMigrations {
+		if migration.version <= current {
+			continue
+		}
+
+		err = s.transaction(func(tx *sql.Tx) error {
+			for _, statement := range migration.statements {
+				if _, err := tx.Exec(statement); err != nil {
+					return err
+				}
+			}
+
+			_, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, migration.version)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readSQLInstance returns the instance with its bindings. An instance
+// without bindings has an empty list of them, unless it was stored without
+// any list, as the other backends return it.
+func readSQLInstance(tx *sql.Tx, instanceID string) (*repository.Instance, error) {
+	instance := repository.Instance{}
+	var bindingsListed bool
+	err := tx.QueryRow(
+		`SELECT id, service_id, plan_id, organization_id, space_id, host, port, bindings_listed FROM instances WHERE id = ?`,
+		instanceID,
+	).Scan(&instance.ID, &instance.ServiceID, &instance.PlanID, &instance.OrganizationID, &instance.SpaceID, &instance.Host, &instance.Port, &bindingsListed)
+	if err == sql.ErrNoRows {
+		return nil, errInstanceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(`SELECT id FROM bindings WHERE instance_id = ? ORDER BY position`, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if bindingsListed {
+		instance.Bindings = []string{}
+	}
+
+	for rows.Next() {
+		var bindingID string
+		if err := rows.Scan(&bindingID); err != nil {
+			return nil, err
+		}
+		instance.Bindings = append(instance.Bindings, bindingID)
+	}
+
+	return &instance, rows.Err()
+}
+
+// checkSQLAddress fails if another instance points at the same host and
+// port.
+func checkSQLAddress(tx *sql.Tx, instance repository.Instance) error {
+	if instance.Host == "" && instance.Port == "" {
+		return nil
+	}
+
+	var count int
+	err := tx.QueryRow(
+		`SELECT COUNT(*) FROM instances WHERE host = ? AND port = ? AND id <> ?`,
+		instance.Host, instance.Port, instance.ID,
+	).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return errAddressTaken
+	}
+
+	return nil
+}
+
+// checkSQLBinding fails unless the instance has the binding.
+func checkSQLBinding(tx *sql.Tx, instanceID, bindingID string) error {
+	if _, err := readSQLInstance(tx, instanceID); err != nil {
+		return err
+	}
+
+	var count int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM bindings WHERE instance_id = ? AND id = ?`, instanceID, bindingID).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return errBindingNotFound
+	}
+
+	return nil
+}
+
+// writeSQLBindings makes the bindings of the instance match the given list,
+// keeping the records of the ones that stay.
+func writeSQLBindings(tx *sql.Tx, instanceID string, bindings []string) error {
+	_, err := tx.Exec(`UPDATE instances SET bindings_listed = ? WHERE id = ?`, bindings != nil, instanceID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`SELECT id FROM bindings WHERE instance_id = ?`, instanceID)
+	if err != nil {
+		return err
+	}
+
+	stored := map[string]bool{}
+	for rows.Next() {
+		var bindingID string
+		if err := rows.Scan(&bindingID); err != nil {
+			rows.Close()
+			return err
+		}
+		stored[bindingID] = true
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	kept := map[string]bool{}
+	for _, bindingID := range bindings {
+		kept[bindingID] = true
+	}
+
+	for bindingID := range stored {
+		if kept[bindingID] {
+			continue
+		}
+
+		_, err = tx.Exec(`DELETE FROM bindings WHERE instance_id = ? AND id = ?`, instanceID, bindingID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`DELETE FROM binding_operations WHERE instance_id = ? AND binding_id = ?`, instanceID, bindingID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for position, bindingID := range bindings {
+		if stored[bindingID] {
+			_, err = tx.Exec(
+				`UPDATE bindings SET position = ? WHERE instance_id = ? AND id = ?`,
+				position, instanceID, bindingID,
+			)
+		} else {
+			_, err = tx.Exec(
+				`INSERT INTO bindings (instance_id, id, position) VALUES (?, ?, ?)`,
+				instanceID, bindingID, position,
+			)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
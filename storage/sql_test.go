@@ -0,0 +1,96 @@
+package storage_test
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tscolari/cf-broker-api/common/repository"
+	"github.com/tscolari/memcached-broker/storage"
+)
+
+func openSQLite(location string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", location+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows a single writer, let database/sql queue the callers.
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+var _ = Describe("SQL", func() {
+	var sqlState *storage.SQL
+	var db *sql.DB
+
+	BeforeEach(func() {
+		dir, err := ioutil.TempDir("/tmp/", "sql")
+		Expect(err).ToNot(HaveOccurred())
+
+		db, err = openSQLite(fmt.Sprintf("%s/state.db", dir))
+		Expect(err).ToNot(HaveOccurred())
+
+		sqlState, err = storage.NewSQL(db, 5)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	itBehavesLikeAState(func(location string, capacity int, opts ...storage.Option) (storage.Storage, error) {
+		db, err := openSQLite(location)
+		if err != nil {
+			return nil, err
+		}
+
+		return storage.NewSQL(db, capacity, opts...)
+	})
+
+	Describe("NewSQL", func() {
+		It("records the applied migrations", func() {
+			var version int
+			err := db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(version).To(Equal(7))
+		})
+
+		It("can run against an already migrated database", func() {
+			_, err := storage.NewSQL(db, 5)
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	Describe("capacity", func() {
+		BeforeEach(func() {
+			err := sqlState.AddInstance(repository.Instance{ID: "instance-id"})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("is kept in the database", func() {
+			var available int
+			err := db.QueryRow(`SELECT available FROM capacity`).Scan(&available)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(available).To(Equal(4))
+		})
+
+		It("is not allowed to go below zero", func() {
+			_, err := db.Exec(`UPDATE capacity SET available = -1`)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("DeleteInstance", func() {
+		It("removes the bindings of the instance", func() {
+			err := sqlState.AddInstance(repository.Instance{ID: "instance-id", Bindings: []string{"binding-1"}})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(sqlState.DeleteInstance("instance-id")).To(Succeed())
+
+			var count int
+			err = db.QueryRow(`SELECT COUNT(*) FROM bindings`).Scan(&count)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(count).To(Equal(0))
+		})
+	})
+})
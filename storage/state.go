@@ -0,0 +1,477 @@
+package storage
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/tscolari/cf-broker-api/common/repository"
+)
+
+// ErrNoCapacity is returned when adding an instance, or moving it to a
+// larger plan, would take more than the capacity left.
+var ErrNoCapacity = errors.New("Can't allocate instance, no capacity")
+
+var (
+	errInstanceIDTaken   = errors.New("Instance ID is taken")
+	errInstanceNotFound  = errors.New("Instance not found")
+	errBindingIDTaken    = errors.New("Binding ID is taken")
+	errBindingNotFound   = errors.New("Binding not found")
+	errAddressTaken      = errors.New("Instance address is taken")
+	errOperationNotFound = errors.New("Operation not found")
+)
+
+// State is the document persisted by the file based backends.
+//
+// Capacity is what is left of the budget, in the units of the plan sizes.
+// Charges records what each instance was charged, so it gets refunded in
+// full even if the plan sizes change in the meantime. Bindings holds the
+// binding records by instance and binding ID, and Parameters the
+// parameters of each instance. Operations and
+// BindingOperations hold the last asynchronous operation of each instance
+// and binding.
+type State struct {
+	Version           int                             `yaml:"version"`
+	Capacity          int                             `yaml:"capacity"`
+	Instances         map[string]repository.Instance  `yaml:"instances"`
+	Charges           map[string]int                  `yaml:"charges"`
+	Bindings          map[string]map[string]Binding   `yaml:"bindings"`
+	Parameters        map[string]string               `yaml:"parameters"`
+	Operations        map[string]Operation            `yaml:"operations"`
+	BindingOperations map[string]map[string]Operation `yaml:"binding_operations"`
+}
+
+func newState(capacity int) State {
+	state := State{
+		Version:   CurrentStateVersion,
+		Capacity:  capacity,
+		Instances: map[string]repository.Instance{},
+	}
+
+	state.initializeMaps()
+	return state
+}
+
+// initializeMaps fills in the maps a decoded document left out.
+func (s *State) initializeMaps() {
+	if s.Charges == nil {
+		s.Charges = map[string]int{}
+	}
+
+	if s.Bindings == nil {
+		s.Bindings = map[string]map[string]Binding{}
+	}
+
+	if s.Parameters == nil {
+		s.Parameters = map[string]string{}
+	}
+
+	if s.Operations == nil {
+		s.Operations = map[string]Operation{}
+	}
+
+	if s.BindingOperations == nil {
+		s.BindingOperations = map[string]map[string]Operation{}
+	}
+}
+
+func (s State) clone() State {
+	instances := make(map[string]repository.Instance, len(s.Instances))
+	for id, instance := range s.Instances {
+		instances[id] = copyInstance(instance)
+	}
+
+	charges := make(map[string]int, len(s.Charges))
+	for id, charge := range s.Charges {
+		charges[id] = charge
+	}
+
+	bindings := make(map[string]map[string]Binding, len(s.Bindings))
+	for instanceID, instanceBindings := range s.Bindings {
+		bindings[instanceID] = make(map[string]Binding, len(instanceBindings))
+		for bindingID, binding := range instanceBindings {
+			bindings[instanceID][bindingID] = binding
+		}
+	}
+
+	parameters := make(map[string]string, len(s.Parameters))
+	for id, instanceParameters := range s.Parameters {
+		parameters[id] = instanceParameters
+	}
+
+	operations := make(map[string]Operation, len(s.Operations))
+	for id, operation := range s.Operations {
+		operations[id] = operation
+	}
+
+	bindingOperations := make(map[string]map[string]Operation, len(s.BindingOperations))
+	for instanceID, instanceOperations := range s.BindingOperations {
+		bindingOperations[instanceID] = make(map[string]Operation, len(instanceOperations))
+		for bindingID, operation := range instanceOperations {
+			bindingOperations[instanceID][bindingID] = operation
+		}
+	}
+
+	s.Instances = instances
+	s.Charges = charges
+	s.Bindings = bindings
+	s.Parameters = parameters
+	s.Operations = operations
+	s.BindingOperations = bindingOperations
+	return s
+}
+
+func (s State) instance(instanceID string) (*repository.Instance, error) {
+	if instance, exists := s.Instances[instanceID]; exists {
+		instance = copyInstance(instance)
+		return &instance, nil
+	}
+
+	return nil, errInstanceNotFound
+}
+
+// instances returns copies of every instance, sorted by ID.
+func (s State) instances() []repository.Instance {
+	instances := make([]repository.Instance, 0, len(s.Instances))
+	for _, instance := range s.Instances {
+		instances = append(instances, copyInstance(instance))
+	}
+
+	sortInstances(instances)
+	return instances
+}
+
+// addressTaken tells if another instance points at the same host and port.
+func (s State) addressTaken(instance repository.Instance) bool {
+	if instance.Host == "" && instance.Port == "" {
+		return false
+	}
+
+	for id, other := range s.Instances {
+		if id != instance.ID && other.Host == instance.Host && other.Port == instance.Port {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s State) instanceBindingExists(instanceID, bindingID string) bool {
+	instance, err := s.instance(instanceID)
+	if err != nil {
+		return false
+	}
+
+	for _, binding := range instance.Bindings {
+		if binding == bindingID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// charge returns what the instance was charged. Instances stored before
+// charges were recorded took a single unit.
+func (s State) charge(instanceID string) int {
+	if charge, exists := s.Charges[instanceID]; exists {
+		return charge
+	}
+
+	return 1
+}
+
+// checkAddInstance tells why addInstance would fail, without changing
+// anything. The other check functions do the same for their mutation.
+func (s State) checkAddInstance(instance repository.Instance, size int) error {
+	if s.Capacity < size || s.Capacity <= 0 {
+		return ErrNoCapacity
+	}
+
+	if _, exists := s.Instances[instance.ID]; exists {
+		return errInstanceIDTaken
+	}
+
+	if s.addressTaken(instance) {
+		return errAddressTaken
+	}
+
+	return nil
+}
+
+// addInstance charges size to the capacity.
+func (s *State) addInstance(instance repository.Instance, size int) error {
+	if err := s.checkAddInstance(instance, size); err != nil {
+		return err
+	}
+
+	s.Capacity -= size
+	s.Instances[instance.ID] = copyInstance(instance)
+	s.Charges[instance.ID] = size
+	return nil
+}
+
+// planChangeFits tells whether the capacity covers the difference between
+// size and what the instance was charged so far.
+func (s State) planChangeFits(instanceID string, size int) bool {
+	if _, exists := s.Instances[instanceID]; !exists {
+		return false
+	}
+
+	return size-s.charge(instanceID) <= s.Capacity
+}
+
+func (s State) checkUpdateInstance(instance repository.Instance, size int) error {
+	if _, exists := s.Instances[instance.ID]; !exists {
+		return errInstanceNotFound
+	}
+
+	if s.addressTaken(instance) {
+		return errAddressTaken
+	}
+
+	if size-s.charge(instance.ID) > s.Capacity {
+		return ErrNoCapacity
+	}
+
+	return nil
+}
+
+// updateInstance charges, or refunds, the difference between size and what
+// the instance was charged so far.
+func (s *State) updateInstance(instance repository.Instance, size int) error {
+	if err := s.checkUpdateInstance(instance, size); err != nil {
+		return err
+	}
+
+	s.Capacity -= size - s.charge(instance.ID)
+	s.Instances[instance.ID] = copyInstance(instance)
+	s.Charges[instance.ID] = size
+
+	// Drop the records of bindings the instance no longer has.
+	for bindingID := range s.Bindings[instance.ID] {
+		if !s.instanceBindingExists(instance.ID, bindingID) {
+			delete(s.Bindings[instance.ID], bindingID)
+		}
+	}
+
+	for bindingID := range s.BindingOperations[instance.ID] {
+		if !s.instanceBindingExists(instance.ID, bindingID) {
+			delete(s.BindingOperations[instance.ID], bindingID)
+		}
+	}
+	return nil
+}
+
+func (s State) checkInstance(instanceID string) error {
+	if _, exists := s.Instances[instanceID]; !exists {
+		return errInstanceNotFound
+	}
+
+	return nil
+}
+
+func (s *State) deleteInstance(instanceID string) error {
+	if err := s.checkInstance(instanceID); err != nil {
+		return err
+	}
+
+	s.Capacity += s.charge(instanceID)
+	delete(s.Instances, instanceID)
+	delete(s.Charges, instanceID)
+	delete(s.Bindings, instanceID)
+	delete(s.Parameters, instanceID)
+	delete(s.Operations, instanceID)
+	delete(s.BindingOperations, instanceID)
+	return nil
+}
+
+func (s State) instanceParameters(instanceID string) (string, error) {
+	if _, exists := s.Instances[instanceID]; !exists {
+		return "", errInstanceNotFound
+	}
+
+	return s.Parameters[instanceID], nil
+}
+
+func (s *State) saveInstanceParameters(instanceID, parameters string) error {
+	if err := s.checkInstance(instanceID); err != nil {
+		return err
+	}
+
+	if parameters == "" {
+		delete(s.Parameters, instanceID)
+		return nil
+	}
+
+	s.Parameters[instanceID] = parameters
+	return nil
+}
+
+func (s State) operation(instanceID string) (*Operation, error) {
+	if _, exists := s.Instances[instanceID]; !exists {
+		return nil, errInstanceNotFound
+	}
+
+	if operation, exists := s.Operations[instanceID]; exists {
+		return &operation, nil
+	}
+
+	return nil, errOperationNotFound
+}
+
+func (s State) bindingOperation(instanceID, bindingID string) (*Operation, error) {
+	if _, err := s.binding(instanceID, bindingID); err != nil {
+		return nil, err
+	}
+
+	if operation, exists := s.BindingOperations[instanceID][bindingID]; exists {
+		return &operation, nil
+	}
+
+	return nil, errOperationNotFound
+}
+
+func (s State) checkSaveOperation(operation Operation) error {
+	if err := s.checkInstance(operation.InstanceID); err != nil {
+		return err
+	}
+
+	if operation.BindingID != "" && !s.instanceBindingExists(operation.InstanceID, operation.BindingID) {
+		return errBindingNotFound
+	}
+
+	return nil
+}
+
+// saveOperation replaces the last operation of its instance, or binding.
+func (s *State) saveOperation(operation Operation) error {
+	if err := s.checkSaveOperation(operation); err != nil {
+		return err
+	}
+
+	if operation.BindingID == "" {
+		s.Operations[operation.InstanceID] = operation
+		return nil
+	}
+
+	if s.BindingOperations[operation.InstanceID] == nil {
+		s.BindingOperations[operation.InstanceID] = map[string]Operation{}
+	}
+
+	s.BindingOperations[operation.InstanceID][operation.BindingID] = operation
+	return nil
+}
+
+// binding returns the record of the binding. Bindings added before records
+// were kept get one without credentials.
+func (s State) binding(instanceID, bindingID string) (*Binding, error) {
+	if _, exists := s.Instances[instanceID]; !exists {
+		return nil, errInstanceNotFound
+	}
+
+	if !s.instanceBindingExists(instanceID, bindingID) {
+		return nil, errBindingNotFound
+	}
+
+	if binding, exists := s.Bindings[instanceID][bindingID]; exists {
+		return &binding, nil
+	}
+
+	return &Binding{ID: bindingID, InstanceID: instanceID}, nil
+}
+
+func (s *State) addBinding(binding Binding) error {
+	err := s.addInstanceBinding(binding.InstanceID, binding.ID)
+	if err != nil {
+		return err
+	}
+
+	if s.Bindings[binding.InstanceID] == nil {
+		s.Bindings[binding.InstanceID] = map[string]Binding{}
+	}
+
+	s.Bindings[binding.InstanceID][binding.ID] = binding
+	return nil
+}
+
+func (s State) checkAddInstanceBinding(instanceID, bindingID string) error {
+	if err := s.checkInstance(instanceID); err != nil {
+		return err
+	}
+
+	if s.instanceBindingExists(instanceID, bindingID) {
+		return errBindingIDTaken
+	}
+
+	return nil
+}
+
+func (s *State) addInstanceBinding(instanceID, bindingID string) error {
+	if err := s.checkAddInstanceBinding(instanceID, bindingID); err != nil {
+		return err
+	}
+
+	instance, err := s.instance(instanceID)
+	if err != nil {
+		return err
+	}
+
+	instance.Bindings = append(instance.Bindings, bindingID)
+	s.Instances[instanceID] = *instance
+	return nil
+}
+
+func (s State) checkDeleteInstanceBinding(instanceID, bindingID string) error {
+	if err := s.checkInstance(instanceID); err != nil {
+		return err
+	}
+
+	if !s.instanceBindingExists(instanceID, bindingID) {
+		return errBindingNotFound
+	}
+
+	return nil
+}
+
+func (s *State) deleteInstanceBinding(instanceID, bindingID string) error {
+	instance, err := s.instance(instanceID)
+	if err != nil {
+		return err
+	}
+
+	for i, binding := range instance.Bindings {
+		if binding == bindingID {
+			instance.Bindings = append(instance.Bindings[:i], instance.Bindings[i+1:]...)
+			s.Instances[instanceID] = *instance
+
+			delete(s.Bindings[instanceID], bindingID)
+			if len(s.Bindings[instanceID]) == 0 {
+				delete(s.Bindings, instanceID)
+			}
+
+			delete(s.BindingOperations[instanceID], bindingID)
+			if len(s.BindingOperations[instanceID]) == 0 {
+				delete(s.BindingOperations, instanceID)
+			}
+			return nil
+		}
+	}
+
+	return errBindingNotFound
+}
+
+// copyInstance detaches the bindings slice, so instances handed in or out
+// never share memory with the stored state.
+func copyInstance(instance repository.Instance) repository.Instance {
+	if instance.Bindings != nil {
+		instance.Bindings = append(make([]string, 0, len(instance.Bindings)), instance.Bindings...)
+	}
+
+	return instance
+}
+
+func sortInstances(instances []repository.Instance) {
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].ID < instances[j].ID
+	})
+}
@@ -0,0 +1,880 @@
+package storage_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tscolari/cf-broker-api/common/repository"
+	"github.com/tscolari/memcached-broker/storage"
+)
+
+type stateConstructor func(location string, capacity int, opts ...storage.Option) (storage.Storage, error)
+
+// itBehavesLikeAState holds the behaviour every repository.State backend in
+// this package has to share. newState is called with the same location to
+// reopen the state from disk.
+func itBehavesLikeAState(newState stateConstructor) {
+	var state storage.Storage
+	var location string
+
+	BeforeEach(func() {
+		dir, err := ioutil.TempDir("/tmp/", "state")
+		Expect(err).ToNot(HaveOccurred())
+
+		location = fmt.Sprintf("%s/state.yml", dir)
+		state, err = newState(location, 1)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	Describe("InstanceExists", func() {
+		Context("when the instance exists", func() {
+			BeforeEach(func() {
+				state.AddInstance(repository.Instance{ID: "instance-id"})
+			})
+
+			It("returns true", func() {
+				Expect(state.InstanceExists("instance-id")).To(BeTrue())
+			})
+		})
+
+		Context("when the instance doesn't exist", func() {
+			It("returns false", func() {
+				Expect(state.InstanceExists("not-here-id")).To(BeFalse())
+			})
+		})
+	})
+
+	Describe("Instance", func() {
+		It("returns a pointer to the instance", func() {
+			instance := repository.Instance{
+				ID:   "instance-id",
+				Host: "127.0.0.1",
+				Port: "11111",
+			}
+			state.AddInstance(instance)
+
+			fetchedInstance, err := state.Instance("instance-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fetchedInstance).To(Equal(&instance))
+		})
+
+		Context("when the instance doesn't exist", func() {
+			It("returns an error", func() {
+				_, err := state.Instance("instance-id")
+				Expect(err).To(MatchError("Instance not found"))
+			})
+		})
+	})
+
+	Describe("Instances", func() {
+		It("returns every instance sorted by ID", func() {
+			state, err := newState(location, 3)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(state.AddInstance(repository.Instance{ID: "instance-b", Host: "127.0.0.1", Port: "11212"})).To(Succeed())
+			Expect(state.AddInstance(repository.Instance{ID: "instance-a", Host: "127.0.0.1", Port: "11211"})).To(Succeed())
+
+			instances, err := state.Instances()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(instances).To(Equal([]repository.Instance{
+				{ID: "instance-a", Host: "127.0.0.1", Port: "11211"},
+				{ID: "instance-b", Host: "127.0.0.1", Port: "11212"},
+			}))
+		})
+
+		Context("when there are no instances", func() {
+			It("returns an empty list", func() {
+				instances, err := state.Instances()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(instances).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("AddInstance", func() {
+		It("adds the instance to the object", func() {
+			instance := repository.Instance{
+				ID:   "instance-id",
+				Host: "127.0.0.1",
+				Port: "11111",
+			}
+
+			err := state.AddInstance(instance)
+			Expect(err).ToNot(HaveOccurred())
+
+			fetchedInstance, err := state.Instance("instance-id")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(fetchedInstance).To(Equal(&instance))
+		})
+
+		It("updates the capacity", func() {
+			capacityBefore := state.AvailableInstances()
+			err := state.AddInstance(repository.Instance{ID: "instance-id"})
+			Expect(err).ToNot(HaveOccurred())
+
+			capacityNow := state.AvailableInstances()
+			Expect(capacityNow).To(Equal(capacityBefore - 1))
+		})
+
+		It("persists the change on disk", func() {
+			instance := repository.Instance{
+				ID:       "instance-id",
+				Host:     "127.0.0.1",
+				Port:     "11111",
+				Bindings: []string{},
+			}
+
+			err := state.AddInstance(instance)
+			Expect(err).ToNot(HaveOccurred())
+
+			reopenedState, err := newState(location, -10)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(reopenedState.AvailableInstances()).To(Equal(state.AvailableInstances()))
+
+			fetchedInstance, err := reopenedState.Instance("instance-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fetchedInstance).To(Equal(&instance))
+		})
+
+		Context("when there's no capacity left", func() {
+			BeforeEach(func() {
+				var err error
+				state, err = newState(location, 0)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("returns an error", func() {
+				err := state.AddInstance(repository.Instance{ID: "instance-id"})
+				Expect(err).To(MatchError("Can't allocate instance, no capacity"))
+			})
+		})
+
+		Context("when another instance has the same address", func() {
+			BeforeEach(func() {
+				var err error
+				state, err = newState(location, 2)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(state.AddInstance(repository.Instance{ID: "instance-id", Host: "127.0.0.1", Port: "11211"})).To(Succeed())
+			})
+
+			It("returns an error", func() {
+				err := state.AddInstance(repository.Instance{ID: "other-instance-id", Host: "127.0.0.1", Port: "11211"})
+				Expect(err).To(MatchError("Instance address is taken"))
+				Expect(state.AvailableInstances()).To(Equal(1))
+			})
+		})
+
+		Context("when the instance id is taken", func() {
+			BeforeEach(func() {
+				var err error
+				state, err = newState(location, 5)
+				Expect(err).ToNot(HaveOccurred())
+				err = state.AddInstance(repository.Instance{ID: "instance-id"})
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("returns an error", func() {
+				err := state.AddInstance(repository.Instance{ID: "instance-id"})
+				Expect(err).To(MatchError("Instance ID is taken"))
+			})
+		})
+	})
+
+	Describe("UpdateInstance", func() {
+		BeforeEach(func() {
+			instance := repository.Instance{
+				ID:   "instance-id",
+				Host: "127.0.0.1",
+				Port: "11111",
+			}
+
+			err := state.AddInstance(instance)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("updates the instance", func() {
+			newInstance := repository.Instance{
+				ID:   "instance-id",
+				Host: "0.0.0.0",
+				Port: "2222",
+			}
+
+			err := state.UpdateInstance(newInstance)
+			Expect(err).ToNot(HaveOccurred())
+
+			fetchedInstance, err := state.Instance("instance-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fetchedInstance).To(Equal(&newInstance))
+		})
+
+		It("persists the change on disk", func() {
+			newInstance := repository.Instance{
+				ID:       "instance-id",
+				Host:     "0.0.0.0",
+				Port:     "2222",
+				Bindings: []string{},
+			}
+
+			err := state.UpdateInstance(newInstance)
+			Expect(err).ToNot(HaveOccurred())
+
+			reopenedState, err := newState(location, -10)
+			Expect(err).ToNot(HaveOccurred())
+
+			fetchedInstance, err := reopenedState.Instance("instance-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fetchedInstance).To(Equal(&newInstance))
+		})
+
+		Context("when the instance is not found", func() {
+			It("returns an error", func() {
+				err := state.UpdateInstance(repository.Instance{ID: "instance-id-2"})
+				Expect(err).To(MatchError("Instance not found"))
+			})
+		})
+	})
+
+	Describe("DeleteInstance", func() {
+		BeforeEach(func() {
+			state.AddInstance(repository.Instance{ID: "instance-id"})
+		})
+
+		It("removes the instance", func() {
+			err := state.DeleteInstance("instance-id")
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = state.Instance("instance-id")
+			Expect(err).To(MatchError("Instance not found"))
+		})
+
+		It("updates the capacity", func() {
+			capacityBefore := state.AvailableInstances()
+			err := state.DeleteInstance("instance-id")
+			Expect(err).ToNot(HaveOccurred())
+
+			capacityNow := state.AvailableInstances()
+			Expect(capacityNow).To(Equal(capacityBefore + 1))
+		})
+
+		It("persists the change on disk", func() {
+			capacityBefore := state.AvailableInstances()
+			err := state.DeleteInstance("instance-id")
+			Expect(err).ToNot(HaveOccurred())
+
+			reopenedState, err := newState(location, -10)
+			Expect(err).ToNot(HaveOccurred())
+
+			fetchedCapacity := reopenedState.AvailableInstances()
+			Expect(fetchedCapacity).To(Equal(capacityBefore + 1))
+
+			Expect(reopenedState.InstanceExists("instance-id")).To(BeFalse())
+		})
+
+		Context("when there's no instance with the given id", func() {
+			It("returns an error", func() {
+				err := state.DeleteInstance("instance-id-2")
+				Expect(err).To(MatchError("Instance not found"))
+			})
+		})
+	})
+
+	Describe("InstanceBindingExists", func() {
+		Context("when the binding exists for the given instance", func() {
+			BeforeEach(func() {
+				instance := repository.Instance{
+					ID:       "instance-id",
+					Bindings: []string{"binding-1"},
+				}
+				state.AddInstance(instance)
+			})
+
+			It("returns true", func() {
+				Expect(state.InstanceBindingExists("instance-id", "binding-1")).To(BeTrue())
+			})
+		})
+
+		Context("when the instance doesn't exist", func() {
+			It("returns false", func() {
+				Expect(state.InstanceBindingExists("instance-id", "binding-1")).To(BeFalse())
+			})
+		})
+
+		Context("when the instance binding doesn't exist", func() {
+			BeforeEach(func() {
+				state.AddInstance(repository.Instance{ID: "instance-id"})
+			})
+
+			It("returns false", func() {
+				Expect(state.InstanceBindingExists("instance-id", "binding-1")).To(BeFalse())
+			})
+		})
+	})
+
+	Describe("AddInstanceBinding", func() {
+		BeforeEach(func() {
+			instance := repository.Instance{
+				ID:       "instance-id",
+				Host:     "127.0.0.1",
+				Port:     "11111",
+				Bindings: []string{"existing-binding"},
+			}
+
+			err := state.AddInstance(instance)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("adds the binding to the instance", func() {
+			err := state.AddInstanceBinding("instance-id", "binding-1")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(state.InstanceBindingExists("instance-id", "binding-1")).To(BeTrue())
+		})
+
+		Context("when the instance doesn't exist", func() {
+			It("returns an error", func() {
+				err := state.AddInstanceBinding("instance-id-2", "binding-1")
+				Expect(err).To(MatchError("Instance not found"))
+			})
+		})
+
+		Context("when the binding id is already taken", func() {
+			It("returns an error", func() {
+				err := state.AddInstanceBinding("instance-id", "existing-binding")
+				Expect(err).To(MatchError("Binding ID is taken"))
+			})
+		})
+	})
+
+	Describe("DeleteInstanceBinding", func() {
+		BeforeEach(func() {
+			instance := repository.Instance{
+				ID:       "instance-id",
+				Host:     "127.0.0.1",
+				Port:     "11111",
+				Bindings: []string{"existing-binding"},
+			}
+
+			err := state.AddInstance(instance)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("deletes the binding from the instance", func() {
+			err := state.DeleteInstanceBinding("instance-id", "existing-binding")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(state.InstanceBindingExists("instance-id", "existing-binding")).To(BeFalse())
+		})
+
+		Context("when the instance doesn't exist", func() {
+			It("returns an error", func() {
+				err := state.DeleteInstanceBinding("instance-id-2", "binding-1")
+				Expect(err).To(MatchError("Instance not found"))
+			})
+		})
+
+		Context("when the binding id doesn't exist", func() {
+			It("returns an error", func() {
+				err := state.DeleteInstanceBinding("instance-id", "binding-1")
+				Expect(err).To(MatchError("Binding not found"))
+			})
+		})
+	})
+
+	Describe("instance parameters", func() {
+		BeforeEach(func() {
+			err := state.AddInstance(repository.Instance{ID: "instance-id"})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("has none by default", func() {
+			parameters, err := state.InstanceParameters("instance-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(parameters).To(BeEmpty())
+		})
+
+		It("keeps the parameters of the instance", func() {
+			Expect(state.SaveInstanceParameters("instance-id", `{"eviction":false}`)).To(Succeed())
+
+			parameters, err := state.InstanceParameters("instance-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(parameters).To(Equal(`{"eviction":false}`))
+		})
+
+		It("persists them on disk", func() {
+			Expect(state.SaveInstanceParameters("instance-id", `{"eviction":false}`)).To(Succeed())
+
+			reopened, err := newState(location, 1)
+			Expect(err).ToNot(HaveOccurred())
+
+			parameters, err := reopened.InstanceParameters("instance-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(parameters).To(Equal(`{"eviction":false}`))
+		})
+
+		It("keeps them when the instance is updated", func() {
+			Expect(state.SaveInstanceParameters("instance-id", `{"eviction":false}`)).To(Succeed())
+			Expect(state.UpdateInstance(repository.Instance{ID: "instance-id", PlanID: "other-plan"})).To(Succeed())
+
+			parameters, err := state.InstanceParameters("instance-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(parameters).To(Equal(`{"eviction":false}`))
+		})
+
+		It("drops them with the instance", func() {
+			Expect(state.SaveInstanceParameters("instance-id", `{"eviction":false}`)).To(Succeed())
+			Expect(state.DeleteInstance("instance-id")).To(Succeed())
+			Expect(state.AddInstance(repository.Instance{ID: "instance-id"})).To(Succeed())
+
+			parameters, err := state.InstanceParameters("instance-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(parameters).To(BeEmpty())
+		})
+
+		Context("when the instance doesn't exist", func() {
+			It("returns an error", func() {
+				Expect(state.SaveInstanceParameters("other-instance-id", "{}")).To(MatchError("Instance not found"))
+
+				_, err := state.InstanceParameters("other-instance-id")
+				Expect(err).To(MatchError("Instance not found"))
+			})
+		})
+	})
+
+	Describe("binding records", func() {
+		var binding storage.Binding
+
+		BeforeEach(func() {
+			binding = storage.Binding{
+				ID:         "binding-id",
+				InstanceID: "instance-id",
+				Credentials: storage.Credentials{
+					Username: "user",
+					Password: "secret",
+				},
+				ServiceID:  "service-id",
+				PlanID:     "plan-id",
+				AppGUID:    "app-guid",
+				Parameters: `{"ttl":60}`,
+			}
+
+			err := state.AddInstance(repository.Instance{ID: "instance-id", Bindings: []string{"old-binding"}})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("adds the binding to the instance", func() {
+			Expect(state.AddBinding(binding)).To(Succeed())
+
+			instance, err := state.Instance("instance-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(instance.Bindings).To(Equal([]string{"old-binding", "binding-id"}))
+		})
+
+		It("keeps the record of the binding", func() {
+			Expect(state.AddBinding(binding)).To(Succeed())
+
+			fetchedBinding, err := state.Binding("instance-id", "binding-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fetchedBinding).To(Equal(&binding))
+		})
+
+		It("persists the record on disk", func() {
+			Expect(state.AddBinding(binding)).To(Succeed())
+
+			reopened, err := newState(location, 1)
+			Expect(err).ToNot(HaveOccurred())
+
+			fetchedBinding, err := reopened.Binding("instance-id", "binding-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fetchedBinding).To(Equal(&binding))
+		})
+
+		It("keeps the record when the instance is updated", func() {
+			Expect(state.AddBinding(binding)).To(Succeed())
+
+			instance, err := state.Instance("instance-id")
+			Expect(err).ToNot(HaveOccurred())
+			instance.PlanID = "other-plan"
+			Expect(state.UpdateInstance(*instance)).To(Succeed())
+
+			fetchedBinding, err := state.Binding("instance-id", "binding-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fetchedBinding).To(Equal(&binding))
+		})
+
+		It("drops the record with the binding", func() {
+			Expect(state.AddBinding(binding)).To(Succeed())
+			Expect(state.DeleteInstanceBinding("instance-id", "binding-id")).To(Succeed())
+
+			_, err := state.Binding("instance-id", "binding-id")
+			Expect(err).To(MatchError("Binding not found"))
+
+			Expect(state.AddInstanceBinding("instance-id", "binding-id")).To(Succeed())
+			fetchedBinding, err := state.Binding("instance-id", "binding-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fetchedBinding.Credentials).To(Equal(storage.Credentials{}))
+		})
+
+		It("gives bindings without a record an empty one", func() {
+			fetchedBinding, err := state.Binding("instance-id", "old-binding")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fetchedBinding).To(Equal(&storage.Binding{ID: "old-binding", InstanceID: "instance-id"}))
+		})
+
+		Context("when the binding id is already taken", func() {
+			It("returns an error", func() {
+				binding.ID = "old-binding"
+				Expect(state.AddBinding(binding)).To(MatchError("Binding ID is taken"))
+			})
+		})
+
+		Context("when the instance doesn't exist", func() {
+			It("returns an error", func() {
+				binding.InstanceID = "other-instance-id"
+				Expect(state.AddBinding(binding)).To(MatchError("Instance not found"))
+
+				_, err := state.Binding("other-instance-id", "binding-id")
+				Expect(err).To(MatchError("Instance not found"))
+			})
+		})
+
+		Context("when the binding doesn't exist", func() {
+			It("returns an error", func() {
+				_, err := state.Binding("instance-id", "binding-id")
+				Expect(err).To(MatchError("Binding not found"))
+			})
+		})
+	})
+
+	Describe("operations", func() {
+		var operation storage.Operation
+
+		BeforeEach(func() {
+			operation = storage.Operation{
+				ID:         "operation-id",
+				InstanceID: "instance-id",
+				Type:       storage.ProvisionOperation,
+				State:      storage.OperationInProgress,
+			}
+
+			err := state.AddInstance(repository.Instance{ID: "instance-id"})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("keeps the last operation of the instance", func() {
+			Expect(state.SaveOperation(operation)).To(Succeed())
+
+			operation.State = storage.OperationFailed
+			operation.Description = "It broke"
+			Expect(state.SaveOperation(operation)).To(Succeed())
+
+			fetchedOperation, err := state.Operation("instance-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fetchedOperation).To(Equal(&operation))
+		})
+
+		It("persists the operation on disk", func() {
+			operation.Type = storage.UpdateOperation
+			operation.PlanID = "other-plan"
+			Expect(state.SaveOperation(operation)).To(Succeed())
+
+			reopened, err := newState(location, 1)
+			Expect(err).ToNot(HaveOccurred())
+
+			fetchedOperation, err := reopened.Operation("instance-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fetchedOperation).To(Equal(&operation))
+		})
+
+		It("drops the operation with the instance", func() {
+			Expect(state.SaveOperation(operation)).To(Succeed())
+			Expect(state.DeleteInstance("instance-id")).To(Succeed())
+			Expect(state.AddInstance(repository.Instance{ID: "instance-id"})).To(Succeed())
+
+			_, err := state.Operation("instance-id")
+			Expect(err).To(MatchError("Operation not found"))
+		})
+
+		Context("when the instance doesn't exist", func() {
+			It("returns an error", func() {
+				operation.InstanceID = "other-instance-id"
+				Expect(state.SaveOperation(operation)).To(MatchError("Instance not found"))
+
+				_, err := state.Operation("other-instance-id")
+				Expect(err).To(MatchError("Instance not found"))
+			})
+		})
+
+		Describe("of bindings", func() {
+			BeforeEach(func() {
+				operation.BindingID = "binding-id"
+				operation.Type = storage.BindOperation
+
+				Expect(state.AddInstanceBinding("instance-id", "binding-id")).To(Succeed())
+			})
+
+			It("keeps them apart from the operation of the instance", func() {
+				Expect(state.SaveOperation(operation)).To(Succeed())
+
+				fetchedOperation, err := state.BindingOperation("instance-id", "binding-id")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(fetchedOperation).To(Equal(&operation))
+
+				_, err = state.Operation("instance-id")
+				Expect(err).To(MatchError("Operation not found"))
+			})
+
+			It("persists them on disk", func() {
+				Expect(state.SaveOperation(operation)).To(Succeed())
+
+				reopened, err := newState(location, 1)
+				Expect(err).ToNot(HaveOccurred())
+
+				fetchedOperation, err := reopened.BindingOperation("instance-id", "binding-id")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(fetchedOperation).To(Equal(&operation))
+			})
+
+			It("drops them with the binding", func() {
+				Expect(state.SaveOperation(operation)).To(Succeed())
+				Expect(state.DeleteInstanceBinding("instance-id", "binding-id")).To(Succeed())
+				Expect(state.AddInstanceBinding("instance-id", "binding-id")).To(Succeed())
+
+				_, err := state.BindingOperation("instance-id", "binding-id")
+				Expect(err).To(MatchError("Operation not found"))
+			})
+
+			It("drops them when the instance no longer has the binding", func() {
+				Expect(state.SaveOperation(operation)).To(Succeed())
+
+				instance, err := state.Instance("instance-id")
+				Expect(err).ToNot(HaveOccurred())
+				instance.Bindings = []string{}
+				Expect(state.UpdateInstance(*instance)).To(Succeed())
+				Expect(state.AddInstanceBinding("instance-id", "binding-id")).To(Succeed())
+
+				_, err = state.BindingOperation("instance-id", "binding-id")
+				Expect(err).To(MatchError("Operation not found"))
+			})
+
+			Context("when the binding doesn't exist", func() {
+				It("returns an error", func() {
+					operation.BindingID = "other-binding-id"
+					Expect(state.SaveOperation(operation)).To(MatchError("Binding not found"))
+
+					_, err := state.BindingOperation("instance-id", "other-binding-id")
+					Expect(err).To(MatchError("Binding not found"))
+				})
+			})
+		})
+	})
+
+	Describe("plan sizes", func() {
+		var sizes map[string]int
+
+		BeforeEach(func() {
+			sizes = map[string]int{"small-plan": 100, "large-plan": 1024}
+
+			var err error
+			state, err = newState(location, 1200, storage.WithPlanSizes(sizes))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("charges the size of the plan", func() {
+			Expect(state.AddInstance(repository.Instance{ID: "instance-id", PlanID: "large-plan"})).To(Succeed())
+			Expect(state.AvailableInstances()).To(Equal(176))
+		})
+
+		It("charges a single unit for plans without a size", func() {
+			Expect(state.AddInstance(repository.Instance{ID: "instance-id", PlanID: "other-plan"})).To(Succeed())
+			Expect(state.AvailableInstances()).To(Equal(1199))
+		})
+
+		It("reports the available instances of each plan", func() {
+			Expect(state.AvailablePlanInstances("small-plan")).To(Equal(12))
+			Expect(state.AvailablePlanInstances("large-plan")).To(Equal(1))
+
+			Expect(state.AddInstance(repository.Instance{ID: "instance-id", PlanID: "small-plan"})).To(Succeed())
+			Expect(state.AvailablePlanInstances("small-plan")).To(Equal(11))
+			Expect(state.AvailablePlanInstances("large-plan")).To(Equal(1))
+
+			Expect(state.AddInstance(repository.Instance{ID: "other-instance-id", PlanID: "small-plan"})).To(Succeed())
+			Expect(state.AvailablePlanInstances("large-plan")).To(Equal(0))
+		})
+
+		It("refunds the size of the plan on delete", func() {
+			Expect(state.AddInstance(repository.Instance{ID: "instance-id", PlanID: "large-plan"})).To(Succeed())
+			Expect(state.DeleteInstance("instance-id")).To(Succeed())
+			Expect(state.AvailableInstances()).To(Equal(1200))
+		})
+
+		Context("when the plan doesn't fit in the remaining capacity", func() {
+			BeforeEach(func() {
+				Expect(state.AddInstance(repository.Instance{ID: "small-id", PlanID: "small-plan"})).To(Succeed())
+				Expect(state.AddInstance(repository.Instance{ID: "other-small-id", PlanID: "small-plan"})).To(Succeed())
+			})
+
+			It("refuses the instance", func() {
+				err := state.AddInstance(repository.Instance{ID: "instance-id", PlanID: "large-plan"})
+				Expect(err).To(MatchError("Can't allocate instance, no capacity"))
+				Expect(state.InstanceExists("instance-id")).To(BeFalse())
+				Expect(state.AvailableInstances()).To(Equal(1000))
+			})
+		})
+
+		Describe("changing the plan", func() {
+			BeforeEach(func() {
+				Expect(state.AddInstance(repository.Instance{ID: "instance-id", PlanID: "small-plan"})).To(Succeed())
+			})
+
+			It("charges the difference on upgrades", func() {
+				Expect(state.UpdateInstance(repository.Instance{ID: "instance-id", PlanID: "large-plan"})).To(Succeed())
+				Expect(state.AvailableInstances()).To(Equal(176))
+			})
+
+			It("refunds the difference on downgrades", func() {
+				Expect(state.UpdateInstance(repository.Instance{ID: "instance-id", PlanID: "large-plan"})).To(Succeed())
+				Expect(state.UpdateInstance(repository.Instance{ID: "instance-id", PlanID: "small-plan"})).To(Succeed())
+				Expect(state.AvailableInstances()).To(Equal(1100))
+			})
+
+			It("refunds what was charged last on delete", func() {
+				Expect(state.UpdateInstance(repository.Instance{ID: "instance-id", PlanID: "large-plan"})).To(Succeed())
+				Expect(state.DeleteInstance("instance-id")).To(Succeed())
+				Expect(state.AvailableInstances()).To(Equal(1200))
+			})
+
+			It("tells whether the new plan fits", func() {
+				Expect(state.PlanChangeFits("instance-id", "large-plan")).To(BeTrue())
+				Expect(state.PlanChangeFits("instance-id", "small-plan")).To(BeTrue())
+				Expect(state.PlanChangeFits("unknown-id", "small-plan")).To(BeFalse())
+			})
+
+			Context("when the difference doesn't fit in the remaining capacity", func() {
+				BeforeEach(func() {
+					Expect(state.AddInstance(repository.Instance{ID: "other-id", PlanID: "small-plan"})).To(Succeed())
+					Expect(state.AddInstance(repository.Instance{ID: "another-id", PlanID: "small-plan"})).To(Succeed())
+				})
+
+				It("tells that the new plan doesn't fit", func() {
+					Expect(state.PlanChangeFits("instance-id", "large-plan")).To(BeFalse())
+					Expect(state.PlanChangeFits("instance-id", "small-plan")).To(BeTrue())
+				})
+
+				It("keeps the instance on its plan", func() {
+					err := state.UpdateInstance(repository.Instance{ID: "instance-id", PlanID: "large-plan"})
+					Expect(err).To(MatchError("Can't allocate instance, no capacity"))
+
+					instance, err := state.Instance("instance-id")
+					Expect(err).ToNot(HaveOccurred())
+					Expect(instance.PlanID).To(Equal("small-plan"))
+					Expect(state.AvailableInstances()).To(Equal(900))
+				})
+			})
+		})
+
+		It("refunds what was charged even if the sizes changed since", func() {
+			Expect(state.AddInstance(repository.Instance{ID: "instance-id", PlanID: "large-plan"})).To(Succeed())
+
+			sizes["large-plan"] = 2048
+			reopened, err := newState(location, 1200, storage.WithPlanSizes(sizes))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(reopened.DeleteInstance("instance-id")).To(Succeed())
+			Expect(reopened.AvailableInstances()).To(Equal(1200))
+		})
+	})
+
+	Describe("concurrent use", func() {
+		const workers = 50
+
+		run := func(work func(i int)) {
+			var wg sync.WaitGroup
+			for i := 0; i < workers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					work(i)
+				}(i)
+			}
+			wg.Wait()
+		}
+
+		BeforeEach(func() {
+			var err error
+			state, err = newState(location, workers/2)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("never allocates more instances than the capacity", func() {
+			var lock sync.Mutex
+			added := 0
+
+			run(func(i int) {
+				err := state.AddInstance(repository.Instance{ID: fmt.Sprintf("instance-%d", i)})
+				if err == nil {
+					lock.Lock()
+					added++
+					lock.Unlock()
+				}
+			})
+
+			Expect(added).To(Equal(workers / 2))
+			Expect(state.AvailableInstances()).To(Equal(0))
+		})
+
+		It("gives a binding id to a single caller", func() {
+			err := state.AddInstance(repository.Instance{ID: "instance-id"})
+			Expect(err).ToNot(HaveOccurred())
+
+			var lock sync.Mutex
+			added := 0
+
+			run(func(i int) {
+				err := state.AddInstanceBinding("instance-id", "binding-id")
+				if err == nil {
+					lock.Lock()
+					added++
+					lock.Unlock()
+				}
+			})
+
+			Expect(added).To(Equal(1))
+		})
+
+		It("doesn't lose bindings added in parallel", func() {
+			err := state.AddInstance(repository.Instance{ID: "instance-id"})
+			Expect(err).ToNot(HaveOccurred())
+
+			run(func(i int) {
+				err := state.AddInstanceBinding("instance-id", fmt.Sprintf("binding-%d", i))
+				Expect(err).ToNot(HaveOccurred())
+
+				state.InstanceBindingExists("instance-id", "binding-0")
+				state.Instance("instance-id")
+			})
+
+			instance, err := state.Instance("instance-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(instance.Bindings).To(HaveLen(workers))
+		})
+
+		It("keeps the capacity consistent while adding and deleting", func() {
+			run(func(i int) {
+				instanceID := fmt.Sprintf("instance-%d", i)
+				if state.AddInstance(repository.Instance{ID: instanceID}) == nil {
+					state.AvailableInstances()
+					Expect(state.DeleteInstance(instanceID)).To(Succeed())
+				}
+			})
+
+			Expect(state.AvailableInstances()).To(Equal(workers / 2))
+		})
+	})
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v2"
+)
+
+// CurrentStateVersion is the version of the state documents written by the
+// file based backends.
+const CurrentStateVersion = 3
+
+type stateDocument map[interface{}]interface{}
+
+// stateMigrations[n] upgrades a state document from version n to n+1. Add a
+// migration, and a fixture in assets/, whenever State or
+// repository.Instance change in a way older documents don't decode into.
+var stateMigrations = []func(document stateDocument) error{
+	// 0: documents written before the version header was introduced.
+	func(document stateDocument) error {
+		return nil
+	},
+	// 1: every instance took a single unit of capacity.
+	func(document stateDocument) error {
+		instances, _ := document["instances"].(map[interface{}]interface{})
+
+		charges := map[interface{}]interface{}{}
+		for instanceID := range instances {
+			charges[instanceID] = 1
+		}
+
+		document["charges"] = charges
+		return nil
+	},
+	// 2: bindings had no records.
+	func(document stateDocument) error {
+		document["bindings"] = map[interface{}]interface{}{}
+		return nil
+	},
+}
+
+// decodeState unmarshals a state document into out, upgrading it to the
+// current version first. It returns the version the document was written
+// with.
+func decodeState(rawData []byte, out interface{}) (int, error) {
+	document := stateDocument{}
+	err := yaml.Unmarshal(rawData, &document)
+	if err != nil {
+		return 0, err
+	}
+
+	version, err := documentVersion(document)
+	if err != nil {
+		return 0, err
+	}
+
+	if version > CurrentStateVersion {
+		return 0, fmt.Errorf("State version %d is newer than the supported version %d", version, CurrentStateVersion)
+	}
+
+	if version < CurrentStateVersion {
+		for v := version; v < CurrentStateVersion; v++ {
+			err = stateMigrations[v](document)
+			if err != nil {
+				return 0, fmt.Errorf("Failed to migrate state from version %d: %s", v, err.Error())
+			}
+		}
+
+		document["version"] = CurrentStateVersion
+		rawData, err = yaml.Marshal(document)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return version, yaml.Unmarshal(rawData, out)
+}
+
+// decodeStateFile decodes the state document read from location. When the
+// document gets upgraded and the backup option is set, the original is
+// copied to location.v<version> first.
+func decodeStateFile(location string, rawData []byte, out interface{}, opts options) error {
+	version, err := decodeState(rawData, out)
+	if err != nil {
+		return err
+	}
+
+	if version == CurrentStateVersion || !opts.migrationBackup {
+		return nil
+	}
+
+	backupLocation := fmt.Sprintf("%s.v%d", location, version)
+	if _, err := os.Stat(backupLocation); err == nil {
+		return nil
+	}
+
+	return writeFileAtomic(backupLocation, "", rawData, 0600)
+}
+
+func documentVersion(document stateDocument) (int, error) {
+	rawVersion, exists := document["version"]
+	if !exists {
+		return 0, nil
+	}
+
+	version, ok := rawVersion.(int)
+	if !ok || version < 0 {
+		return 0, fmt.Errorf("Invalid state version: %v", rawVersion)
+	}
+
+	return version, nil
+}
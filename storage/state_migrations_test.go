@@ -0,0 +1,143 @@
+package storage_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tscolari/cf-broker-api/common/repository"
+	"github.com/tscolari/memcached-broker/storage"
+)
+
+var _ = Describe("State migrations", func() {
+	var tempFileName string
+
+	copyFixture := func(version int) []byte {
+		rawData, err := ioutil.ReadFile(fmt.Sprintf("./assets/state.v%d.yml", version))
+		Expect(err).ToNot(HaveOccurred())
+
+		err = ioutil.WriteFile(tempFileName, rawData, 0600)
+		Expect(err).ToNot(HaveOccurred())
+		return rawData
+	}
+
+	BeforeEach(func() {
+		dir, err := ioutil.TempDir("/tmp/", "state-migrations")
+		Expect(err).ToNot(HaveOccurred())
+
+		tempFileName = fmt.Sprintf("%s/state.yml", dir)
+	})
+
+	for version := 0; version <= storage.CurrentStateVersion; version++ {
+		version := version
+
+		Context(fmt.Sprintf("when the state file has version %d", version), func() {
+			BeforeEach(func() {
+				copyFixture(version)
+			})
+
+			It("loads the state", func() {
+				localFile, err := storage.NewLocalFile(tempFileName, -10)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(localFile.AvailableInstances()).To(Equal(3))
+
+				instance, err := localFile.Instance("instance-1")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(instance).To(Equal(&repository.Instance{
+					ID:             "instance-1",
+					ServiceID:      "service-1",
+					PlanID:         "plan-1",
+					OrganizationID: "org-1",
+					SpaceID:        "space-1",
+					Host:           "127.0.0.1",
+					Port:           "11211",
+					Bindings:       []string{"binding-1"},
+				}))
+			})
+
+			It("keeps the binding records", func() {
+				localFile, err := storage.NewLocalFile(tempFileName, -10)
+				Expect(err).ToNot(HaveOccurred())
+
+				binding, err := localFile.Binding("instance-1", "binding-1")
+				Expect(err).ToNot(HaveOccurred())
+
+				if version < 3 {
+					Expect(binding.Credentials).To(Equal(storage.Credentials{}))
+				} else {
+					Expect(binding.Credentials).To(Equal(storage.Credentials{Username: "user-1", Password: "password-1"}))
+				}
+			})
+
+			It("refunds what the instance was charged", func() {
+				localFile, err := storage.NewLocalFile(tempFileName, -10, storage.WithPlanSizes(map[string]int{"plan-1": 2}))
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(localFile.DeleteInstance("instance-1")).To(Succeed())
+				Expect(localFile.AvailableInstances()).To(Equal(4))
+			})
+
+			It("writes the current version on the next save", func() {
+				localFile, err := storage.NewLocalFile(tempFileName, -10)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(localFile.Save()).To(Succeed())
+
+				rawData, err := ioutil.ReadFile(tempFileName)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(rawData)).To(HavePrefix(fmt.Sprintf("version: %d\n", storage.CurrentStateVersion)))
+			})
+
+			It("loads it as a journal snapshot", func() {
+				journal, err := storage.NewJournal(tempFileName, -10)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(journal.AvailableInstances()).To(Equal(3))
+				Expect(journal.InstanceBindingExists("instance-1", "binding-1")).To(BeTrue())
+			})
+		})
+	}
+
+	Context("when the state file is older than the current version", func() {
+		var original []byte
+
+		BeforeEach(func() {
+			original = copyFixture(0)
+		})
+
+		It("doesn't keep a backup by default", func() {
+			_, err := storage.NewLocalFile(tempFileName, -10)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = os.Stat(tempFileName + ".v0")
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		Context("and the migration backup is enabled", func() {
+			It("keeps a copy of the original file", func() {
+				localFile, err := storage.NewLocalFile(tempFileName, -10, storage.WithMigrationBackup())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(localFile.Save()).To(Succeed())
+
+				backup, err := ioutil.ReadFile(tempFileName + ".v0")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(backup).To(Equal(original))
+			})
+		})
+	})
+
+	Context("when the state file is newer than the current version", func() {
+		BeforeEach(func() {
+			err := ioutil.WriteFile(tempFileName, []byte("version: 999\ncapacity: 1\ninstances: {}\n"), 0600)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("refuses to load it", func() {
+			_, err := storage.NewLocalFile(tempFileName, 1)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("newer than the supported version"))
+		})
+	})
+})
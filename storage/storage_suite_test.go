@@ -4,10 +4,43 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"fmt"
+	"os"
+	"strconv"
 	"testing"
+
+	"github.com/tscolari/memcached-broker/storage"
 )
 
 func TestStorage(t *testing.T) {
+	if location := os.Getenv("STORAGE_TEST_WRITER_FILE"); location != "" {
+		runWriter(t, location)
+		return
+	}
+
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Storage Suite")
 }
+
+// runWriter is the body of the writer processes forked by the LocalFile
+// tests: it adds STORAGE_TEST_WRITER_BINDINGS bindings to "instance-id".
+func runWriter(t *testing.T, location string) {
+	name := os.Getenv("STORAGE_TEST_WRITER_NAME")
+	bindings, err := strconv.Atoi(os.Getenv("STORAGE_TEST_WRITER_BINDINGS"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	localFile, err := storage.NewLocalFile(location, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer localFile.Close()
+
+	for i := 0; i < bindings; i++ {
+		err := localFile.AddInstanceBinding("instance-id", fmt.Sprintf("%s-%d", name, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
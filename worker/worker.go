@@ -0,0 +1,73 @@
+package worker
+
+import "sync"
+
+// DefaultWorkers is how many jobs a Pool runs at the same time, unless
+// configured otherwise.
+const DefaultWorkers = 4
+
+//go:generate counterfeiter . Queue
+
+// Queue runs jobs in the background, so requests can answer before the
+// work they started is done.
+type Queue interface {
+	Enqueue(job func())
+}
+
+func NewPool(workers int) *Pool {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+
+	pool := &Pool{jobs: make(chan func(), 64)}
+	for i := 0; i < workers; i++ {
+		pool.running.Add(1)
+		go pool.work()
+	}
+
+	return pool
+}
+
+// Pool runs the jobs it is given on a fixed number of goroutines, in the
+// order they were enqueued. Enqueue blocks while every worker is busy and
+// the backlog is full.
+type Pool struct {
+	jobs    chan func()
+	running sync.WaitGroup
+	lock    sync.RWMutex
+	stopped bool
+}
+
+var _ Queue = &Pool{}
+
+// Enqueue schedules the job. Jobs enqueued after Stop are dropped.
+func (p *Pool) Enqueue(job func()) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	if p.stopped {
+		return
+	}
+
+	p.jobs <- job
+}
+
+// Stop waits for the jobs enqueued so far to finish.
+func (p *Pool) Stop() {
+	p.lock.Lock()
+	if !p.stopped {
+		p.stopped = true
+		close(p.jobs)
+	}
+	p.lock.Unlock()
+
+	p.running.Wait()
+}
+
+func (p *Pool) work() {
+	defer p.running.Done()
+
+	for job := range p.jobs {
+		job()
+	}
+}
@@ -0,0 +1,65 @@
+package worker_test
+
+import (
+	"sync"
+
+	"github.com/tscolari/memcached-broker/worker"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Pool", func() {
+	var pool *worker.Pool
+
+	BeforeEach(func() {
+		pool = worker.NewPool(2)
+	})
+
+	AfterEach(func() {
+		pool.Stop()
+	})
+
+	It("runs the jobs in the background", func() {
+		release := make(chan struct{})
+		done := make(chan string, 2)
+
+		pool.Enqueue(func() {
+			<-release
+			done <- "first"
+		})
+		pool.Enqueue(func() {
+			done <- "second"
+		})
+
+		Eventually(done).Should(Receive(Equal("second")))
+		close(release)
+		Eventually(done).Should(Receive(Equal("first")))
+	})
+
+	Describe("Stop", func() {
+		It("waits for the enqueued jobs", func() {
+			var lock sync.Mutex
+			finished := 0
+			for i := 0; i < 10; i++ {
+				pool.Enqueue(func() {
+					lock.Lock()
+					defer lock.Unlock()
+					finished++
+				})
+			}
+
+			pool.Stop()
+			Expect(finished).To(Equal(10))
+		})
+
+		It("drops the jobs enqueued afterwards", func() {
+			pool.Stop()
+
+			ran := false
+			pool.Enqueue(func() { ran = true })
+			pool.Stop()
+			Expect(ran).To(BeFalse())
+		})
+	})
+})